@@ -119,8 +119,8 @@ func buildConfigHandler(
 		rulerURL,
 		disableAPIAuthentication,
 	).ReplacePaths(rulerPathReplacement)
-	router.PathPrefix("/api/v1/ruler").HandlerFunc(rulerProxy.HandleWithProxy)
-	router.PathPrefix("/api/v1/rules").HandlerFunc(rulerProxy.HandleWithProxy)
+	handleWithConfigScopes(router, "/api/v1/ruler", rulerProxy)
+	handleWithConfigScopes(router, "/api/v1/rules", rulerProxy)
 
 	// Cortex Alertmanager config
 	alertmanagerPathReplacement := func(requrl *url.URL) string {
@@ -143,11 +143,20 @@ func buildConfigHandler(
 	).ReplacePaths(alertmanagerPathReplacement)
 	// We don't route /alertmanager for the Alertmanager UI since it isn't useful via curl.
 	// The Alertmanager UI can be viewed at '<tenant>.<cluster>.opstrace.io/alertmanager/'
-	router.PathPrefix("/api/v1/alerts").HandlerFunc(alertmanagerProxy.HandleWithProxy)
-	router.PathPrefix("/api/v1/multitenant_alertmanager").HandlerFunc(alertmanagerProxy.HandleWithProxy)
+	handleWithConfigScopes(router, "/api/v1/alerts", alertmanagerProxy)
+	handleWithConfigScopes(router, "/api/v1/multitenant_alertmanager", alertmanagerProxy)
 	return router
 }
 
+// Route requests for `pathPrefix` to `proxy`. Reading config (GET, HEAD)
+// requires the config:read scope, anything else the config:write scope.
+func handleWithConfigScopes(router *mux.Router, pathPrefix string, proxy *middleware.TenantReverseProxy) {
+	router.PathPrefix(pathPrefix).Methods(http.MethodGet, http.MethodHead).HandlerFunc(
+		proxy.HandleWithProxyRequiringScope(authenticator.ScopeConfigRead))
+	router.PathPrefix(pathPrefix).HandlerFunc(
+		proxy.HandleWithProxyRequiringScope(authenticator.ScopeConfigWrite))
+}
+
 func replacePathPrefix(url *url.URL, from string, to string) *string {
 	if strings.HasPrefix(url.Path, from) {
 		replaced := strings.Replace(url.Path, from, to, 1)
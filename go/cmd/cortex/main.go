@@ -21,8 +21,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -30,6 +32,8 @@ import (
 
 	"github.com/opstrace/opstrace/go/pkg/authenticator"
 	"github.com/opstrace/opstrace/go/pkg/middleware"
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
+	"github.com/opstrace/opstrace/go/pkg/selector"
 )
 
 var (
@@ -38,8 +42,17 @@ var (
 	cortexQuerierURL         string
 	cortexDistributorURL     string
 	tenantName               string
+	tenantsFile              string
+	tenantsGraphQLEndpoint   string
+	tenantsRefreshInterval   time.Duration
 	disableAPIAuthentication bool
 	allowPushRetries         bool
+	rateLimitConfigPath      string
+	rateLimitReloadInterval  time.Duration
+	pushLimitsConfigPath     string
+	pushRelabelConfigPath    string
+	pushMaxMessageSize       int
+	selectorPolicyPath       string
 )
 
 // The error code to use when replacing 429 errors with a consistently retryable error code.
@@ -102,6 +115,16 @@ func replacePushErrors(resp *http.Response) error {
 	return nil
 }
 
+// The response code for push requests exceeding the proxy's rate limits.
+// Follow the policy for the distributor's own 429 responses: a rate-limited
+// client is expected to retry later.
+func rateLimitedStatusCode() int {
+	if allowPushRetries {
+		return http.StatusTooManyRequests
+	}
+	return retryableStatusCode
+}
+
 func main() {
 	flag.StringVar(&listenAddress, "listen", "", "Endpoint for listening to incoming requests from the Internet")
 	flag.StringVar(&cortexQuerierURL, "cortex-querier-url", "", "Endpoint for reaching the cortex querier for reads")
@@ -111,7 +134,30 @@ func main() {
 		"",
 		"Endpoint for reaching the cortex distributor for writes",
 	)
-	flag.StringVar(&tenantName, "tenantname", "", "Name of the tenant that the API is serving")
+	flag.StringVar(
+		&tenantName,
+		"tenantname",
+		"",
+		"Name of the tenant that the API is serving. If not set, serve all tenants on the allow-list",
+	)
+	flag.StringVar(
+		&tenantsFile,
+		"tenants-file",
+		"",
+		"Multi-tenant mode: file with the names of the tenants to serve, one per line",
+	)
+	flag.StringVar(
+		&tenantsGraphQLEndpoint,
+		"tenants-graphql-endpoint",
+		"",
+		"Multi-tenant mode: serve the tenants in the Hasura tenant table, fetched via this GraphQL endpoint",
+	)
+	flag.DurationVar(
+		&tenantsRefreshInterval,
+		"tenants-refresh-interval",
+		30*time.Second,
+		"Multi-tenant mode: how often to re-read the tenant allow-list",
+	)
 	flag.StringVar(&loglevel, "loglevel", "info", "error|info|debug")
 	flag.BoolVar(
 		&disableAPIAuthentication,
@@ -129,6 +175,44 @@ func main() {
 		"Whether to allow write clients to receive retryable 429/500 errors on push requests",
 	)
 
+	flag.StringVar(
+		&rateLimitConfigPath,
+		"ratelimit-config",
+		"",
+		"YAML file with per-tenant push request and byte rate limits. If not set, do not limit",
+	)
+	flag.DurationVar(
+		&rateLimitReloadInterval,
+		"ratelimit-reload-interval",
+		10*time.Second,
+		"How often to check the rate limit config file for changes",
+	)
+	flag.StringVar(
+		&pushLimitsConfigPath,
+		"push-limits-config",
+		"",
+		"YAML file with per-tenant limits on the series in push requests",
+	)
+	flag.StringVar(
+		&pushRelabelConfigPath,
+		"push-relabel-config",
+		"",
+		"YAML file with per-tenant relabeling rules for the series in push requests",
+	)
+	flag.IntVar(
+		&pushMaxMessageSize,
+		"push-max-message-size",
+		remotewrite.DefaultMaxMessageSize,
+		"With -push-limits-config or -push-relabel-config: the maximum size of a push request in bytes, "+
+			"compressed or decompressed (0: unlimited)",
+	)
+	flag.StringVar(
+		&selectorPolicyPath,
+		"selector-policy",
+		"",
+		"YAML file with per-tenant label selectors that queries are restricted to",
+	)
+
 	flag.Parse()
 
 	level, lerr := log.ParseLevel(loglevel)
@@ -150,7 +234,11 @@ func main() {
 	log.Infof("cortex querier URL: %s", cortexqurl)
 	log.Infof("cortex distributor URL: %s", cortexdurl)
 	log.Infof("listen address: %s", listenAddress)
-	log.Infof("tenant name: %s", tenantName)
+	if tenantName != "" {
+		log.Infof("tenant name: %s", tenantName)
+	} else {
+		log.Infof("no tenant name set: multi-tenant mode")
+	}
 	log.Infof("API authentication enabled: %v", !disableAPIAuthentication)
 	log.Infof("Remapping retryable distributor errors: %v", !allowPushRetries)
 
@@ -160,30 +248,50 @@ func main() {
 
 	// See: https://github.com/cortexproject/cortex/blob/master/docs/api/_index.md
 	cortexTenantHeader := "X-Scope-OrgID"
-	querierProxy := middleware.NewReverseProxyFixedTenant(
-		tenantName,
-		cortexTenantHeader,
-		cortexqurl,
-		disableAPIAuthentication,
-	)
-	distributorProxy := middleware.NewReverseProxyFixedTenant(
-		tenantName,
-		cortexTenantHeader,
-		cortexdurl,
-		disableAPIAuthentication,
-	)
+	newProxy := newFixedTenantProxy
+	if tenantName == "" {
+		allowedTenants, err := middleware.NewTenantAllowListFromSource(
+			tenantsFile,
+			tenantsGraphQLEndpoint,
+			os.Getenv("HASURA_GRAPHQL_ADMIN_SECRET"),
+			tenantsRefreshInterval,
+		)
+		if err != nil {
+			log.Fatalf("multi-tenant mode: %s", err)
+		}
+		newProxy = middleware.NewMultiTenantProxyFactory(allowedTenants, disableAPIAuthentication)
+	}
+	querierProxy := newProxy(cortexTenantHeader, cortexqurl)
+	distributorProxy := newProxy(cortexTenantHeader, cortexdurl)
+	pushProxy := newProxy(cortexTenantHeader, cortexdurl)
 	if !allowPushRetries {
-		distributorProxy.ReplaceResponses(replacePushErrors)
+		pushProxy.ReplaceResponses(replacePushErrors)
+	}
+	if rateLimitConfigPath != "" {
+		rateLimiter, err := middleware.NewRateLimiterFromFile(rateLimitConfigPath, rateLimitReloadInterval)
+		if err != nil {
+			log.Fatalf("bad rate limit config: %s", err)
+		}
+		log.Infof("rate limit config: %s", rateLimitConfigPath)
+		pushProxy.LimitRate(rateLimiter, rateLimitedStatusCode())
 	}
+	if pushFilter := newPushFilter(); pushFilter != nil {
+		pushProxy.FilterRequests(pushFilter.FilterRequest)
+	}
+	// Always enforce the `selector` claim of tokens, if present.
+	querierProxy.FilterRequests(newSelectorEnforcer().FilterPromQLRequest)
+
 	// mux matches based on registration order, not prefix length.
 	router := mux.NewRouter()
 
 	// Require non-deprecated push path (instead of also allowing /api/prom/push)
-	router.PathPrefix("/api/v1/push").HandlerFunc(distributorProxy.HandleWithProxy)
+	router.PathPrefix("/api/v1/push").HandlerFunc(
+		pushProxy.HandleWithProxyRequiringScope(authenticator.ScopeMetricsWrite))
 
 	// /api/v1/read, /api/v1/query, /api/v1/labels etc: direct everything that's not
 	// /api/v1/push to the querier for now.
-	router.PathPrefix("/api/v1").HandlerFunc(querierProxy.HandleWithProxy)
+	router.PathPrefix("/api/v1").HandlerFunc(
+		querierProxy.HandleWithProxyRequiringScope(authenticator.ScopeMetricsRead))
 
 	// All Cortex components expose various endpoints with configuration /
 	// debug details. https://cortexmetrics.io/docs/api/#all-services Expose
@@ -191,13 +299,14 @@ func main() {
 	// security / isolation reasons. Note that /runtime_config and /config and
 	// /services are expected to look the same regardless of which Cortex
 	// component serves them (use the distributor, here).
-	router.PathPrefix("/runtime_config").HandlerFunc(distributorProxy.HandleWithProxy)
-	router.PathPrefix("/config").HandlerFunc(distributorProxy.HandleWithProxy)
-	router.PathPrefix("/services").HandlerFunc(distributorProxy.HandleWithProxy)
+	debugHandler := distributorProxy.HandleWithProxyRequiringScope(authenticator.ScopeMetricsRead)
+	router.PathPrefix("/runtime_config").HandlerFunc(debugHandler)
+	router.PathPrefix("/config").HandlerFunc(debugHandler)
+	router.PathPrefix("/services").HandlerFunc(debugHandler)
 	// This is distributor-specific (must be served by the Cortex distributor).
 	// "Displays a web page with the distributor hash ring status, including
 	// the state, healthy and last heartbeat time of each distributor.""
-	router.PathPrefix("/distributor/ring").HandlerFunc(distributorProxy.HandleWithProxy)
+	router.PathPrefix("/distributor/ring").HandlerFunc(debugHandler)
 
 	// Expose a special endpoint /metrics exposing metrics for _this API
 	// proxy_.
@@ -206,3 +315,49 @@ func main() {
 
 	log.Fatalf("terminated: %s", http.ListenAndServe(listenAddress, router))
 }
+
+// Return the filter relabeling and validating push requests, or nil if neither
+// is configured.
+func newPushFilter() *remotewrite.PushFilter {
+	var (
+		relabeler *remotewrite.Relabeler
+		validator *remotewrite.Validator
+		err       error
+	)
+	if pushRelabelConfigPath != "" {
+		relabeler, err = remotewrite.NewRelabelerFromFile(pushRelabelConfigPath)
+		if err != nil {
+			log.Fatalf("bad push relabel config: %s", err)
+		}
+		log.Infof("push relabel config: %s", pushRelabelConfigPath)
+	}
+	if pushLimitsConfigPath != "" {
+		validator, err = remotewrite.NewValidatorFromFile(pushLimitsConfigPath)
+		if err != nil {
+			log.Fatalf("bad push limits config: %s", err)
+		}
+		log.Infof("push limits config: %s", pushLimitsConfigPath)
+	}
+	if relabeler == nil && validator == nil {
+		return nil
+	}
+	return remotewrite.NewPushFilter(relabeler, validator).MaxMessageSize(pushMaxMessageSize)
+}
+
+// Return the enforcer of the selectors of tokens and, if configured, of the
+// selector policy.
+func newSelectorEnforcer() *selector.Enforcer {
+	if selectorPolicyPath == "" {
+		return selector.NewEnforcer(nil)
+	}
+	policy, err := selector.NewPolicyFromFile(selectorPolicyPath)
+	if err != nil {
+		log.Fatalf("bad selector policy: %s", err)
+	}
+	log.Infof("selector policy: %s", selectorPolicyPath)
+	return selector.NewEnforcer(policy)
+}
+
+func newFixedTenantProxy(headerName string, backendURL *url.URL) *middleware.TenantReverseProxy {
+	return middleware.NewReverseProxyFixedTenant(tenantName, headerName, backendURL, disableAPIAuthentication)
+}
@@ -18,6 +18,10 @@ import (
 	"flag"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -26,6 +30,7 @@ import (
 	"github.com/opstrace/opstrace/go/pkg/authenticator"
 	"github.com/opstrace/opstrace/go/pkg/ddapi"
 	"github.com/opstrace/opstrace/go/pkg/middleware"
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
 )
 
 var (
@@ -34,6 +39,18 @@ var (
 	remoteWriteURL           string
 	tenantName               string
 	disableAPIAuthentication bool
+	relabelConfigPath        string
+	sketchBuckets            string
+	convertCounters          bool
+	counterTTL               time.Duration
+	lokiPushURL              string
+	walDir                   string
+	walMaxSize               int64
+	rwShards                 int
+	rwMaxSamplesPerSend      int
+	rwBatchSendDeadline      time.Duration
+	rwTargetsConfigPath      string
+	maxDecompressedSize      int64
 )
 
 func main() {
@@ -45,6 +62,59 @@ func main() {
 	flag.StringVar(&loglevel, "loglevel", "info", "error|info|debug")
 	flag.StringVar(&tenantName, "tenantname", "", "")
 	flag.BoolVar(&disableAPIAuthentication, "disable-api-authn", false, "")
+	flag.StringVar(&relabelConfigPath,
+		"relabel-config",
+		"",
+		"YAML file with per-tenant relabeling rules for the translated series")
+	flag.StringVar(&sketchBuckets,
+		"sketch-buckets",
+		"",
+		"Comma-separated bucket upper bounds: write distribution metrics also as <name>_bucket{le=...} series")
+
+	flag.BoolVar(&convertCounters,
+		"convert-counters",
+		false,
+		"Write DD count series as Prometheus counters (<name>_total), and rate series as gauges (<name>_per_second)")
+	flag.DurationVar(&counterTTL,
+		"counter-ttl",
+		time.Hour,
+		"With -convert-counters: forget the running total of a count series after this time without points")
+
+	flag.StringVar(&lokiPushURL,
+		"loki-push-url",
+		"",
+		"A Loki push endpoint (e.g. http://127.0.0.1:3100/loki/api/v1/push): forward DD logs to it")
+
+	flag.StringVar(&walDir,
+		"wal-dir",
+		"",
+		"Buffer writes to the remote_write endpoint in a write-ahead log in this directory, to ride out outages")
+	flag.Int64Var(&walMaxSize,
+		"wal-max-size",
+		1<<30,
+		"With -wal-dir: the maximum size of the write-ahead log in bytes (0: unlimited)")
+
+	flag.StringVar(&rwTargetsConfigPath,
+		"remote-write-targets-config",
+		"",
+		"YAML file with the remote_write endpoints to write to, instead of -prom-remote-write-url")
+	flag.IntVar(&rwShards,
+		"remote-write-shards",
+		0,
+		"Write to the remote_write endpoint asynchronously, with this number of concurrent shards (0: synchronously)")
+	flag.IntVar(&rwMaxSamplesPerSend,
+		"remote-write-max-samples-per-send",
+		remotewrite.DefaultQueueConfig.MaxSamplesPerSend,
+		"With -remote-write-shards: the maximum number of samples per request")
+	flag.DurationVar(&rwBatchSendDeadline,
+		"remote-write-batch-send-deadline",
+		remotewrite.DefaultQueueConfig.BatchSendDeadline,
+		"With -remote-write-shards: the maximum time a sample waits before being sent")
+
+	flag.Int64Var(&maxDecompressedSize,
+		"max-decompressed-size",
+		ddapi.DefaultMaxDecompressedSize,
+		"Reject request bodies larger than this number of bytes after decompression (0: unlimited)")
 
 	flag.Parse()
 	level, lerr := log.ParseLevel(loglevel)
@@ -75,7 +145,77 @@ func main() {
 		authenticator.ReadConfigFromEnvOrCrash()
 	}
 
-	ddcp := ddapi.NewDDCortexProxy(tenantName, remoteWriteURL, disableAPIAuthentication)
+	ddcp := ddapi.NewDDCortexProxy(tenantName, remoteWriteURL, disableAPIAuthentication).
+		MaxDecompressedSize(maxDecompressedSize)
+	log.Infof("max decompressed request body size: %d bytes", maxDecompressedSize)
+	if relabelConfigPath != "" {
+		relabeler, err := remotewrite.NewRelabelerFromFile(relabelConfigPath)
+		if err != nil {
+			log.Fatalf("bad relabel config: %s", err)
+		}
+		log.Infof("relabel config: %s", relabelConfigPath)
+		ddcp.Relabel(relabeler)
+	}
+
+	if sketchBuckets != "" {
+		buckets, err := parseBuckets(sketchBuckets)
+		if err != nil {
+			log.Fatalf("bad sketch buckets: %s", err)
+		}
+		log.Infof("sketch buckets: %v", buckets)
+		ddcp.SketchBuckets(buckets)
+	}
+
+	if convertCounters {
+		log.Infof("converting DD counts into Prometheus counters (TTL: %s)", counterTTL)
+		ddcp.ConvertCounters(ddapi.NewCounterConverter(counterTTL))
+	}
+
+	if rwTargetsConfigPath != "" {
+		cfg, err := remotewrite.ReadTargetsConfigFile(rwTargetsConfigPath)
+		if err != nil {
+			log.Fatalf("bad remote_write targets config: %s", err)
+		}
+		targets := cfg.NewTargets(tenantName, ddcp.Transport())
+		for i, t := range targets {
+			log.Infof("remote_write target %s: %s (policy: %s)",
+				t.Client().Name(), t.Client().URL(), cfg.Targets[i].Policy)
+		}
+		ddcp.WriteToTargets(targets)
+	}
+
+	if walDir != "" && rwShards > 0 {
+		// The queue acknowledges samples before sending them: the WAL would
+		// consider them shipped.
+		log.Fatalf("-wal-dir and -remote-write-shards cannot be combined")
+	}
+
+	if rwShards > 0 {
+		cfg := remotewrite.DefaultQueueConfig
+		cfg.Shards = rwShards
+		cfg.MaxSamplesPerSend = rwMaxSamplesPerSend
+		cfg.BatchSendDeadline = rwBatchSendDeadline
+		log.Infof("remote_write queue: %d shards, %d samples per send, batch send deadline: %s",
+			cfg.Shards, cfg.MaxSamplesPerSend, cfg.BatchSendDeadline)
+		ddcp.QueueWrites(cfg)
+	}
+
+	if walDir != "" {
+		wal, err := ddapi.NewWAL(walDir, walMaxSize)
+		if err != nil {
+			log.Fatalf("could not open write-ahead log: %s", err)
+		}
+		log.Infof("write-ahead log: %s (max size: %d bytes)", walDir, walMaxSize)
+		ddcp.BufferWrites(wal)
+	}
+
+	if lokiPushURL != "" {
+		if _, err := url.Parse(lokiPushURL); err != nil {
+			log.Fatalf("bad Loki push URL: %s", err)
+		}
+		log.Infof("Loki push endpoint: %s", lokiPushURL)
+		ddcp.ForwardLogs(lokiPushURL)
+	}
 
 	router := mux.NewRouter()
 
@@ -84,10 +224,28 @@ func main() {
 	// https://docs.datadoghq.com/api/v1/metrics/#submit-metrics
 	router.PathPrefix("/api/v1/series").HandlerFunc(ddcp.HandlerSeriesPost).Methods(http.MethodPost)
 
+	// Version 2 of the same API, also accepting protobuf messages. See
+	// https://docs.datadoghq.com/api/latest/metrics/#submit-metrics
+	router.PathPrefix("/api/v2/series").HandlerFunc(ddcp.HandlerSeriesV2Post).Methods(http.MethodPost)
+
 	// DD API for service checks. See
 	// https://docs.datadoghq.com/api/latest/service-checks/
 	router.PathPrefix("/api/v1/check_run").HandlerFunc(ddcp.HandlerCheckPost).Methods(http.MethodPost)
 
+	// DD API for distribution metrics, sent by the DD agent as protobuf
+	// messages. Not documented by DD.
+	router.PathPrefix("/api/beta/sketches").HandlerFunc(ddcp.HandlerSketchesPost).Methods(http.MethodPost)
+
+	// DD API for logs, forwarded to Loki (when enabled). See
+	// https://docs.datadoghq.com/api/latest/logs/#send-logs
+	router.PathPrefix("/api/v2/logs").HandlerFunc(ddcp.HandlerLogsPost).Methods(http.MethodPost)
+
+	// Used by the DD agent to check its API key. Not documented by DD.
+	router.PathPrefix("/api/v1/validate").HandlerFunc(ddcp.HandlerValidateGet).Methods(http.MethodGet)
+
+	// Used by the DD agent for host metadata and events. Not documented by DD.
+	router.PathPrefix("/intake/").HandlerFunc(ddcp.HandlerIntakePost).Methods(http.MethodPost)
+
 	// Expose a Prometheus scrape endpoint.
 	router.Handle("/metrics", promhttp.Handler())
 	router.Use(middleware.PrometheusMetrics("dd_api"))
@@ -95,3 +253,18 @@ func main() {
 	log.Infof("starting HTTP server on %s", listenAddress)
 	log.Fatal(http.ListenAndServe(listenAddress, router))
 }
+
+// Parse comma-separated bucket upper bounds, such as "0.1,0.5,1", in
+// ascending order.
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	sort.Float64s(buckets)
+	return buckets, nil
+}
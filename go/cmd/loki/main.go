@@ -18,13 +18,17 @@ import (
 	"flag"
 	"net/http"
 	"net/url"
+	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/opstrace/opstrace/go/pkg/authenticator"
+	"github.com/opstrace/opstrace/go/pkg/lokipush"
 	"github.com/opstrace/opstrace/go/pkg/middleware"
+	"github.com/opstrace/opstrace/go/pkg/selector"
 )
 
 var (
@@ -34,7 +38,13 @@ var (
 	lokiQueryFrontendURL     string
 	lokiDistributorURL       string
 	tenantName               string
+	tenantsFile              string
+	tenantsGraphQLEndpoint   string
+	tenantsRefreshInterval   time.Duration
 	disableAPIAuthentication bool
+	selectorPolicyPath       string
+	pushLimitsConfigPath     string
+	pushMaxMessageSize       int
 )
 
 func main() {
@@ -42,9 +52,19 @@ func main() {
 	flag.StringVar(&lokiQuerierURL, "loki-querier-url", "", "")
 	flag.StringVar(&lokiQueryFrontendURL, "loki-query-frontend-url", "", "")
 	flag.StringVar(&lokiDistributorURL, "loki-distributor-url", "", "")
-	flag.StringVar(&tenantName, "tenantname", "", "")
+	flag.StringVar(&tenantName, "tenantname", "", "If not set, serve all tenants on the allow-list")
+	flag.StringVar(&tenantsFile, "tenants-file", "", "Multi-tenant mode: file with tenant names, one per line")
+	flag.StringVar(&tenantsGraphQLEndpoint, "tenants-graphql-endpoint", "", "Multi-tenant mode: Hasura GraphQL endpoint")
+	flag.DurationVar(&tenantsRefreshInterval, "tenants-refresh-interval", 30*time.Second, "")
 	flag.StringVar(&loglevel, "loglevel", "info", "error|info|debug")
 	flag.BoolVar(&disableAPIAuthentication, "disable-api-authn", false, "")
+	flag.StringVar(&selectorPolicyPath, "selector-policy", "",
+		"YAML file with per-tenant stream selectors that queries and pushes are restricted to")
+	flag.StringVar(&pushLimitsConfigPath, "push-limits-config", "",
+		"YAML file with per-tenant limits on the streams in push requests")
+	flag.IntVar(&pushMaxMessageSize, "push-max-message-size", lokipush.DefaultMaxMessageSize,
+		"With -push-limits-config or -selector-policy: the maximum size of a push request in bytes, "+
+			"compressed or decompressed (0: unlimited)")
 
 	flag.Parse()
 
@@ -73,7 +93,11 @@ func main() {
 	log.Infof("loki query-frontend URL: %s", lokiqfurl)
 	log.Infof("loki distributor URL: %s", lokidurl)
 	log.Infof("listen address: %s", listenAddress)
-	log.Infof("tenant name: %s", tenantName)
+	if tenantName != "" {
+		log.Infof("tenant name: %s", tenantName)
+	} else {
+		log.Infof("no tenant name set: multi-tenant mode")
+	}
 	log.Infof("API authentication enabled: %v", !disableAPIAuthentication)
 
 	if !disableAPIAuthentication {
@@ -82,41 +106,49 @@ func main() {
 
 	// See: https://github.com/grafana/loki/blob/master/docs/api.md#microservices-mode
 	lokiTenantHeader := "X-Scope-OrgID"
-	querierProxy := middleware.NewReverseProxyFixedTenant(
-		tenantName,
-		lokiTenantHeader,
-		lokiqurl,
-		disableAPIAuthentication,
-	)
-	queryFrontendProxy := middleware.NewReverseProxyFixedTenant(
-		tenantName,
-		lokiTenantHeader,
-		lokiqfurl,
-		disableAPIAuthentication,
-	)
-	distributorProxy := middleware.NewReverseProxyFixedTenant(
-		tenantName,
-		lokiTenantHeader,
-		lokidurl,
-		disableAPIAuthentication,
-	)
+	newProxy := newFixedTenantProxy
+	if tenantName == "" {
+		allowedTenants, err := middleware.NewTenantAllowListFromSource(
+			tenantsFile,
+			tenantsGraphQLEndpoint,
+			os.Getenv("HASURA_GRAPHQL_ADMIN_SECRET"),
+			tenantsRefreshInterval,
+		)
+		if err != nil {
+			log.Fatalf("multi-tenant mode: %s", err)
+		}
+		newProxy = middleware.NewMultiTenantProxyFactory(allowedTenants, disableAPIAuthentication)
+	}
+	querierProxy := newProxy(lokiTenantHeader, lokiqurl)
+	queryFrontendProxy := newProxy(lokiTenantHeader, lokiqfurl)
+	distributorProxy := newProxy(lokiTenantHeader, lokidurl)
+
+	// Always enforce the `selector` claim of tokens, if present.
+	enforcer := newSelectorEnforcer()
+	querierProxy.FilterRequests(enforcer.FilterLogQLRequest)
+	queryFrontendProxy.FilterRequests(enforcer.FilterLogQLRequest)
+	distributorProxy.FilterRequests(lokipush.NewPushFilter(enforcer, newPushValidator()).
+		MaxMessageSize(pushMaxMessageSize).FilterRequest)
 
 	// mux matches based on registration order, not prefix length.
 	router := mux.NewRouter()
 
 	// The intended push path.
-	router.PathPrefix("/loki/api/v1/push").HandlerFunc(distributorProxy.HandleWithProxy)
+	router.PathPrefix("/loki/api/v1/push").HandlerFunc(
+		distributorProxy.HandleWithProxyRequiringScope(authenticator.ScopeLogsWrite))
 
 	// Proxy tail endpoint request directly to the queriers.
 	// https://grafana.com/docs/loki/latest/api/#get-lokiapiv1tail
-	router.PathPrefix("/loki/api/v1/tail").HandlerFunc(querierProxy.HandleWithProxy)
+	router.PathPrefix("/loki/api/v1/tail").HandlerFunc(
+		querierProxy.HandleWithProxyRequiringScope(authenticator.ScopeLogsRead))
 
 	// Maybe we should not expose this?
 	// From loki API docs: WARNING: /api/prom/push is DEPRECATED; use /loki/api/v1/push instead.
 	// router.PathPrefix("/api/prom/push").HandlerFunc(reverseProxy.HandleWithDistributorProxy)
 
 	// The intended query / readout path(s)
-	router.PathPrefix("/loki/api/v1/").HandlerFunc(queryFrontendProxy.HandleWithProxy)
+	router.PathPrefix("/loki/api/v1/").HandlerFunc(
+		queryFrontendProxy.HandleWithProxyRequiringScope(authenticator.ScopeLogsRead))
 
 	// I think we can outcomment this one here, too. Want to encourage to use
 	// /loki/api/v1/ for readout.
@@ -127,3 +159,34 @@ func main() {
 
 	log.Fatalf("terminated: %s", http.ListenAndServe(listenAddress, router))
 }
+
+func newFixedTenantProxy(headerName string, backendURL *url.URL) *middleware.TenantReverseProxy {
+	return middleware.NewReverseProxyFixedTenant(tenantName, headerName, backendURL, disableAPIAuthentication)
+}
+
+// Return the enforcer of the selectors of tokens and, if configured, of the
+// selector policy.
+func newSelectorEnforcer() *selector.Enforcer {
+	if selectorPolicyPath == "" {
+		return selector.NewEnforcer(nil)
+	}
+	policy, err := selector.NewPolicyFromFile(selectorPolicyPath)
+	if err != nil {
+		log.Fatalf("bad selector policy: %s", err)
+	}
+	log.Infof("selector policy: %s", selectorPolicyPath)
+	return selector.NewEnforcer(policy)
+}
+
+// Return the validator of push requests, or nil if no limits are configured.
+func newPushValidator() *lokipush.Validator {
+	if pushLimitsConfigPath == "" {
+		return nil
+	}
+	validator, err := lokipush.NewValidatorFromFile(pushLimitsConfigPath)
+	if err != nil {
+		log.Fatalf("bad push limits config: %s", err)
+	}
+	log.Infof("push limits config: %s", pushLimitsConfigPath)
+	return validator
+}
@@ -15,12 +15,17 @@
 package authenticator
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 )
 
 // General note: authentication failure is an expected scenario, which is why
 // the boolean `ok` paradigm is used instead of returning an error or nil.
+//
+// The functions below accept optional `requiredScopes`: when given, the
+// (valid) token must also grant each of these via its `scope` claim, otherwise
+// a 403 response is emitted. Tokens without a `scope` claim grant all scopes.
 
 // HTTP Request header used by GetTenant when disableAPIAuthentication is true
 // and requireTenantName is nil. This is only meant for use in testing, and
@@ -32,8 +37,8 @@ Infer tenant identity (name) from request or context.
 
 Return 2-tuple (tenantName: string, ok: bool).
 
-Callers can rely on a 401 response to have been emitted when `ok` is `false`,
-and should terminate request processing. If `ok` is `false` do not use
+Callers can rely on a 401 (or 403) response to have been emitted when `ok` is
+`false`, and should terminate request processing. If `ok` is `false` do not use
 `tenantName`.
 
 When `ok` is true, the request has been inspected and the returned `tenantName`
@@ -75,20 +80,47 @@ func GetTenantNameOr401(
 	r *http.Request,
 	expectedTenantName *string,
 	disableAPIAuthentication bool,
+	requiredScopes ...Scope,
 ) (string, bool) {
+	tenant, ok := GetTenantOr401(w, r, expectedTenantName, disableAPIAuthentication, requiredScopes...)
+	return tenant.Name, ok
+}
+
+// Tenant is the identity of an authenticated request.
+type Tenant struct {
+	Name string
+	// The label selector of the token's `selector` claim, such as
+	// `{team="payments"}`: the request may only access series (or log
+	// streams) matching it. Empty if not restricted.
+	Selector string
+}
+
+/*
+Like GetTenantNameOr401(), but return the Tenant, including the selector of
+the authentication token. The selector is empty when API authentication is
+disabled.
+*/
+func GetTenantOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+	disableAPIAuthentication bool,
+	requiredScopes ...Scope,
+) (Tenant, bool) {
 	if expectedTenantName != nil {
 		if !disableAPIAuthentication {
 			// Authenticate and expect specific tenant. Otherwise send 401 response.
-			if !AuthenticateSpecificTenantByHeaderOr401(w, r, *expectedTenantName) {
-				return "", false
+			vt, ok := authenticateByHeaderOr401(w, r, *expectedTenantName, requiredScopes)
+			if !ok {
+				return Tenant{}, false
 			}
 
 			// Request is authenticated as the expected tenant.
-			return *expectedTenantName, true
+			return vt.tenant(), true
 		}
 
 		// ONLY FOR TESTING: do not inspect request, assume the expected tenant
-		return *expectedTenantName, true
+		return Tenant{Name: *expectedTenantName}, true
 	}
 
 	// Do not expect specific tenant: allow for incoming requests to be
@@ -96,12 +128,12 @@ func GetTenantNameOr401(
 
 	if !disableAPIAuthentication {
 		// Authenticate (accept any tenant name). Otherwise send 401 response.
-		tnFromReq, ok := AuthenticateAnyTenantByHeaderOr401(w, r)
+		vt, ok := authenticateByHeaderOr401(w, r, "", requiredScopes)
 		if !ok {
-			return "", false
+			return Tenant{}, false
 		}
 
-		return tnFromReq, true
+		return vt.tenant(), true
 	}
 
 	// ONLY FOR TESTING: no single expected tenant, and authenticator
@@ -109,9 +141,22 @@ func GetTenantNameOr401(
 	tenantName := r.Header.Get(TestTenantHeader)
 	if tenantName == "" {
 		exit401(w, fmt.Sprintf("missing test %s header specifying tenant", TestTenantHeader))
-		return "", false
+		return Tenant{}, false
 	}
-	return tenantName, true
+	return Tenant{Name: tenantName}, true
+}
+
+type tenantContextKey struct{}
+
+// WithTenant returns a copy of `ctx` carrying `tenant`, see TenantFromContext().
+func WithTenant(ctx context.Context, tenant Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant stored in `ctx` by WithTenant(), if any.
+func TenantFromContext(ctx context.Context) (Tenant, bool) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(Tenant)
+	return tenant, ok
 }
 
 /*
@@ -125,30 +170,28 @@ Emit error HTTP responses and return `false` upon any failure.
 Return `true` only when the authentication proof is valid and matches the
 expected Opstrace tenant name.
 
-Callers can rely on a 401 response to have been emitted when `ok` is `false`.
+Callers can rely on a 401 (or 403) response to have been emitted when `ok` is
+`false`.
 */
 func AuthenticateSpecificTenantByDDQueryParamOr401(
 	w http.ResponseWriter,
 	r *http.Request,
 	expectedTenantName string,
+	requiredScopes ...Scope,
 ) bool {
 	// Only one parameter of that name is expected.
 	apikey := r.URL.Query().Get("api_key")
 
 	if apikey == "" {
-		return exit401(w, "DD API key missing (api_key URL query parameter)")
+		return exitFailure(w, recordFailure(
+			requestFailure(failureMissingToken, "DD API key missing (api_key URL query parameter)"),
+			expectedTenantName))
 	}
 
 	authTokenUnverified := apikey
 
-	tenantNameFromToken, veriferr := validateAuthTokenGetTenantName(authTokenUnverified)
-	if veriferr != nil {
-		return exit401(w, veriferr.Error())
-	}
-
-	if expectedTenantName != tenantNameFromToken {
-		return exit401(w, fmt.Sprintf("bad authentication token: unexpected tenant: %s",
-			tenantNameFromToken))
+	if _, f := authenticateToken(authTokenUnverified, expectedTenantName, requiredScopes); f != nil {
+		return exitFailure(w, f)
 	}
 	return true
 }
@@ -166,20 +209,19 @@ If `ok` is `false` then do not use tenant name (it is an empty string).
 Write a 401 response to `w` when the authentication proof is not present,
 in a bad format, or invalid in any way.
 
-Callers can rely on a 401 response to have been emitted when `ok` is `false`.
+Callers can rely on a 401 (or 403) response to have been emitted when `ok` is
+`false`.
 */
-func AuthenticateAnyTenantByHeaderOr401(w http.ResponseWriter, r *http.Request) (string, bool) {
-	authTokenUnverified, ok := getUnverifiedHTTPAuthTokenOr401(w, r)
+func AuthenticateAnyTenantByHeaderOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	requiredScopes ...Scope,
+) (string, bool) {
+	vt, ok := authenticateByHeaderOr401(w, r, "", requiredScopes)
 	if !ok {
 		return "", false
 	}
-
-	tenantNameFromToken, veriferr := validateAuthTokenGetTenantName(authTokenUnverified)
-	if veriferr != nil {
-		return "", exit401(w, veriferr.Error())
-	}
-
-	return tenantNameFromToken, true
+	return vt.tenantName, true
 }
 
 /*
@@ -194,24 +236,37 @@ Return `true` when authentication succeeded.
 Write a 401 response to `w` when the authentication proof is not present, in a
 bad format, or invalid in any way. Return `false`.
 
-Callers can rely on a 401 response to have been emitted when `ok` is `false`.
+Callers can rely on a 401 (or 403) response to have been emitted when `ok` is
+`false`.
 */
-func AuthenticateSpecificTenantByHeaderOr401(w http.ResponseWriter, r *http.Request, expectedTenantName string) bool {
-	authTokenUnverified, ok := getUnverifiedHTTPAuthTokenOr401(w, r)
-	if !ok {
-		return false
-	}
+func AuthenticateSpecificTenantByHeaderOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName string,
+	requiredScopes ...Scope,
+) bool {
+	_, ok := authenticateByHeaderOr401(w, r, expectedTenantName, requiredScopes)
+	return ok
+}
 
-	tenantNameFromToken, veriferr := validateAuthTokenGetTenantName(authTokenUnverified)
-	if veriferr != nil {
-		return exit401(w, veriferr.Error())
+// Authenticate the request by the token in its `Authorization` header, see
+// authenticateToken(). Write the error response and return false upon failure.
+func authenticateByHeaderOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName string,
+	requiredScopes []Scope,
+) (*verifiedToken, bool) {
+	authTokenUnverified, geterr := getUnverifiedHTTPAuthToken(r)
+	if geterr != nil {
+		return nil, exitFailure(w, recordFailure(geterr, expectedTenantName))
 	}
 
-	if expectedTenantName != tenantNameFromToken {
-		return exit401(w, fmt.Sprintf("bad authentication token: unexpected tenant: %s",
-			tenantNameFromToken))
+	vt, f := authenticateToken(authTokenUnverified, expectedTenantName, requiredScopes)
+	if f != nil {
+		return nil, exitFailure(w, f)
 	}
-	return true
+	return vt, true
 }
 
 /*
@@ -227,20 +282,47 @@ func AuthenticateSpecificTenantByHeaderMap(
 	headers map[string][]string,
 	headerName string,
 	expectedTenantName string,
+	requiredScopes ...Scope,
 ) error {
 	authTokenUnverified, geterr := getUnverifiedAuthHeader(headers, headerName)
 	if geterr != nil {
-		return geterr
+		return recordFailure(geterr, expectedTenantName)
 	}
 
-	tenantNameFromToken, veriferr := validateAuthTokenGetTenantName(authTokenUnverified)
+	if _, f := authenticateToken(authTokenUnverified, expectedTenantName, requiredScopes); f != nil {
+		return f
+	}
+	return nil
+}
+
+/*
+Validate the token, require it to be for `expectedTenantName` (if empty: accept
+any tenant) and to grant `requiredScopes`.
+
+Upon failure, the failure has already been logged and counted.
+*/
+func authenticateToken(
+	authTokenUnverified string,
+	expectedTenantName string,
+	requiredScopes []Scope,
+) (*verifiedToken, *authFailure) {
+	vt, veriferr := validateAuthToken(authTokenUnverified)
 	if veriferr != nil {
-		return veriferr
+		return nil, recordFailure(asAuthFailure(veriferr), expectedTenantName)
 	}
 
-	if expectedTenantName != tenantNameFromToken {
-		return fmt.Errorf("bad authentication token: unexpected tenant: %s",
-			tenantNameFromToken)
+	if expectedTenantName != "" && expectedTenantName != vt.tenantName {
+		return nil, recordFailure(requestFailure(failureUnexpectedTenant,
+			"bad authentication token: unexpected tenant: %s", vt.tenantName), expectedTenantName)
 	}
-	return nil
+
+	if missing := vt.scopes.missing(requiredScopes); missing != "" {
+		return nil, recordFailure(requestFailure(failureMissingScope,
+			"authentication token lacks required scope: %s", missing), vt.tenantName)
+	}
+	return vt, nil
+}
+
+func (vt *verifiedToken) tenant() Tenant {
+	return Tenant{Name: vt.tenantName, Selector: vt.selector}
 }
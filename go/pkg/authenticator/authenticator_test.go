@@ -0,0 +1,75 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTenantOr401_Selector(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	kid, pubkey := pemRoundTrip(t, &privkey.PublicKey)
+	useStaticKeySet(t, map[string]crypto.PublicKey{kid: pubkey})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"sub":      "tenant-tenantfoo",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+		"selector": `{team="payments"}`,
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(privkey)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+
+	// Any tenant.
+	tenant, ok := GetTenantOr401(httptest.NewRecorder(), req, nil, false)
+	assert.True(t, ok)
+	assert.Equal(t, Tenant{Name: "tenantfoo", Selector: `{team="payments"}`}, tenant)
+
+	// Specific tenant.
+	expected := "tenantfoo"
+	tenant, ok = GetTenantOr401(httptest.NewRecorder(), req, &expected, false)
+	assert.True(t, ok)
+	assert.Equal(t, Tenant{Name: "tenantfoo", Selector: `{team="payments"}`}, tenant)
+
+	// Authentication disabled: no token, no selector.
+	tenant, ok = GetTenantOr401(httptest.NewRecorder(), req, &expected, true)
+	assert.True(t, ok)
+	assert.Equal(t, Tenant{Name: "tenantfoo"}, tenant)
+}
+
+func TestTenantFromContext(t *testing.T) {
+	_, ok := TenantFromContext(context.Background())
+	assert.False(t, ok)
+
+	ctx := WithTenant(context.Background(), Tenant{Name: "tenantfoo", Selector: `{team="payments"}`})
+	tenant, ok := TenantFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "tenantfoo", tenant.Name)
+	assert.Equal(t, `{team="payments"}`, tenant.Selector)
+}
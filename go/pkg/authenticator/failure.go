@@ -0,0 +1,134 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// failureReason classifies why a request could not be authenticated. It is
+// used as a metric label value and must therefore be one of a small, fixed
+// set of values.
+type failureReason string
+
+const (
+	failureMissingToken     failureReason = "missing_token"
+	failureMalformedToken   failureReason = "malformed_token"
+	failureUnsupportedAlg   failureReason = "unsupported_alg"
+	failureUnknownKeyID     failureReason = "unknown_kid"
+	failureBadSignature     failureReason = "bad_signature"
+	failureExpired          failureReason = "expired"
+	failureNotValidYet      failureReason = "not_valid_yet"
+	failureBadSubject       failureReason = "bad_subject"
+	failureBadAudience      failureReason = "bad_audience"
+	failureBadIssuer        failureReason = "bad_issuer"
+	failureRevoked          failureReason = "revoked"
+	failureUnexpectedTenant failureReason = "unexpected_tenant"
+	failureMissingScope     failureReason = "missing_scope"
+	failureUnknownTenant    failureReason = "unknown_tenant"
+)
+
+/*
+authFailure is the error type for all authentication failures.
+
+`Error()` returns the message meant for the client, which is deliberately
+vague for anything related to token verification (trade-off between
+debuggability / devX and security). `detail` is meant for the log only.
+*/
+type authFailure struct {
+	reason failureReason
+	msg    string
+	detail string
+}
+
+func (f *authFailure) Error() string {
+	return f.msg
+}
+
+// Failure while verifying the token itself: respond with a generic message.
+func tokenFailure(reason failureReason, format string, args ...interface{}) *authFailure {
+	return &authFailure{
+		reason: reason,
+		msg:    "bad authentication token",
+		detail: fmt.Sprintf(format, args...),
+	}
+}
+
+// Failure that can be explained to the client as is (such as a missing
+// header): use the same text for response and log.
+func requestFailure(reason failureReason, format string, args ...interface{}) *authFailure {
+	msg := fmt.Sprintf(format, args...)
+	return &authFailure{reason: reason, msg: msg, detail: msg}
+}
+
+/*
+Map an error returned by `jwt.ParseWithClaims()` to an authFailure.
+
+Key lookup errors (see `keyLookupCallback()`) are authFailures already. For
+everything else, inspect the validation error bitfield. Note that the JWT
+library checks the claims before the signature, so that more than one bit may
+be set: a bad signature takes precedence over, for example, expiry.
+*/
+func failureFromJWTError(err error) *authFailure {
+	var ve *jwt.ValidationError
+	if !errors.As(err, &ve) {
+		return tokenFailure(failureMalformedToken, "%s", err)
+	}
+
+	var f *authFailure
+	if ve.Inner != nil && errors.As(ve.Inner, &f) {
+		return f
+	}
+
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return tokenFailure(failureMalformedToken, "%s", err)
+	case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+		return tokenFailure(failureUnsupportedAlg, "%s", err)
+	case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return tokenFailure(failureBadSignature, "%s", err)
+	case ve.Errors&jwt.ValidationErrorExpired != 0:
+		return tokenFailure(failureExpired, "%s", err)
+	default:
+		// Not valid yet (`nbf`), or issued in the future (`iat`).
+		return tokenFailure(failureNotValidYet, "%s", err)
+	}
+}
+
+func asAuthFailure(err error) *authFailure {
+	var f *authFailure
+	if errors.As(err, &f) {
+		return f
+	}
+	return tokenFailure(failureMalformedToken, "%s", err)
+}
+
+/*
+Log and count the failure, return it for convenience.
+
+`tenantName` may be empty when the tenant is not known. Only ever pass the
+expected tenant name or one read from a verified token, to keep the
+cardinality of the metric bounded (the `sub` claim of an unverified token can
+be anything).
+*/
+func recordFailure(f *authFailure, tenantName string) *authFailure {
+	log.Infof("authentication failed (reason: %s, tenant: %s): %s", f.reason, tenantName, f.detail)
+	authFailuresTotal.WithLabelValues(string(f.reason), tenantName).Inc()
+	return f
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAuthToken_FailureReasons(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	kid, pubkey := pemRoundTrip(t, &privkey.PublicKey)
+	useStaticKeySet(t, map[string]crypto.PublicKey{kid: pubkey})
+	otherkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	sign := func(claims jwt.MapClaims, kid string, key *ecdsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = kid
+		signed, serr := token.SignedString(key)
+		assert.NoError(t, serr)
+		return signed
+	}
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "tenant-tenantfoo", "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	expired := valid()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	notyet := valid()
+	notyet["nbf"] = time.Now().Add(time.Hour).Unix()
+	badsub := valid()
+	badsub["sub"] = "tenantfoo"
+
+	for token, reason := range map[string]failureReason{
+		"foo.bar":                      failureMalformedToken,
+		sign(expired, kid, privkey):    failureExpired,
+		sign(notyet, kid, privkey):     failureNotValidYet,
+		sign(valid(), "nope", privkey): failureUnknownKeyID,
+		sign(valid(), kid, otherkey):   failureBadSignature,
+		sign(badsub, kid, privkey):     failureBadSubject,
+		signTestToken(t, jwt.SigningMethodHS256, kid, []byte("secret")): failureUnsupportedAlg,
+	} {
+		_, err := validateAuthToken(token)
+		// The response message does not reveal the reason.
+		assert.EqualError(t, err, "bad authentication token")
+		assert.Equal(t, reason, asAuthFailure(err).reason)
+	}
+}
+
+func TestAuthenticateSpecificTenantByHeader_FailureMetric(t *testing.T) {
+	useStaticKeySet(t, nil)
+	count := func(reason failureReason, tenant string) float64 {
+		return testutil.ToFloat64(authFailuresTotal.WithLabelValues(string(reason), tenant))
+	}
+	missing := count(failureMissingToken, "tenantfoo")
+	unknown := count(failureUnknownKeyID, "tenantfoo")
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	w := httptest.NewRecorder()
+	assert.False(t, AuthenticateSpecificTenantByHeaderOr401(w, req, "tenantfoo"))
+	assert.Equal(t, 401, w.Result().StatusCode)
+	assert.Equal(t, "Authorization header missing or invalid", w.Body.String())
+	assert.Equal(t, missing+1, count(failureMissingToken, "tenantfoo"))
+
+	// No key configured: the token's key ID is unknown.
+	req.Header.Set("Authorization", "Bearer "+TenantAPITokenForKey624)
+	w = httptest.NewRecorder()
+	assert.False(t, AuthenticateSpecificTenantByHeaderOr401(w, req, "tenantfoo"))
+	assert.Equal(t, 401, w.Result().StatusCode)
+	assert.Equal(t, "bad authentication token", w.Body.String())
+	assert.Equal(t, unknown+1, count(failureUnknownKeyID, "tenantfoo"))
+}
+
+func TestExitUnknownTenant(t *testing.T) {
+	before := testutil.ToFloat64(authFailuresTotal.WithLabelValues(string(failureUnknownTenant), ""))
+
+	w := httptest.NewRecorder()
+	assert.False(t, ExitUnknownTenant(w, "other"))
+	assert.Equal(t, 401, w.Result().StatusCode)
+	assert.Equal(t, "unknown tenant: other", w.Body.String())
+	assert.Equal(t, before+1, testutil.ToFloat64(authFailuresTotal.WithLabelValues(string(failureUnknownTenant), "")))
+}
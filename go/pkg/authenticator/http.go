@@ -15,7 +15,6 @@
 package authenticator
 
 import (
-	"fmt"
 	"net/http"
 	"strings"
 
@@ -23,45 +22,41 @@ import (
 )
 
 // Tries BasicAuth before falling back to checking the Authorization header.
-func getUnverifiedHTTPAuthTokenOr401(w http.ResponseWriter, r *http.Request) (string, bool) {
+func getUnverifiedHTTPAuthToken(r *http.Request) (string, *authFailure) {
 	_, authTokenUnverifiedFromBasicAuth, ok := r.BasicAuth()
 	if ok {
 		// It's not documented what `ok` being `true` really means so this
 		// next check is just for sanity
 		if len(authTokenUnverifiedFromBasicAuth) > 1 {
-			return authTokenUnverifiedFromBasicAuth, true
+			return authTokenUnverifiedFromBasicAuth, nil
 		}
 	}
 
-	authTokenUnverified, err := getUnverifiedAuthHeader(r.Header, "Authorization")
-	if err != nil {
-		return "", exit401(w, err.Error())
-	}
-	return authTokenUnverified, true
+	return getUnverifiedAuthHeader(r.Header, "Authorization")
 }
 
 // Expect HTTP request to have a header of the shape
 //
 //      `<headerName>: Bearer <AUTHTOKEN>`
 //
-// set. Extract (and do _not_ verify) the authentication token. Emit error HTTP
-// response and return `false` upon any failure.
+// set. Extract (and do _not_ verify) the authentication token.
 //
 // Added later, for legacy software: if this HTTP request has an Authorization
 // header with the Basic scheme then extract the Basic auth credentials
 // (username, password), ignore the username, and treat the password as
 // <AUTHTOKEN>.
-func getUnverifiedAuthHeader(headers map[string][]string, headerName string) (string, error) {
+func getUnverifiedAuthHeader(headers map[string][]string, headerName string) (string, *authFailure) {
 	// Read first value set for Authorization header. (no support for multiple
 	// of these headers yet, maybe never.)
 	av, ok := headers[headerName]
 	if !ok || len(av) == 0 || av[0] == "" {
-		return "", fmt.Errorf("%s header missing or invalid", headerName)
+		return "", requestFailure(failureMissingToken, "%s header missing or invalid", headerName)
 	}
 	asplits := strings.Split(av[0], "Bearer ")
 
 	if len(asplits) != 2 {
-		return "", fmt.Errorf("%s header format invalid. Expecting 'Bearer <AUTHTOKEN>'", headerName)
+		return "", requestFailure(failureMissingToken,
+			"%s header format invalid. Expecting 'Bearer <AUTHTOKEN>'", headerName)
 	}
 
 	authTokenUnverified := asplits[1]
@@ -91,3 +86,39 @@ func exit401(resp http.ResponseWriter, errmsg string) bool {
 	}
 	return false
 }
+
+/*
+Write the response for an authentication failure and return false: 403 for a
+valid token lacking a required scope, 401 otherwise. The failure has already
+been logged (see `recordFailure()`).
+
+Only the (deliberately vague) message of the failure is written to the
+response body.
+*/
+func exitFailure(resp http.ResponseWriter, f *authFailure) bool {
+	status := http.StatusUnauthorized
+	if f.reason == failureMissingScope {
+		status = http.StatusForbidden
+	}
+	resp.WriteHeader(status)
+
+	_, werr := resp.Write([]byte(f.msg))
+	if werr != nil {
+		log.Errorf("writing response failed: %v", werr)
+	}
+	return false
+}
+
+/*
+Reject a request for a tenant that the caller does not serve (such as a tenant
+missing from the allow-list of a multi-tenant proxy), although the request was
+authenticated: log and count the failure and write a 401 response. Return
+false, like the authentication functions.
+
+The failure is counted with an empty tenant label: with authentication
+disabled, the tenant name comes from a request header and can be anything.
+*/
+func ExitUnknownTenant(w http.ResponseWriter, tenantName string) bool {
+	f := requestFailure(failureUnknownTenant, "unknown tenant: %s", tenantName)
+	return exitFailure(w, recordFailure(f, ""))
+}
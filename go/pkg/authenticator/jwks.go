@@ -0,0 +1,387 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	json "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Default interval for periodically re-fetching the JWKS document.
+	jwksDefaultRefreshInterval = 5 * time.Minute
+	// Minimum time between two fetches triggered by tokens referring to an
+	// unknown key ID. Protects the JWKS endpoint (and this process) against
+	// being hammered with tokens carrying random key IDs.
+	jwksMinRefetchInterval = 30 * time.Second
+	// Maximum time a request waits for such a fetch to complete. The fetch
+	// itself goes on in the background.
+	jwksMaxRefetchWait = 2 * time.Second
+)
+
+var (
+	// The JWKS source used by the authenticator, nil if not configured. It
+	// may be replaced while requests are verified: use getJWKSSource().
+	authtokenVerificationJWKS   *JWKSSource
+	authtokenVerificationJWKSMu sync.RWMutex
+	jwksRefreshStop             chan struct{}
+)
+
+func getJWKSSource() *JWKSSource {
+	authtokenVerificationJWKSMu.RLock()
+	defer authtokenVerificationJWKSMu.RUnlock()
+	return authtokenVerificationJWKS
+}
+
+func setJWKSSource(s *JWKSSource) {
+	authtokenVerificationJWKSMu.Lock()
+	defer authtokenVerificationJWKSMu.Unlock()
+	authtokenVerificationJWKS = s
+}
+
+// Subset of RFC 7517 JSON Web Key fields relevant for signature verification.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA public key parameters (RFC 7518 section 6.3.1).
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC (RFC 7518 section 6.2.1) and OKP (RFC 8037 section 2) public key
+	// parameters.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwksDocument struct {
+	Keys []jwk `json:"keys"`
+}
+
+/*
+JWKSSource periodically fetches a JSON Web Key Set document (RFC 7517) from a
+URL and stores the keys it contains in a KeySet, indexed by their `kid`.
+
+In addition to the periodic refresh, the document can be re-fetched on demand
+when a token refers to a key ID not (yet) known. Such on-demand fetches are
+rate limited, and requests wait for them for a bounded time only.
+*/
+type JWKSSource struct {
+	url                string
+	client             *http.Client
+	keySet             *KeySet
+	minRefetchInterval time.Duration
+	maxRefetchWait     time.Duration
+
+	mu        sync.Mutex
+	lastFetch time.Time
+	// Closed when the on-demand fetch in progress completes, nil if there is
+	// none.
+	refetchDone chan struct{}
+}
+
+func NewJWKSSource(url string) *JWKSSource {
+	return &JWKSSource{
+		url:                url,
+		client:             &http.Client{Timeout: 10 * time.Second},
+		keySet:             NewKeySet("jwks"),
+		minRefetchInterval: jwksMinRefetchInterval,
+		maxRefetchWait:     jwksMaxRefetchWait,
+	}
+}
+
+// KeySet returns the key set populated from the JWKS document.
+func (s *JWKSSource) KeySet() *KeySet {
+	return s.keySet
+}
+
+// Refresh fetches the JWKS document and replaces the keys in the key set.
+// Upon error, the previous keys remain active.
+func (s *JWKSSource) Refresh() error {
+	s.mu.Lock()
+	s.lastFetch = time.Now()
+	s.mu.Unlock()
+
+	return s.fetch("periodic")
+}
+
+/*
+RefreshForUnknownKeyID re-fetches the JWKS document because a token refers to
+key ID `kid` which is not in the key set, or waits for the on-demand fetch in
+progress. Return `true` if `kid` is known after the fetch.
+
+Return `false` without fetching if the last fetch happened less than
+`minRefetchInterval` ago, and without waiting any longer if the fetch takes
+more than `maxRefetchWait`: the fetch completes in the background.
+*/
+func (s *JWKSSource) RefreshForUnknownKeyID(kid string) bool {
+	s.mu.Lock()
+	done := s.refetchDone
+	if done == nil {
+		if time.Since(s.lastFetch) < s.minRefetchInterval {
+			s.mu.Unlock()
+			log.Debugf("jwks: unknown kid %s, skip fetch (rate limited)", kid)
+			return false
+		}
+		s.lastFetch = time.Now()
+		done = make(chan struct{})
+		s.refetchDone = done
+		log.Infof("jwks: unknown kid %s, fetch %s", kid, s.url)
+		go s.refetch(done)
+	}
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.maxRefetchWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Warnf("jwks: unknown kid %s, fetch still in progress after %s", kid, s.maxRefetchWait)
+		return false
+	}
+
+	_, known := s.keySet.Lookup(kid)
+	return known
+}
+
+// Fetch the JWKS document on demand, then close `done`.
+func (s *JWKSSource) refetch(done chan struct{}) {
+	if err := s.fetch("unknown_kid"); err != nil {
+		log.Warnf("jwks: %s", err)
+	}
+
+	s.mu.Lock()
+	s.refetchDone = nil
+	s.mu.Unlock()
+	close(done)
+}
+
+// Run refreshes the key set every `interval` until `stop` is closed.
+func (s *JWKSSource) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.Refresh(); err != nil {
+			log.Warnf("jwks: periodic refresh failed, keep previous keys: %s", err)
+		}
+	}
+}
+
+func (s *JWKSSource) fetch(trigger string) error {
+	keys, err := s.fetchKeys()
+	if err != nil {
+		jwksFetchesTotal.WithLabelValues(trigger, "failure").Inc()
+		return err
+	}
+
+	jwksFetchesTotal.WithLabelValues(trigger, "success").Inc()
+	s.keySet.Replace(keys)
+	return nil
+}
+
+func (s *JWKSSource) fetchKeys() (map[string]crypto.PublicKey, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching JWKS document: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading JWKS document: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response while fetching JWKS document: %d", resp.StatusCode)
+	}
+
+	return parseJWKS(body)
+}
+
+/*
+Parse a JWKS document. Skip (and log) keys that cannot be used for verifying
+Opstrace tenant API tokens: keys without key ID, keys not meant for signature
+verification, and keys of an unsupported type. Fail if the document itself is
+malformed, or if a supported key is malformed.
+*/
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var doc jwksDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error while JSON-parsing JWKS document: %s", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Kid == "" {
+			log.Warnf("jwks: skip key without kid")
+			continue
+		}
+		if k.Use != "" && k.Use != "sig" {
+			log.Debugf("jwks: skip key %s with use %s", k.Kid, k.Use)
+			continue
+		}
+
+		var pubkey crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			pubkey, err = rsaPubKeyFromJWK(k)
+		case "EC":
+			pubkey, err = ecdsaPubKeyFromJWK(k)
+		case "OKP":
+			pubkey, err = ed25519PubKeyFromJWK(k)
+		default:
+			log.Warnf("jwks: skip key %s with unsupported kty %s", k.Kid, k.Kty)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %s: %s", k.Kid, err)
+		}
+		keys[k.Kid] = pubkey
+	}
+	return keys, nil
+}
+
+func rsaPubKeyFromJWK(k jwk) (*rsa.PublicKey, error) {
+	nbytes, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil || len(nbytes) == 0 {
+		return nil, fmt.Errorf("invalid modulus")
+	}
+	ebytes, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(ebytes) == 0 || len(ebytes) > 4 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+
+	e := new(big.Int).SetBytes(ebytes)
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nbytes),
+		E: int(e.Int64()),
+	}, nil
+}
+
+func ecdsaPubKeyFromJWK(k jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	default:
+		return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+	}
+
+	xbytes, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(xbytes) == 0 {
+		return nil, fmt.Errorf("invalid x coordinate")
+	}
+	ybytes, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil || len(ybytes) == 0 {
+		return nil, fmt.Errorf("invalid y coordinate")
+	}
+
+	pubkey := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xbytes),
+		Y:     new(big.Int).SetBytes(ybytes),
+	}
+	if !curve.IsOnCurve(pubkey.X, pubkey.Y) {
+		return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+	}
+	return pubkey, nil
+}
+
+func ed25519PubKeyFromJWK(k jwk) (ed25519.PublicKey, error) {
+	if k.Crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+	}
+
+	xbytes, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(xbytes) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	return ed25519.PublicKey(xbytes), nil
+}
+
+/*
+Read JWKS configuration from environment. If API_AUTHTOKEN_VERIFICATION_JWKS_URL
+is set then fetch the JWKS document from that URL, and keep refreshing it
+periodically (every API_AUTHTOKEN_VERIFICATION_JWKS_REFRESH_INTERVAL, a Go
+duration string).
+
+If the initial fetch fails or if the configuration is invalid, log an error and
+exit the process with a non-zero exit code.
+*/
+func readJWKSConfigFromEnvOrCrash() {
+	url, present := os.LookupEnv("API_AUTHTOKEN_VERIFICATION_JWKS_URL")
+	if !present || url == "" {
+		log.Infof("API_AUTHTOKEN_VERIFICATION_JWKS_URL is not set, don't use JWKS")
+		stopJWKSRefresh()
+		return
+	}
+
+	interval := jwksDefaultRefreshInterval
+	if ival := os.Getenv("API_AUTHTOKEN_VERIFICATION_JWKS_REFRESH_INTERVAL"); ival != "" {
+		var err error
+		interval, err = time.ParseDuration(ival)
+		if err != nil || interval <= 0 {
+			log.Errorf("invalid API_AUTHTOKEN_VERIFICATION_JWKS_REFRESH_INTERVAL: %s", ival)
+			os.Exit(1)
+		}
+	}
+
+	log.Infof("fetch JWKS document from %s, refresh interval: %s", url, interval)
+	s := NewJWKSSource(url)
+	if err := s.Refresh(); err != nil {
+		log.Errorf("%s", err)
+		os.Exit(1)
+	}
+
+	// Stop a previously started refresh loop (ReadConfigFromEnvOrCrash() may
+	// be called more than once, for example in tests).
+	stopJWKSRefresh()
+	jwksRefreshStop = make(chan struct{})
+	setJWKSSource(s)
+	go s.Run(interval, jwksRefreshStop)
+}
+
+func stopJWKSRefresh() {
+	if jwksRefreshStop != nil {
+		close(jwksRefreshStop)
+		jwksRefreshStop = nil
+	}
+	setJWKSSource(nil)
+}
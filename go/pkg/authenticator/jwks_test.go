@@ -0,0 +1,171 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+)
+
+const testKid624 = "624bd05d77efb13d9d1ed923baef5483b5e07933"
+
+// Build a JWKS document containing the public key that was used for signing
+// `TenantAPITokenForKey624`, using `kid` as its key ID.
+func testJWKSDocument(t *testing.T, kid string) string {
+	var pemstrings map[string]string
+	assert.NoError(t, json.Unmarshal([]byte(TestKeysetEnvValThreePubkeys), &pemstrings))
+	key, err := deserializePubKeyFromPEMBytes([]byte(pemstrings[testKid624]))
+	assert.NoError(t, err)
+	pubkey := key.(*rsa.PublicKey)
+
+	return fmt.Sprintf(
+		`{"keys": [
+			{"kid": "enc1", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"},
+			{"kid": "%s", "kty": "RSA", "use": "sig", "alg": "RS256", "n": "%s", "e": "%s"}
+		]}`,
+		kid,
+		base64.RawURLEncoding.EncodeToString(pubkey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pubkey.E)).Bytes()),
+	)
+}
+
+// Serve `*doc` as JWKS document, count requests in `*hits`.
+func createJWKSServer(doc *atomic.Value, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		fmt.Fprint(w, doc.Load().(string))
+	}))
+}
+
+// Use `s` as the authenticator's only key source for the duration of a test.
+func useJWKSSource(t *testing.T, s *JWKSSource) {
+	prevJWKS, prevKeySet := getJWKSSource(), authtokenVerificationKeySet
+	setJWKSSource(s)
+	authtokenVerificationKeySet = NewKeySet("static")
+	verifiedTokens.purge()
+	t.Cleanup(func() {
+		setJWKSSource(prevJWKS)
+		authtokenVerificationKeySet = prevKeySet
+		verifiedTokens.purge()
+	})
+}
+
+func TestParseJWKS(t *testing.T) {
+	keys, err := parseJWKS([]byte(testJWKSDocument(t, "foo")))
+	assert.NoError(t, err)
+	// The key with `"use": "enc"` is expected to be skipped.
+	assert.Len(t, keys, 1)
+	assert.Contains(t, keys, "foo")
+
+	_, err = parseJWKS([]byte(`{"keys": [{"kid": "foo", "kty": "RSA", "n": "", "e": "AQAB"}]}`))
+	assert.Error(t, err)
+
+	_, err = parseJWKS([]byte(`{"keys": `))
+	assert.Error(t, err)
+}
+
+func TestJWKS_RefetchForUnknownKid(t *testing.T) {
+	var doc atomic.Value
+	var hits int32
+	doc.Store(`{"keys": []}`)
+	srv := createJWKSServer(&doc, &hits)
+	defer srv.Close()
+
+	s := NewJWKSSource(srv.URL)
+	s.minRefetchInterval = 0
+	assert.NoError(t, s.Refresh())
+	assert.Equal(t, 0, s.KeySet().Len())
+	useJWKSSource(t, s)
+
+	// The identity provider publishes the key after the last fetch. Expect
+	// the token to be verified after an on-demand fetch.
+	doc.Store(testJWKSDocument(t, testKid624))
+	vt, err := validateAuthToken(TenantAPITokenForKey624)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tenantfoo", vt.tenantName)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestJWKS_RefetchRateLimited(t *testing.T) {
+	var doc atomic.Value
+	var hits int32
+	doc.Store(`{"keys": []}`)
+	srv := createJWKSServer(&doc, &hits)
+	defer srv.Close()
+
+	s := NewJWKSSource(srv.URL)
+	s.minRefetchInterval = time.Hour
+	assert.NoError(t, s.Refresh())
+	useJWKSSource(t, s)
+
+	doc.Store(testJWKSDocument(t, testKid624))
+	for i := 0; i < 3; i++ {
+		_, err := validateAuthToken(TenantAPITokenForKey624)
+		assert.Error(t, err)
+	}
+	// Only the initial fetch is expected to have happened.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestJWKS_RefetchTimeBounded(t *testing.T) {
+	var doc, gate atomic.Value
+	var hits int32
+	doc.Store(`{"keys": []}`)
+	open := make(chan struct{})
+	close(open)
+	gate.Store(open)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-gate.Load().(chan struct{})
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, doc.Load().(string))
+	}))
+	defer srv.Close()
+
+	s := NewJWKSSource(srv.URL)
+	s.minRefetchInterval = 0
+	s.maxRefetchWait = 10 * time.Millisecond
+	assert.NoError(t, s.Refresh())
+	useJWKSSource(t, s)
+
+	// The JWKS endpoint is slow: the request does not wait for the fetch.
+	blocked := make(chan struct{})
+	gate.Store(blocked)
+	doc.Store(testJWKSDocument(t, testKid624))
+	start := time.Now()
+	_, err := validateAuthToken(TenantAPITokenForKey624)
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// The fetch completes in the background.
+	close(blocked)
+	assert.Eventually(t, func() bool {
+		_, ok := s.KeySet().Lookup(testKid624)
+		return ok
+	}, time.Second, time.Millisecond)
+	_, err = validateAuthToken(TenantAPITokenForKey624)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
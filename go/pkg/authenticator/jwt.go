@@ -15,31 +15,146 @@
 package authenticator
 
 import (
+	"crypto"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v4"
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	// If non-empty: require the `aud` claim to contain this value.
+	expectedAudience string
+	// If non-empty: require the `iss` claim to be one of these values.
+	expectedIssuers []string
+)
+
+/*
+Read expected audience and issuer(s) from environment variables
+API_AUTHTOKEN_EXPECTED_AUDIENCE and API_AUTHTOKEN_EXPECTED_ISSUERS (a
+comma-separated list). If not set, the corresponding claim is not checked.
+*/
+func readClaimsConfigFromEnv() {
+	expectedAudience = strings.TrimSpace(os.Getenv("API_AUTHTOKEN_EXPECTED_AUDIENCE"))
+	if expectedAudience != "" {
+		log.Infof("expected token audience: %s", expectedAudience)
+	} else {
+		log.Infof("API_AUTHTOKEN_EXPECTED_AUDIENCE is not set, don't check token audience")
+	}
+
+	expectedIssuers = nil
+	for _, iss := range strings.Split(os.Getenv("API_AUTHTOKEN_EXPECTED_ISSUERS"), ",") {
+		if iss = strings.TrimSpace(iss); iss != "" {
+			expectedIssuers = append(expectedIssuers, iss)
+		}
+	}
+	if len(expectedIssuers) > 0 {
+		log.Infof("expected token issuers: %v", expectedIssuers)
+	} else {
+		log.Infof("API_AUTHTOKEN_EXPECTED_ISSUERS is not set, don't check token issuer")
+	}
+}
+
+func issuerExpected(iss string) bool {
+	for _, e := range expectedIssuers {
+		if iss == e {
+			return true
+		}
+	}
+	return false
+}
+
+// The claims of an Opstrace tenant API authentication token: the standard
+// claims plus the optional custom `scope` and `selector` claims.
+type tenantTokenClaims struct {
+	jwt.RegisteredClaims
+	Scope    scopeClaim `json:"scope,omitempty"`
+	Selector string     `json:"selector,omitempty"`
+}
+
+// The outcome of successfully validating a tenant API authentication token.
+type verifiedToken struct {
+	tenantName string
+	scopes     scopeClaim
+	selector   string
+}
+
 /*
-The error message corresponding to the error returned in the 2-tuple is meant
-to be exposed in an HTTP response. That is, it must not expose too much detail
+The error returned in the 2-tuple is an `*authFailure`. Its message is meant to
+be exposed in an HTTP response. That is, it must not expose too much detail
 (trade-off between debuggability / devX and security).
 */
-func validateAuthTokenGetTenantName(authTokenUnverified string) (string, error) {
+func validateAuthToken(authTokenUnverified string) (*verifiedToken, error) {
+	// Skip the signature verification for a token that has been verified
+	// before (with the current set of keys).
+	gen := verifiedTokens.generation()
+	tokenclaims, cached := verifiedTokens.get(authTokenUnverified)
+	if !cached {
+		var veriferr error
+		tokenclaims, veriferr = verifyAuthTokenSignature(authTokenUnverified)
+		if veriferr != nil {
+			return nil, veriferr
+		}
+		verifiedTokens.add(authTokenUnverified, tokenclaims, gen)
+	}
+
+	// https://pkg.go.dev/github.com/golang-jwt/jwt/v4#RegisteredClaims
+	claims := &tokenclaims.RegisteredClaims
+	// log.Infof("claims: %+v", claims)
+
+	// Custom convention: encode Opstrace tenant name in subject, expect
+	// a specific prefix.
+	if !strings.HasPrefix(claims.Subject, "tenant-") {
+		return nil, tokenFailure(failureBadSubject, "invalid subject (tenant- prefix missing): %s", claims.Subject)
+	}
+
+	// Another part of custom spec/convection: the `aud` claim should identify
+	// the Opstrace cluster (`opstrace-cluster-<clustername>`) that this
+	// authenticator runs in, and the `iss` claim the token issuer. When
+	// configured, require both to match, so that a token minted for one
+	// cluster cannot be replayed against another one sharing a key pair.
+	if expectedAudience != "" && !claims.VerifyAudience(expectedAudience, true) {
+		return nil, tokenFailure(failureBadAudience, "unexpected audience: %v (expected: %s)",
+			claims.Audience, expectedAudience)
+	}
+
+	if len(expectedIssuers) > 0 && !issuerExpected(claims.Issuer) {
+		return nil, tokenFailure(failureBadIssuer, "unexpected issuer: %s (expected one of: %v)",
+			claims.Issuer, expectedIssuers)
+	}
+
+	tenantNameFromToken := strings.TrimPrefix(claims.Subject, "tenant-")
+
+	if reverr := getRevocationList().check(tenantNameFromToken, claims); reverr != nil {
+		return nil, tokenFailure(failureRevoked, "token revoked: %s", reverr)
+	}
+	// log.Debugf("authenticated for tenant: %s", tenantNameFromToken)
+
+	return &verifiedToken{
+		tenantName: tenantNameFromToken,
+		scopes:     tokenclaims.Scope,
+		selector:   tokenclaims.Selector,
+	}, nil
+}
+
+/*
+Parse the token, verify its signature and the time-based standard claims. Same
+error convention as for validateAuthToken().
+*/
+func verifyAuthTokenSignature(authTokenUnverified string) (*tenantTokenClaims, error) {
 	// Perform RFC 7519-compliant JWT verification (standard claims, such as
 	// exp and nbf, but also cryptographic signature verification). Expect a
-	// set of standard claims to be present (`sub`, `iss` and the likes), and
-	// custom claims to not be present.
+	// set of standard claims to be present (`sub`, `iss` and the likes). The
+	// only custom claims looked at are `scope` and `selector`.
 	tokenstruct, veriferr := jwt.ParseWithClaims(
-		authTokenUnverified, &jwt.RegisteredClaims{}, keyLookupCallback)
+		authTokenUnverified, &tenantTokenClaims{}, keyLookupCallback)
 
 	if veriferr != nil {
-		log.Infof("jwt verification failed: %s", veriferr)
 		// See below: must exit here, because `tokenstruct.Valid` may not
 		// be accessible. See #282.
-		return "", fmt.Errorf("bad authentication token")
+		return nil, failureFromJWTError(veriferr)
 	}
 
 	// The `err` check above should be enough, but the documentation for
@@ -48,76 +163,105 @@ func validateAuthTokenGetTenantName(authTokenUnverified string) (string, error)
 	// segmentation fault here when `veriferr` above is not `nil`! That is
 	// why there are two checks and exit routes now.
 	if !(tokenstruct.Valid) {
-		log.Infof("jwt verification failed: %s", veriferr)
-		return "", fmt.Errorf("bad authentication token")
+		return nil, tokenFailure(failureBadSignature, "token not valid")
 	}
 
-	// https://pkg.go.dev/github.com/golang-jwt/jwt/v4#RegisteredClaims
-	claims := tokenstruct.Claims.(*jwt.RegisteredClaims)
-	// log.Infof("claims: %+v", claims)
-
-	// Custom convention: encode Opstrace tenant name in subject, expect
-	// a specific prefix.
-	if !strings.HasPrefix(claims.Subject, "tenant-") {
-		log.Infof("invalid subject (tenant- prefix missing): %s", claims.Subject)
-		return "", fmt.Errorf("bad authentication token")
-	}
-
-	// Another part of custom spec/convection: we should also inspect the `aud`
-	// claim: should be an Opstrace cluster name, and match the cluster name of
-	// the Opstrace cluster that this authenticator runs in. Let's do this in
-	// the future. For now, technically, the cryptographic verification already
-	// confirms that (if key pairs are not shared between Opstrace clusters).
-
-	tenantNameFromToken := strings.TrimPrefix(claims.Subject, "tenant-")
-	// log.Debugf("authenticated for tenant: %s", tenantNameFromToken)
-
-	return tenantNameFromToken, nil
+	return tokenstruct.Claims.(*tenantTokenClaims), nil
 }
 
 /*
-First return value is of type `*rsa.PublicKey`. However, need to specify as
-type `interface{}` for compat with jwt lib.
+First return value is of type `*rsa.PublicKey`, `*ecdsa.PublicKey` or
+`ed25519.PublicKey`. However, need to specify as type `interface{}` for compat
+with jwt lib.
 */
 func keyLookupCallback(unveriftoken *jwt.Token) (interface{}, error) {
 	// Receives the parsed, but unverified JWT payload. Can inspect claims to
-	// decide which public key for verification to use. Use this to enforce the
-	// RS256 signing method for now.
+	// decide which public key for verification to use. Use this to enforce
+	// the signing method: each key is bound to exactly one algorithm (RS256,
+	// ES256, ES384 or EdDSA) by its type, see signingAlgForKey().
 
 	unverfClaimsStr := fmt.Sprintf("%v", unveriftoken.Claims)
 	kid, kidset := unveriftoken.Header["kid"]
+	alg := fmt.Sprintf("%v", unveriftoken.Header["alg"])
 
-	if unveriftoken.Header["alg"] != "RS256" {
-		return nil, fmt.Errorf(
-			"jwt verif: invalid alg: %s (unverif. claims: %v)",
-			unveriftoken.Header["alg"],
+	if !supportedSigningAlgs[alg] {
+		return nil, tokenFailure(failureUnsupportedAlg,
+			"invalid alg: %s (unverif. claims: %v)",
+			alg,
 			unverfClaimsStr,
 		)
 	}
 
+	var pkey crypto.PublicKey
 	if kidset {
 		kidStr := fmt.Sprintf("%s", kid)
-		pkey, keyknown := authtokenVerificationPubKeys[kidStr]
-
-		if keyknown {
-			// A public key with the key ID as referred to by this unverified
-			// authentication token is configured for the authenticator. That's
-			// the happy path. Use that key to cryptographically verify the
-			// token.
-			return pkey, nil
-		} else {
+		var keyknown bool
+		pkey, keyknown = lookupKey(kidStr)
+
+		if !keyknown {
 			// This could be an accident or a malicious token.
-			return nil, fmt.Errorf("jwt verif: unknown kid: %s", kidStr)
+			return nil, tokenFailure(failureUnknownKeyID, "unknown kid: %s", kidStr)
 		}
+		// A public key with the key ID as referred to by this unverified
+		// authentication token is configured for the authenticator. That's
+		// the happy path. Use that key to cryptographically verify the
+		// token (if the algorithm matches, see below).
 	} else {
-		if authtokenVerificationPubKeyFallback == nil {
-			return nil, fmt.Errorf(
+		pkey = authtokenVerificationKeySet.Fallback()
+		if pkey == nil {
+			return nil, tokenFailure(failureUnknownKeyID,
 				"kid not set in auth token, fallback key not set, consider token invalid (unverif. claims: %v)",
 				unverfClaimsStr,
 			)
 		}
 
 		log.Debug("kid not set in auth token, use fallback key (is configured)")
-		return authtokenVerificationPubKeyFallback, nil
 	}
+
+	keyalg, err := signingAlgForKey(pkey)
+	if err != nil {
+		return nil, tokenFailure(failureUnsupportedAlg, "%s", err)
+	}
+
+	// Do not trust the `alg` header: require it to match the algorithm that
+	// the key is bound to.
+	if alg != keyalg || unveriftoken.Method.Alg() != keyalg {
+		return nil, tokenFailure(failureUnsupportedAlg, "alg %s does not match key (expected alg: %s)", alg, keyalg)
+	}
+
+	return pkey, nil
+}
+
+// Signing algorithms accepted for tenant API tokens.
+var supportedSigningAlgs = map[string]bool{
+	jwt.SigningMethodRS256.Alg(): true,
+	jwt.SigningMethodES256.Alg(): true,
+	jwt.SigningMethodES384.Alg(): true,
+	jwt.SigningMethodEdDSA.Alg(): true,
+}
+
+/*
+Look up the public key with ID `kid`: first in the static key set, then in
+the JWKS key set (if configured). If the key is not known and JWKS is
+configured then re-fetch the JWKS document (rate limited): the token might
+have been signed with a key that was added after the last fetch.
+*/
+func lookupKey(kid string) (crypto.PublicKey, bool) {
+	if pkey, ok := authtokenVerificationKeySet.Lookup(kid); ok {
+		return pkey, true
+	}
+
+	jwks := getJWKSSource()
+	if jwks == nil {
+		return nil, false
+	}
+
+	if pkey, ok := jwks.KeySet().Lookup(kid); ok {
+		return pkey, true
+	}
+
+	if jwks.RefreshForUnknownKeyID(kid) {
+		return jwks.KeySet().Lookup(kid)
+	}
+	return nil, false
 }
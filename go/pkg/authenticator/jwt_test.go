@@ -0,0 +1,183 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// Use a static key set with the given keys as the authenticator's only key
+// source for the duration of a test.
+func useStaticKeySet(t *testing.T, keys map[string]crypto.PublicKey) {
+	prevJWKS, prevKeySet := getJWKSSource(), authtokenVerificationKeySet
+	setJWKSSource(nil)
+	authtokenVerificationKeySet = NewKeySet("static")
+	authtokenVerificationKeySet.Replace(keys)
+	verifiedTokens.purge()
+	t.Cleanup(func() {
+		setJWKSSource(prevJWKS)
+		authtokenVerificationKeySet = prevKeySet
+		verifiedTokens.purge()
+	})
+}
+
+// Serialize `pubkey` the same way as a cluster admin would (PEM-encoded X.509
+// SubjectPublicKeyInfo), and deserialize it again. Return the key and its ID.
+func pemRoundTrip(t *testing.T, pubkey crypto.PublicKey) (string, crypto.PublicKey) {
+	der, err := x509.MarshalPKIXPublicKey(pubkey)
+	assert.NoError(t, err)
+	pemstring := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	key, err := deserializePubKeyFromPEMBytes([]byte(pemstring))
+	assert.NoError(t, err)
+	return keyIDfromPEM(pemstring), key
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, privkey interface{}) string {
+	token := jwt.NewWithClaims(method, &jwt.RegisteredClaims{
+		Subject:   "tenant-tenantfoo",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(privkey)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestValidateAuthToken_ES256(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	kid, pubkey := pemRoundTrip(t, &privkey.PublicKey)
+	useStaticKeySet(t, map[string]crypto.PublicKey{kid: pubkey})
+
+	vt, err := validateAuthToken(signTestToken(t, jwt.SigningMethodES256, kid, privkey))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tenantfoo", vt.tenantName)
+	}
+
+	// Key is bound to ES256: reject an ES384 token referring to it.
+	p384privkey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	_, err = validateAuthToken(signTestToken(t, jwt.SigningMethodES384, kid, p384privkey))
+	assert.Error(t, err)
+}
+
+func TestValidateAuthToken_ES384(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	kid, pubkey := pemRoundTrip(t, &privkey.PublicKey)
+	useStaticKeySet(t, map[string]crypto.PublicKey{kid: pubkey})
+
+	vt, err := validateAuthToken(signTestToken(t, jwt.SigningMethodES384, kid, privkey))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tenantfoo", vt.tenantName)
+	}
+}
+
+func TestValidateAuthToken_EdDSA(t *testing.T) {
+	pub, privkey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	kid, pubkey := pemRoundTrip(t, pub)
+	useStaticKeySet(t, map[string]crypto.PublicKey{kid: pubkey})
+
+	vt, err := validateAuthToken(signTestToken(t, jwt.SigningMethodEdDSA, kid, privkey))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tenantfoo", vt.tenantName)
+	}
+}
+
+func TestValidateAuthToken_AlgConfusion(t *testing.T) {
+	ecprivkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	eckid, ecpubkey := pemRoundTrip(t, &ecprivkey.PublicKey)
+
+	_, edprivkey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	useStaticKeySet(t, map[string]crypto.PublicKey{eckid: ecpubkey})
+
+	// Token signed with an Ed25519 key, but referring to the ECDSA key.
+	_, err = validateAuthToken(signTestToken(t, jwt.SigningMethodEdDSA, eckid, edprivkey))
+	assert.Error(t, err)
+
+	// Token "signed" with HMAC, using the serialized public key as secret.
+	der, err := x509.MarshalPKIXPublicKey(&ecprivkey.PublicKey)
+	assert.NoError(t, err)
+	_, err = validateAuthToken(signTestToken(t, jwt.SigningMethodHS256, eckid, der))
+	assert.Error(t, err)
+}
+
+func TestDeserializePubKey_UnsupportedCurve(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&privkey.PublicKey)
+	assert.NoError(t, err)
+
+	_, err = deserializePubKeyFromPEMBytes(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.Error(t, err)
+}
+
+// Use the given expected audience and issuers for the duration of a test.
+func useExpectedClaims(t *testing.T, audience string, issuers []string) {
+	prevAudience, prevIssuers := expectedAudience, expectedIssuers
+	expectedAudience, expectedIssuers = audience, issuers
+	t.Cleanup(func() {
+		expectedAudience, expectedIssuers = prevAudience, prevIssuers
+	})
+}
+
+func TestValidateAuthToken_AudienceIssuer(t *testing.T) {
+	useStaticKeySet(t, nil)
+	keys, err := parseKeySetJSON([]byte(TestKeysetEnvValThreePubkeys))
+	assert.NoError(t, err)
+	authtokenVerificationKeySet.Replace(keys)
+
+	// TenantAPITokenForKey624 was issued by `opstrace-cli` for the cluster
+	// `instancename`.
+	useExpectedClaims(t, "opstrace-cluster-instancename", []string{"foo", "opstrace-cli"})
+	vt, err := validateAuthToken(TenantAPITokenForKey624)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tenantfoo", vt.tenantName)
+	}
+
+	useExpectedClaims(t, "opstrace-cluster-prod", nil)
+	_, err = validateAuthToken(TenantAPITokenForKey624)
+	assert.EqualError(t, err, "bad authentication token")
+
+	useExpectedClaims(t, "", []string{"foo"})
+	_, err = validateAuthToken(TenantAPITokenForKey624)
+	assert.EqualError(t, err, "bad authentication token")
+}
+
+func TestReadClaimsConfigFromEnv(t *testing.T) {
+	useExpectedClaims(t, "", nil)
+	t.Setenv("API_AUTHTOKEN_EXPECTED_AUDIENCE", "opstrace-cluster-prod")
+	t.Setenv("API_AUTHTOKEN_EXPECTED_ISSUERS", "opstrace-cli, https://idp.example.com ,")
+
+	readClaimsConfigFromEnv()
+	assert.Equal(t, "opstrace-cluster-prod", expectedAudience)
+	assert.Equal(t, []string{"opstrace-cli", "https://idp.example.com"}, expectedIssuers)
+}
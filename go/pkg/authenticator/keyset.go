@@ -15,25 +15,130 @@
 package authenticator
 
 import (
-	"crypto/rsa"
+	"crypto"
 	// Disable warning for using sha1: a cryptographically secure hash is not
 	// needed here: an cluster admin generates and manages key pairs, and only
 	// trusted admin is supposed to add or remove keys from the key set.
 	//nolint: gosec
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	json "github.com/json-iterator/go"
 	log "github.com/sirupsen/logrus"
 )
 
-// Map for key set (the set of public keys considered for token verification).
-// Map key: key ID corresponding to public key.
-var authtokenVerificationPubKeys map[string]*rsa.PublicKey
+/*
+KeySet is the set of public keys considered for token verification.
+
+Keys are indexed by their key ID. A KeySet is safe for concurrent use: the
+key map is only ever swapped as a whole (see `Replace()`), so that keys can be
+rotated while requests are being authenticated, without restarting the
+process.
+
+The fallback key is used for legacy tokens that do not encode a key ID.
+
+`name` identifies the key set in log messages and metrics.
+*/
+type KeySet struct {
+	name     string
+	mu       sync.RWMutex
+	keys     map[string]crypto.PublicKey
+	fallback crypto.PublicKey
+}
+
+func NewKeySet(name string) *KeySet {
+	return &KeySet{name: name, keys: make(map[string]crypto.PublicKey)}
+}
+
+// The key set used by the authenticator for token verification, configured
+// statically or via a file (see ReadConfigFromEnvOrCrash()).
+var authtokenVerificationKeySet = NewKeySet("static")
+
+// Lookup returns the public key with ID `kid`, and whether it is known.
+func (ks *KeySet) Lookup(kid string) (crypto.PublicKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	pkey, ok := ks.keys[kid]
+	return pkey, ok
+}
+
+// Fallback returns the fallback key, or nil if none is configured.
+func (ks *KeySet) Fallback() crypto.PublicKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.fallback
+}
+
+func (ks *KeySet) SetFallback(pubkey crypto.PublicKey) {
+	ks.mu.Lock()
+	ks.fallback = pubkey
+	ks.mu.Unlock()
+	verifiedTokens.purge()
+}
+
+// Len returns the number of keys in the set (not counting the fallback key).
+func (ks *KeySet) Len() int {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return len(ks.keys)
+}
+
+// KeyIDs returns the sorted IDs of the keys in the set.
+func (ks *KeySet) KeyIDs() []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return sortedKeyIDs(ks.keys)
+}
+
+/*
+Replace swaps the current set of keys for `keys`. Log each key that has been
+added or removed, and account for these changes in the key set metrics.
+
+The caller must not modify `keys` after handing it over.
+*/
+func (ks *KeySet) Replace(keys map[string]crypto.PublicKey) {
+	ks.mu.Lock()
+	old := ks.keys
+	ks.keys = keys
+	ks.mu.Unlock()
+
+	changed := false
+	for _, kid := range sortedKeyIDs(keys) {
+		if _, known := old[kid]; !known {
+			log.Infof("authenticator: key set %s: added key with ID %s", ks.name, kid)
+			keySetChangesTotal.WithLabelValues(ks.name, "added").Inc()
+			changed = true
+		}
+	}
+	for _, kid := range sortedKeyIDs(old) {
+		if _, kept := keys[kid]; !kept {
+			log.Infof("authenticator: key set %s: removed key with ID %s", ks.name, kid)
+			keySetChangesTotal.WithLabelValues(ks.name, "removed").Inc()
+			changed = true
+		}
+	}
+	keySetKeys.WithLabelValues(ks.name).Set(float64(len(keys)))
 
-var authtokenVerificationPubKeyFallback *rsa.PublicKey
+	if changed {
+		// Tokens verified with a key that is gone must not be accepted
+		// anymore.
+		verifiedTokens.purge()
+	}
+}
+
+func sortedKeyIDs(keys map[string]crypto.PublicKey) []string {
+	kids := make([]string, 0, len(keys))
+	for kid := range keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	return kids
+}
 
 func keyIDfromPEM(pemstring string) string {
 	//nolint: gosec // a strong hash is not needed here, md5 would also do it.
@@ -49,15 +154,38 @@ func keyIDfromPEM(pemstring string) string {
 Read set of public keys for authentication token verification from environment.
 If key deserialization fails or if no key is configured, log an error and exit
 the process with a non-zero exit code.
+
+If API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_PATH is set then read the key set from
+that file or directory (instead of from API_AUTHTOKEN_VERIFICATION_PUBKEY_SET),
+and keep watching it for changes: keys can then be rotated without restarting
+the process.
+
+If API_AUTHTOKEN_VERIFICATION_JWKS_URL is set then additionally consider the
+keys published in the JWKS document at that URL.
+
+Also read the expected token audience and issuer(s), see
+readClaimsConfigFromEnv(), and the token revocation list, see
+readRevocationConfigFromEnvOrCrash().
 */
 func ReadConfigFromEnvOrCrash() {
 	legacyReadAuthTokenVerificationKeyFromEnvOrCrash()
-	readKeySetJSONFromEnvOrCrash()
+
+	if path, present := os.LookupEnv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_PATH"); present && path != "" {
+		readKeySetFromPathOrCrash(path)
+	} else {
+		readKeySetJSONFromEnvOrCrash()
+	}
+
+	readJWKSConfigFromEnvOrCrash()
+	readClaimsConfigFromEnv()
+	readRevocationConfigFromEnvOrCrash()
+	readTokenCacheConfigFromEnvOrCrash()
 
 	// No verification key configured? Bad configuration state. Exit process
-	// non-zero.
-	if len(authtokenVerificationPubKeys) == 0 {
-		if authtokenVerificationPubKeyFallback == nil {
+	// non-zero. Note that a JWKS document may (temporarily) be empty: that
+	// is not considered a configuration error.
+	if authtokenVerificationKeySet.Len() == 0 && getJWKSSource() == nil {
+		if authtokenVerificationKeySet.Fallback() == nil {
 			log.Error("authenticator: bad config: key set not configured and no fallback key set.")
 			os.Exit(1)
 		}
@@ -74,55 +202,66 @@ exit code.
 If the environment variable is empty or not set, use an empty key set.
 */
 func readKeySetJSONFromEnvOrCrash() {
-	// Initialize map (make it empty!)
-	authtokenVerificationPubKeys = make(map[string]*rsa.PublicKey)
-
 	data, present := os.LookupEnv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET")
 
 	if !present {
 		log.Errorf("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET is not set.")
+		// Initialize key set (make it empty!)
+		authtokenVerificationKeySet.Replace(make(map[string]crypto.PublicKey))
 		return
 	}
 
 	if data == "" {
 		log.Errorf("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET is empty.")
+		authtokenVerificationKeySet.Replace(make(map[string]crypto.PublicKey))
 		return
 	}
 
 	log.Infof("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET value: %s", data)
 
-	var keys map[string]string
-	jerr := json.Unmarshal([]byte(data), &keys)
-	if jerr != nil {
-		log.Errorf("error while JSON-parsing API_AUTHTOKEN_VERIFICATION_PUBKEY_SET: %s", jerr)
+	keys, err := parseKeySetJSON([]byte(data))
+	if err != nil {
+		log.Errorf("error while parsing API_AUTHTOKEN_VERIFICATION_PUBKEY_SET: %s", err)
 		os.Exit(1)
 	}
 
-	for kidFromConfig, pemstring := range keys {
-		log.Infof("parse PEM bytes for key with ID %s", kidFromConfig)
+	// Store in global authenticator key set.
+	authtokenVerificationKeySet.Replace(keys)
+}
+
+/*
+Parse a key set JSON document: a flat map with key IDs as keys and
+PEM-encoded public keys as values (see README.md). Require each key ID to
+match the ID calculated from the corresponding key.
+*/
+func parseKeySetJSON(data []byte) (map[string]crypto.PublicKey, error) {
+	var pemstrings map[string]string
+	jerr := json.Unmarshal(data, &pemstrings)
+	if jerr != nil {
+		return nil, fmt.Errorf("error while JSON-parsing key set: %s", jerr)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for kidFromConfig, pemstring := range pemstrings {
+		log.Debugf("parse PEM bytes for key with ID %s", kidFromConfig)
 		// We're interested in processing the (PEM) bytes underneath the string
 		// value.
-		pubkey, err := deserializeRSAPubKeyFromPEMBytes([]byte(pemstring))
+		pubkey, err := deserializePubKeyFromPEMBytes([]byte(pemstring))
 		if err != nil {
-			log.Errorf("%s", err)
-			os.Exit(1)
+			return nil, err
 		}
 
 		kidFromKey := keyIDfromPEM(pemstring)
-		log.Infof("calculated key ID from PEM data: %s", kidFromKey)
 		if kidFromKey != kidFromConfig {
-			log.Errorf("key ID from config (%s) does not match key ID calculated from key (%s)", kidFromConfig, kidFromKey)
-			os.Exit(1)
+			return nil, fmt.Errorf(
+				"key ID from config (%s) does not match key ID calculated from key (%s)",
+				kidFromConfig, kidFromKey)
 		}
-		log.Infof("key ID confirmed")
-
-		log.Infof(
-			"Parsed RSA public key. Modulus size: %d bits",
-			pubkey.Size()*8)
+		log.Debugf("key ID confirmed: %s", kidFromKey)
 
-		// Store in global authenticator key set.
-		authtokenVerificationPubKeys[kidFromConfig] = pubkey
+		keys[kidFromConfig] = pubkey
 	}
+	return keys, nil
 }
 
 func legacyReadAuthTokenVerificationKeyFromEnvOrCrash() {
@@ -147,14 +286,14 @@ func legacyReadAuthTokenVerificationKeyFromEnvOrCrash() {
 
 	// `os.LookupEnv` returns a string. We're interested in processing the
 	// bytes underneath it.
-	pubkey, err := deserializeRSAPubKeyFromPEMBytes([]byte(data))
+	pubkey, err := deserializePubKeyFromPEMBytes([]byte(data))
 	if err != nil {
 		// This is a permanent configuration error, crash the process.
 		log.Errorf("%s", err)
 		os.Exit(1)
 	}
 
-	// Set module global for subsequent consumption by authenticator logic.
-	authtokenVerificationPubKeyFallback = pubkey
+	// Set fallback key for subsequent consumption by authenticator logic.
+	authtokenVerificationKeySet.SetFallback(pubkey)
 	log.Infof("read RSA public key from legacy env var API_AUTHTOKEN_VERIFICATION_PUBKEY, using as fallback key")
 }
@@ -0,0 +1,141 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often a key set file or directory is checked for changes.
+const keySetReloadInterval = 10 * time.Second
+
+var (
+	keySetWatcherMu   sync.Mutex
+	keySetWatcherStop chan struct{}
+)
+
+/*
+Read the key set from `path` into the authenticator's key set, and start
+watching `path` for changes. If the initial read fails, log an error and exit
+the process with a non-zero exit code. Later read errors are logged, and the
+previous key set remains active.
+*/
+func readKeySetFromPathOrCrash(path string) {
+	log.Infof("read key set from %s", path)
+	keys, err := ReadKeySetFromPath(path)
+	if err != nil {
+		log.Errorf("error while reading key set from %s: %s", path, err)
+		os.Exit(1)
+	}
+	authtokenVerificationKeySet.Replace(keys)
+
+	// Stop a previously started watcher (ReadConfigFromEnvOrCrash() may be
+	// called more than once, for example in tests).
+	keySetWatcherMu.Lock()
+	defer keySetWatcherMu.Unlock()
+	if keySetWatcherStop != nil {
+		close(keySetWatcherStop)
+	}
+	keySetWatcherStop = make(chan struct{})
+	go authtokenVerificationKeySet.WatchPath(path, keySetReloadInterval, keySetWatcherStop)
+}
+
+/*
+ReadKeySetFromPath reads a set of public keys from a file or from a directory.
+
+A file is expected to contain a key set JSON document (the same format as
+accepted via API_AUTHTOKEN_VERIFICATION_PUBKEY_SET, see README.md).
+
+A directory is expected to contain one PEM-encoded public key per file, which
+is what a Kubernetes secret mounted as a volume looks like. The key ID is
+calculated from the PEM data. Hidden files (names starting with a dot) are
+ignored: Kubernetes uses them for atomically swapping the secret's contents.
+*/
+func ReadKeySetFromPath(path string) (map[string]crypto.PublicKey, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		data, rerr := ioutil.ReadFile(path)
+		if rerr != nil {
+			return nil, rerr
+		}
+		return parseKeySetJSON(data)
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		// Follow symlinks: do not rely on `entry.IsDir()`.
+		fp := filepath.Join(path, entry.Name())
+		efi, serr := os.Stat(fp)
+		if serr != nil {
+			return nil, serr
+		}
+		if efi.IsDir() {
+			continue
+		}
+
+		data, rerr := ioutil.ReadFile(fp)
+		if rerr != nil {
+			return nil, rerr
+		}
+
+		pubkey, derr := deserializePubKeyFromPEMBytes(data)
+		if derr != nil {
+			return nil, fmt.Errorf("%s: %s", fp, derr)
+		}
+		keys[keyIDfromPEM(string(data))] = pubkey
+	}
+	return keys, nil
+}
+
+/*
+WatchPath polls the file or directory at `path` every `interval` and replaces
+the keys in `ks` when the contents changed. Return when `stop` is closed.
+*/
+func (ks *KeySet) WatchPath(path string, interval time.Duration, stop <-chan struct{}) {
+	watchPath(path, interval, stop, "key set "+ks.name, func(initial bool) error {
+		keys, err := ReadKeySetFromPath(path)
+		if err != nil {
+			keySetReloadsTotal.WithLabelValues(ks.name, "failure").Inc()
+			return err
+		}
+		if !initial {
+			keySetReloadsTotal.WithLabelValues(ks.name, "success").Inc()
+		}
+		ks.Replace(keys)
+		return nil
+	})
+}
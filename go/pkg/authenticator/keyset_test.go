@@ -15,8 +15,12 @@
 package authenticator
 
 import (
+	"crypto"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -25,23 +29,23 @@ import (
 func TestKeysetFromEnv_TwoKeys(t *testing.T) {
 	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET", TestKeysetEnvValThreePubkeys)
 
-	log.Infof("keyset map:\n%v", authtokenVerificationPubKeys)
-	log.Infof("fallback key:\n%v", authtokenVerificationPubKeyFallback)
+	log.Infof("keyset key IDs:\n%v", authtokenVerificationKeySet.KeyIDs())
+	log.Infof("fallback key:\n%v", authtokenVerificationKeySet.Fallback())
 
 	assert.Empty(
 		t,
-		authtokenVerificationPubKeys,
-		"map authtokenVerificationPubKeys expected to be empty",
+		authtokenVerificationKeySet.KeyIDs(),
+		"key set expected to be empty",
 	)
 	readKeySetJSONFromEnvOrCrash()
 
-	log.Infof("keyset map:\n%v", authtokenVerificationPubKeys)
-	log.Infof("fallback key:\n%v", authtokenVerificationPubKeyFallback)
+	log.Infof("keyset key IDs:\n%v", authtokenVerificationKeySet.KeyIDs())
+	log.Infof("fallback key:\n%v", authtokenVerificationKeySet.Fallback())
 
 	assert.NotEmpty(
 		t,
-		authtokenVerificationPubKeys,
-		"map authtokenVerificationPubKeys expected to not be empty",
+		authtokenVerificationKeySet.KeyIDs(),
+		"key set expected to not be empty",
 	)
 }
 
@@ -52,6 +56,65 @@ func TestKeysetFromEnv_EmtpySetButFallback(t *testing.T) {
 	// This is now expected to _not_ crash, becuse a fallback key is
 	// configured.
 	ReadConfigFromEnvOrCrash()
-	log.Infof("keyset map:\n%v", authtokenVerificationPubKeys)
-	log.Infof("fallback key:\n%v", authtokenVerificationPubKeyFallback)
+	log.Infof("keyset key IDs:\n%v", authtokenVerificationKeySet.KeyIDs())
+	log.Infof("fallback key:\n%v", authtokenVerificationKeySet.Fallback())
+}
+
+func TestKeySetFromPath_File(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "keyset.json")
+	assert.NoError(t, ioutil.WriteFile(fp, []byte(TestKeysetEnvValThreePubkeys), 0600))
+
+	keys, err := ReadKeySetFromPath(fp)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+	assert.Contains(t, keys, "624bd05d77efb13d9d1ed923baef5483b5e07933")
+}
+
+func TestKeySetFromPath_Directory(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "key1.pem"), []byte(TestPubKey), 0600))
+	// Hidden files are expected to be ignored.
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".data"), []byte("not a key"), 0600))
+
+	keys, err := ReadKeySetFromPath(dir)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.Contains(t, keys, "df99d68cf04b53c2697e4b537d6236a7a1ee79e9")
+}
+
+func TestKeySetFromPath_BadKey(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "key1.pem"), []byte("foo"), 0600))
+
+	_, err := ReadKeySetFromPath(dir)
+	assert.Error(t, err)
+}
+
+func TestKeySet_WatchPath(t *testing.T) {
+	dir := t.TempDir()
+	ks := NewKeySet("test")
+	ks.Replace(make(map[string]crypto.PublicKey))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go ks.WatchPath(dir, 10*time.Millisecond, stop)
+
+	// Add a key: expect it to be picked up without explicit reload.
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "key1.pem"), []byte(TestPubKey), 0600))
+	assert.Eventually(t, func() bool {
+		_, ok := ks.Lookup("df99d68cf04b53c2697e4b537d6236a7a1ee79e9")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A broken key must not replace the current key set.
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "key2.pem"), []byte("foo"), 0600))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, ks.Len())
+
+	// Remove all keys.
+	assert.NoError(t, os.Remove(filepath.Join(dir, "key1.pem")))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "key2.pem")))
+	assert.Eventually(t, func() bool {
+		return ks.Len() == 0
+	}, 5*time.Second, 10*time.Millisecond)
 }
@@ -0,0 +1,66 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default registry, and are therefore exposed
+// via the `/metrics` endpoint of each process using the authenticator.
+var (
+	keySetKeys = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "authenticator",
+		Name:      "keyset_keys",
+		Help:      "Number of public keys in the authenticator key set.",
+	}, []string{"keyset"})
+
+	keySetChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "authenticator",
+		Name:      "keyset_changes_total",
+		Help:      "Number of public keys added to or removed from the authenticator key set.",
+	}, []string{"keyset", "change"})
+
+	keySetReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "authenticator",
+		Name:      "keyset_reloads_total",
+		Help:      "Number of attempts to reload a changed key set file or directory.",
+	}, []string{"keyset", "result"})
+
+	jwksFetchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "authenticator",
+		Name:      "jwks_fetches_total",
+		Help:      "Number of attempts to fetch the JWKS document.",
+	}, []string{"trigger", "result"})
+
+	revocationListEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "authenticator",
+		Name:      "revocation_list_entries",
+		Help:      "Number of entries in the token revocation list.",
+	}, []string{"kind"})
+
+	tokenCacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "authenticator",
+		Name:      "token_cache_requests_total",
+		Help:      "Number of verified token cache lookups, by result (hit or miss).",
+	}, []string{"result"})
+
+	authFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "authenticator",
+		Name:      "failures_total",
+		Help:      "Number of requests that failed authentication, by reason and tenant.",
+	}, []string{"reason", "tenant"})
+)
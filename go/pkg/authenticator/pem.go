@@ -15,16 +15,21 @@
 package authenticator
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 
+	"github.com/golang-jwt/jwt/v4"
 	log "github.com/sirupsen/logrus"
 )
 
 /*
-Decode RSA public key from PEM data, expecting the X.509 SubjectPublicKeyInfo
+Decode public key from PEM data, expecting the X.509 SubjectPublicKeyInfo
 format (which is what OpenSSL uses when writing a public key to a "PEM file").
 
 Assume byte sequence `data` to be ascii-encoded PEM text.
@@ -44,8 +49,12 @@ See https://stackoverflow.com/a/29707204/145400 for a lovely discussion about
 the X.509 SubjectPublicKeyInfo PEM serialization format, and how the difference
 between `BEGIN PUBLIC KEY` (supported here) and `BEGIN RSA PUBLIC KEY` (not
 supported here) matters a lot.
+
+Supported key types: RSA, ECDSA (curves P-256 and P-384), and Ed25519. The
+returned key is of type `*rsa.PublicKey`, `*ecdsa.PublicKey` or
+`ed25519.PublicKey`, respectively.
 */
-func deserializeRSAPubKeyFromPEMBytes(data []byte) (*rsa.PublicKey, error) {
+func deserializePubKeyFromPEMBytes(data []byte) (crypto.PublicKey, error) {
 	pubPem, _ := pem.Decode(data)
 
 	badFormatMsg := "Unexpected key format. Expected: PEM-encoded X.509 SubjectPublicKeyInfo"
@@ -60,17 +69,48 @@ func deserializeRSAPubKeyFromPEMBytes(data []byte) (*rsa.PublicKey, error) {
 	}
 
 	// ParsePKIXPublicKey() above can deserialize various key types (RSA,
-	// ECDSA, DSA). Use type assertion to see of which type the key is, and
-	// support RSA only here for now.
-	var pubkey *rsa.PublicKey
-	var ok bool
-	if pubkey, ok = parsedkey.(*rsa.PublicKey); !ok {
-		return nil, fmt.Errorf("pubkey is not of type RSA")
+	// ECDSA, Ed25519, DSA). Only accept the types for which a token signing
+	// algorithm is defined, see signingAlgForKey().
+	alg, err := signingAlgForKey(parsedkey)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Infof(
-		"Deserialized RSA public key with modulus size: %d bits",
-		pubkey.Size()*8)
+	if pubkey, ok := parsedkey.(*rsa.PublicKey); ok {
+		log.Infof(
+			"Deserialized RSA public key with modulus size: %d bits",
+			pubkey.Size()*8)
+	} else {
+		log.Infof("Deserialized public key for signing algorithm %s", alg)
+	}
+
+	return parsedkey, nil
+}
 
-	return pubkey, nil
+/*
+Return the JWT signing algorithm (`alg` header value) that a token must use to
+be verified with `key`.
+
+Binding each key to exactly one algorithm prevents algorithm confusion: an
+attacker cannot make the authenticator verify a token with an algorithm the key
+was not meant for (for example, HS256 with the public key as HMAC secret).
+*/
+func signingAlgForKey(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256.Alg(), nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256.Alg(), nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384.Alg(), nil
+		default:
+			return "", fmt.Errorf("pubkey is of type ECDSA with unsupported curve %s", k.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA.Alg(), nil
+	default:
+		return "", fmt.Errorf("pubkey is not of type RSA, ECDSA or Ed25519")
+	}
 }
@@ -0,0 +1,289 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	json "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+)
+
+// Default interval for re-reading the revocation list from its source.
+const revocationDefaultRefreshInterval = 30 * time.Second
+
+/*
+RevocationList describes tenant API tokens that must be rejected although they
+are cryptographically valid and not expired:
+
+- tokens with a specific token ID (`jti` claim), and
+- tokens for a specific tenant issued (`iat` claim) before a point in time.
+  That allows for revoking all tokens of a tenant at once, for example after
+  a leak of unknown extent.
+*/
+type RevocationList struct {
+	TokenIDs        map[string]struct{}
+	TenantNotBefore map[string]time.Time
+}
+
+// The revocation list used by the authenticator. Holds a `*RevocationList`
+// (nil if not configured). Swapped as a whole upon reload so that the check
+// in the request processing hot path does not need to take a lock.
+var authtokenRevocations atomic.Value
+
+func setRevocationList(rl *RevocationList) {
+	authtokenRevocations.Store(rl)
+	if rl != nil {
+		revocationListEntries.WithLabelValues("token_id").Set(float64(len(rl.TokenIDs)))
+		revocationListEntries.WithLabelValues("tenant_not_before").Set(float64(len(rl.TenantNotBefore)))
+	}
+}
+
+func getRevocationList() *RevocationList {
+	rl, _ := authtokenRevocations.Load().(*RevocationList)
+	return rl
+}
+
+/*
+Return a non-nil error describing why the (verified) token is revoked, or nil
+if it is not revoked. The error is meant for logging, not for an HTTP response.
+*/
+func (rl *RevocationList) check(tenantName string, claims *jwt.RegisteredClaims) error {
+	if rl == nil {
+		return nil
+	}
+
+	if claims.ID != "" {
+		if _, revoked := rl.TokenIDs[claims.ID]; revoked {
+			return fmt.Errorf("token ID %s is revoked", claims.ID)
+		}
+	}
+
+	if notBefore, ok := rl.TenantNotBefore[tenantName]; ok {
+		// Tokens without `iat` claim cannot be proven to have been issued
+		// after the cutoff: consider them revoked.
+		if claims.IssuedAt == nil {
+			return fmt.Errorf("tokens for tenant %s issued before %s are revoked, token has no iat claim",
+				tenantName, notBefore.Format(time.RFC3339))
+		}
+		if claims.IssuedAt.Time.Before(notBefore) {
+			return fmt.Errorf("tokens for tenant %s issued before %s are revoked (iat: %s)",
+				tenantName, notBefore.Format(time.RFC3339), claims.IssuedAt.Time.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+/*
+Revocation list file format (JSON):
+
+	{
+	  "token_ids": ["<jti>", ...],
+	  "tenant_not_before": {"<tenant name>": "<RFC 3339 timestamp>", ...}
+	}
+*/
+type revocationListDocument struct {
+	TokenIDs        []string          `json:"token_ids"`
+	TenantNotBefore map[string]string `json:"tenant_not_before"`
+}
+
+func parseRevocationListJSON(data []byte) (*RevocationList, error) {
+	var doc revocationListDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error while JSON-parsing revocation list: %s", err)
+	}
+
+	rl := newRevocationList()
+	for _, jti := range doc.TokenIDs {
+		rl.TokenIDs[jti] = struct{}{}
+	}
+	for tenant, ts := range doc.TenantNotBefore {
+		if err := rl.addTenantNotBefore(tenant, ts); err != nil {
+			return nil, err
+		}
+	}
+	return rl, nil
+}
+
+func newRevocationList() *RevocationList {
+	return &RevocationList{
+		TokenIDs:        make(map[string]struct{}),
+		TenantNotBefore: make(map[string]time.Time),
+	}
+}
+
+// Record that tokens for `tenant` issued before `ts` (RFC 3339) are revoked.
+// Keep the latest cutoff when there is more than one for a tenant.
+func (rl *RevocationList) addTenantNotBefore(tenant string, ts string) error {
+	notBefore, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return fmt.Errorf("invalid not-before timestamp for tenant %s: %s", tenant, err)
+	}
+	if prev, ok := rl.TenantNotBefore[tenant]; !ok || notBefore.After(prev) {
+		rl.TenantNotBefore[tenant] = notBefore
+	}
+	return nil
+}
+
+func readRevocationListFromPath(path string) (*RevocationList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRevocationListJSON(data)
+}
+
+// Fetch the revocation list from the `token_revocation` table via the
+// Hasura GraphQL API.
+func fetchRevocationListFromGraphQL(access *graphql.GraphqlAccess) (*RevocationList, error) {
+	req, err := graphql.NewGetTokenRevocationsRequest(access.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp graphql.GetTokenRevocationsResponse
+	if err := access.Execute(req.Request, &resp); err != nil {
+		return nil, err
+	}
+
+	rl := newRevocationList()
+	for _, r := range resp.TokenRevocation {
+		if r.Jti != "" {
+			rl.TokenIDs[r.Jti] = struct{}{}
+		}
+		if r.NotBefore != "" {
+			if err := rl.addTenantNotBefore(r.Tenant, r.NotBefore); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rl, nil
+}
+
+var revocationRefreshStop chan struct{}
+
+/*
+Read revocation list configuration from environment.
+
+If API_AUTHTOKEN_REVOCATION_LIST_PATH is set then read the revocation list
+from that file, and keep watching it for changes.
+
+If API_AUTHTOKEN_REVOCATION_GRAPHQL_ENDPOINT is set then periodically fetch
+the revocation list from the Hasura GraphQL API at that URL, authenticating
+with HASURA_GRAPHQL_ADMIN_SECRET.
+
+API_AUTHTOKEN_REVOCATION_REFRESH_INTERVAL (a Go duration string) controls how
+often the revocation list is re-read. If the initial read fails or if the
+configuration is invalid, log an error and exit the process with a non-zero
+exit code.
+*/
+func readRevocationConfigFromEnvOrCrash() {
+	if revocationRefreshStop != nil {
+		close(revocationRefreshStop)
+		revocationRefreshStop = nil
+	}
+	setRevocationList(nil)
+
+	path := os.Getenv("API_AUTHTOKEN_REVOCATION_LIST_PATH")
+	endpoint := os.Getenv("API_AUTHTOKEN_REVOCATION_GRAPHQL_ENDPOINT")
+
+	if path == "" && endpoint == "" {
+		log.Infof("no token revocation list configured")
+		return
+	}
+	if path != "" && endpoint != "" {
+		log.Errorf("set only one of API_AUTHTOKEN_REVOCATION_LIST_PATH and API_AUTHTOKEN_REVOCATION_GRAPHQL_ENDPOINT")
+		os.Exit(1)
+	}
+
+	interval := revocationDefaultRefreshInterval
+	if ival := os.Getenv("API_AUTHTOKEN_REVOCATION_REFRESH_INTERVAL"); ival != "" {
+		var err error
+		interval, err = time.ParseDuration(ival)
+		if err != nil || interval <= 0 {
+			log.Errorf("invalid API_AUTHTOKEN_REVOCATION_REFRESH_INTERVAL: %s", ival)
+			os.Exit(1)
+		}
+	}
+
+	revocationRefreshStop = make(chan struct{})
+
+	if path != "" {
+		log.Infof("read token revocation list from %s", path)
+		rl, err := readRevocationListFromPath(path)
+		if err != nil {
+			log.Errorf("error while reading token revocation list: %s", err)
+			os.Exit(1)
+		}
+		setRevocationList(rl)
+
+		go watchPath(path, interval, revocationRefreshStop, "revocation list", func(bool) error {
+			rl, err := readRevocationListFromPath(path)
+			if err != nil {
+				return err
+			}
+			setRevocationList(rl)
+			return nil
+		})
+		return
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		log.Errorf("bad API_AUTHTOKEN_REVOCATION_GRAPHQL_ENDPOINT: %s", err)
+		os.Exit(1)
+	}
+	access := graphql.NewGraphqlAccess(endpointURL, os.Getenv("HASURA_GRAPHQL_ADMIN_SECRET"))
+
+	log.Infof("fetch token revocation list from %s", endpointURL)
+	rl, err := fetchRevocationListFromGraphQL(access)
+	if err != nil {
+		log.Errorf("error while fetching token revocation list: %s", err)
+		os.Exit(1)
+	}
+	setRevocationList(rl)
+
+	go pollRevocationListFromGraphQL(access, interval, revocationRefreshStop)
+}
+
+func pollRevocationListFromGraphQL(access *graphql.GraphqlAccess, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		rl, err := fetchRevocationListFromGraphQL(access)
+		if err != nil {
+			// Keep using the previous revocation list.
+			log.Warnf("error while fetching token revocation list, keep previous list: %s", err)
+			continue
+		}
+		setRevocationList(rl)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+)
+
+// Use `rl` as the authenticator's revocation list for the duration of a test.
+func useRevocationList(t *testing.T, rl *RevocationList) {
+	prev := getRevocationList()
+	setRevocationList(rl)
+	t.Cleanup(func() { setRevocationList(prev) })
+}
+
+func TestRevocationList_TenantNotBefore(t *testing.T) {
+	keys, err := parseKeySetJSON([]byte(TestKeysetEnvValThreePubkeys))
+	assert.NoError(t, err)
+	useStaticKeySet(t, keys)
+
+	// TenantAPITokenForKey624 was issued at 2021-10-01T11:40:51Z.
+	rl, err := parseRevocationListJSON([]byte(`{"tenant_not_before": {"tenantfoo": "2021-10-01T00:00:00Z"}}`))
+	assert.NoError(t, err)
+	useRevocationList(t, rl)
+	_, err = validateAuthToken(TenantAPITokenForKey624)
+	assert.NoError(t, err)
+
+	rl, err = parseRevocationListJSON([]byte(`{"tenant_not_before": {"tenantfoo": "2021-10-02T00:00:00Z"}}`))
+	assert.NoError(t, err)
+	useRevocationList(t, rl)
+	_, err = validateAuthToken(TenantAPITokenForKey624)
+	assert.EqualError(t, err, "bad authentication token")
+
+	// Other tenants are not affected.
+	rl, err = parseRevocationListJSON([]byte(`{"tenant_not_before": {"tenantbar": "2031-10-02T00:00:00Z"}}`))
+	assert.NoError(t, err)
+	useRevocationList(t, rl)
+	_, err = validateAuthToken(TenantAPITokenForKey624)
+	assert.NoError(t, err)
+}
+
+func TestRevocationList_TokenID(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	kid, pubkey := pemRoundTrip(t, &privkey.PublicKey)
+	useStaticKeySet(t, map[string]crypto.PublicKey{kid: pubkey})
+
+	signWithID := func(jti string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, &jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   "tenant-tenantfoo",
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		})
+		token.Header["kid"] = kid
+		signed, serr := token.SignedString(privkey)
+		assert.NoError(t, serr)
+		return signed
+	}
+
+	rl, err := parseRevocationListJSON([]byte(`{"token_ids": ["leaked"]}`))
+	assert.NoError(t, err)
+	useRevocationList(t, rl)
+
+	_, err = validateAuthToken(signWithID("leaked"))
+	assert.EqualError(t, err, "bad authentication token")
+	_, err = validateAuthToken(signWithID("fine"))
+	assert.NoError(t, err)
+}
+
+func TestRevocationList_BadDocument(t *testing.T) {
+	_, err := parseRevocationListJSON([]byte(`{"tenant_not_before": {"tenantfoo": "yesterday"}}`))
+	assert.Error(t, err)
+}
+
+func TestRevocationList_FromGraphQL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("x-hasura-admin-secret"))
+		fmt.Fprint(w, `{"data": {"token_revocation": [
+			{"tenant": "foo", "jti": "leaked", "not_before": null},
+			{"tenant": "foo", "jti": null, "not_before": "2021-10-01T00:00:00+00:00"},
+			{"tenant": "foo", "jti": null, "not_before": "2021-10-22T10:15:33.451+00:00"}
+		]}}`)
+	}))
+	defer srv.Close()
+
+	srvURL, err := url.Parse(srv.URL)
+	assert.NoError(t, err)
+
+	rl, err := fetchRevocationListFromGraphQL(graphql.NewGraphqlAccess(srvURL, "secret"))
+	assert.NoError(t, err)
+	assert.Contains(t, rl.TokenIDs, "leaked")
+	// Expect the latest cutoff to win.
+	assert.Equal(t, "2021-10-22T10:15:33Z", rl.TenantNotBefore["foo"].UTC().Format(time.RFC3339))
+}
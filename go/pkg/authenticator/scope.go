@@ -0,0 +1,105 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"strings"
+
+	json "github.com/json-iterator/go"
+)
+
+// Scope is a permission that a tenant API authentication token may grant via
+// its custom `scope` claim. Route handlers declare the scope(s) they require.
+type Scope string
+
+const (
+	ScopeMetricsRead  Scope = "metrics:read"
+	ScopeMetricsWrite Scope = "metrics:write"
+	ScopeLogsRead     Scope = "logs:read"
+	ScopeLogsWrite    Scope = "logs:write"
+	ScopeTracesWrite  Scope = "traces:write"
+	ScopeConfigRead   Scope = "config:read"
+	ScopeConfigWrite  Scope = "config:write"
+)
+
+/*
+AnyScope returns a requirement met by a token granting any one of `scopes`,
+for a route serving different kinds of clients (such as the DD agent's
+connectivity check, for agents sending metrics or logs).
+*/
+func AnyScope(scopes ...Scope) Scope {
+	names := make([]string, len(scopes))
+	for i, s := range scopes {
+		names[i] = string(s)
+	}
+	return Scope(strings.Join(names, "|"))
+}
+
+/*
+The `scope` claim, either as a space-separated string (the RFC 8693 convention)
+or as a JSON array of strings.
+
+A nil scopeClaim means that the token does not carry a `scope` claim at all.
+For backwards compatibility with tokens issued before scopes were introduced,
+such a token grants every scope. A token with an empty `scope` claim grants
+none.
+*/
+type scopeClaim []string
+
+func (sc *scopeClaim) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*sc = append(scopeClaim{}, strings.Fields(s)...)
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("scope claim must be a string or an array of strings")
+	}
+	*sc = append(scopeClaim{}, list...)
+	return nil
+}
+
+// Return the first of `required` that is not granted, or an empty string if
+// all of them are.
+func (sc scopeClaim) missing(required []Scope) Scope {
+	if sc == nil {
+		return ""
+	}
+	for _, r := range required {
+		if !sc.has(r) {
+			return r
+		}
+	}
+	return ""
+}
+
+// Whether `s` is granted, or any of its alternatives (see AnyScope()).
+func (sc scopeClaim) has(s Scope) bool {
+	for _, alternative := range strings.Split(string(s), "|") {
+		for _, granted := range sc {
+			if granted == alternative {
+				return true
+			}
+		}
+	}
+	return false
+}
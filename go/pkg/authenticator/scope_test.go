@@ -0,0 +1,121 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopeClaim_Parse(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	kid, pubkey := pemRoundTrip(t, &privkey.PublicKey)
+	useStaticKeySet(t, map[string]crypto.PublicKey{kid: pubkey})
+
+	signWithScope := func(scope interface{}) string {
+		claims := jwt.MapClaims{
+			"sub": "tenant-tenantfoo",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		if scope != nil {
+			claims["scope"] = scope
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = kid
+		signed, serr := token.SignedString(privkey)
+		assert.NoError(t, serr)
+		return signed
+	}
+
+	// No scope claim: legacy token, unrestricted.
+	vt, err := validateAuthToken(signWithScope(nil))
+	if assert.NoError(t, err) {
+		assert.Nil(t, vt.scopes)
+		assert.Equal(t, Scope(""), vt.scopes.missing([]Scope{ScopeMetricsWrite, ScopeConfigWrite}))
+	}
+
+	// Space-separated string.
+	vt, err = validateAuthToken(signWithScope("metrics:write  logs:write"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, Scope(""), vt.scopes.missing([]Scope{ScopeMetricsWrite, ScopeLogsWrite}))
+		assert.Equal(t, ScopeMetricsRead, vt.scopes.missing([]Scope{ScopeMetricsWrite, ScopeMetricsRead}))
+		assert.Equal(t, Scope(""), vt.scopes.missing([]Scope{AnyScope(ScopeMetricsRead, ScopeLogsWrite)}))
+		assert.Equal(t, AnyScope(ScopeMetricsRead, ScopeLogsRead),
+			vt.scopes.missing([]Scope{AnyScope(ScopeMetricsRead, ScopeLogsRead)}))
+	}
+
+	// Array of strings.
+	vt, err = validateAuthToken(signWithScope([]string{"config:read"}))
+	if assert.NoError(t, err) {
+		assert.Equal(t, Scope(""), vt.scopes.missing([]Scope{ScopeConfigRead}))
+		assert.Equal(t, ScopeConfigWrite, vt.scopes.missing([]Scope{ScopeConfigWrite}))
+	}
+
+	// Empty scope claim: grants nothing.
+	vt, err = validateAuthToken(signWithScope(""))
+	if assert.NoError(t, err) {
+		assert.Equal(t, ScopeMetricsRead, vt.scopes.missing([]Scope{ScopeMetricsRead}))
+	}
+
+	_, err = validateAuthToken(signWithScope(42))
+	assert.EqualError(t, err, "bad authentication token")
+}
+
+func TestAuthenticateSpecificTenantByHeader_Scope(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	kid, pubkey := pemRoundTrip(t, &privkey.PublicKey)
+	useStaticKeySet(t, map[string]crypto.PublicKey{kid: pubkey})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"sub":   "tenant-tenantfoo",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "metrics:write",
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(privkey)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/push", nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+
+	w := httptest.NewRecorder()
+	assert.True(t, AuthenticateSpecificTenantByHeaderOr401(w, req, "tenantfoo", ScopeMetricsWrite))
+
+	w = httptest.NewRecorder()
+	assert.False(t, AuthenticateSpecificTenantByHeaderOr401(w, req, "tenantfoo", ScopeMetricsRead))
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Equal(t, "authentication token lacks required scope: metrics:read", w.Body.String())
+
+	// Tenant mismatch is still an authentication failure.
+	w = httptest.NewRecorder()
+	assert.False(t, AuthenticateSpecificTenantByHeaderOr401(w, req, "tenantbar", ScopeMetricsWrite))
+	assert.Equal(t, 401, w.Result().StatusCode)
+
+	headers := map[string][]string{"authorization": {"Bearer " + signed}}
+	assert.NoError(t, AuthenticateSpecificTenantByHeaderMap(headers, "authorization", "tenantfoo"))
+	assert.EqualError(t,
+		AuthenticateSpecificTenantByHeaderMap(headers, "authorization", "tenantfoo", ScopeTracesWrite),
+		"authentication token lacks required scope: traces:write")
+}
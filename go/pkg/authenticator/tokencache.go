@@ -0,0 +1,187 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"os"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const tokenCacheDefaultSize = 10000
+
+/*
+Cache for tokens whose signature has been verified, to save the (RSA)
+signature verification for subsequent requests presenting the same token.
+That matters for clients that send many small requests, such as Prometheus
+remote_write.
+
+Entries are keyed by the SHA-256 hash of the token (the raw token is not kept
+in memory). An entry holds the token's claims: the time-based claims (`exp`,
+`nbf`) and all other checks (tenant, audience, issuer, revocation) are
+evaluated again for each request, they are cheap.
+
+The cache is bounded: when full, the least recently used entry is evicted. It
+is purged whenever the set of verification keys changes, so that a removed key
+takes effect immediately. Tokens verified concurrently with a purge (possibly
+with the previous keys) are not added: see generation().
+*/
+type tokenCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	// Most recently used entry at the front.
+	lru *list.List
+	// Incremented by each purge.
+	gen uint64
+}
+
+type tokenCacheEntry struct {
+	key    [sha256.Size]byte
+	claims *tenantTokenClaims
+}
+
+func newTokenCache(size int) *tokenCache {
+	return &tokenCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// The cache used by the authenticator, see readTokenCacheConfigFromEnvOrCrash().
+var verifiedTokens = newTokenCache(tokenCacheDefaultSize)
+
+func tokenCacheKey(authToken string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(authToken))
+}
+
+// Return the claims of a cached token, and whether there was a cache hit.
+// Expired entries are removed, and reported as a miss.
+func (tc *tokenCache) get(authToken string) (*tenantTokenClaims, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.size <= 0 {
+		return nil, false
+	}
+
+	key := tokenCacheKey(authToken)
+	elem, ok := tc.entries[key]
+	if !ok {
+		tokenCacheRequestsTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+
+	entry := elem.Value.(*tokenCacheEntry)
+	// Check `exp` and `nbf` (and `iat`) against the current time, exactly
+	// like the JWT library does during verification.
+	if err := entry.claims.Valid(); err != nil {
+		tc.lru.Remove(elem)
+		delete(tc.entries, key)
+		tokenCacheRequestsTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+
+	tc.lru.MoveToFront(elem)
+	tokenCacheRequestsTotal.WithLabelValues("hit").Inc()
+	return entry.claims, true
+}
+
+// Return the current generation of the cache, to be passed to add(). Get it
+// before verifying a token.
+func (tc *tokenCache) generation() uint64 {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.gen
+}
+
+// Add the claims of a token whose signature has been verified, unless the
+// cache has been purged since generation `gen`: the token may have been
+// verified with a key that has been removed since.
+func (tc *tokenCache) add(authToken string, claims *tenantTokenClaims, gen uint64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.size <= 0 || gen != tc.gen {
+		return
+	}
+
+	key := tokenCacheKey(authToken)
+	if elem, ok := tc.entries[key]; ok {
+		elem.Value.(*tokenCacheEntry).claims = claims
+		tc.lru.MoveToFront(elem)
+		return
+	}
+
+	tc.entries[key] = tc.lru.PushFront(&tokenCacheEntry{key: key, claims: claims})
+	for tc.lru.Len() > tc.size {
+		oldest := tc.lru.Back()
+		tc.lru.Remove(oldest)
+		delete(tc.entries, oldest.Value.(*tokenCacheEntry).key)
+	}
+}
+
+// Remove all entries. Called when the verification keys change.
+func (tc *tokenCache) purge() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.entries = make(map[[sha256.Size]byte]*list.Element)
+	tc.lru.Init()
+	tc.gen++
+}
+
+// Set the maximum number of entries (0 disables the cache), and purge.
+func (tc *tokenCache) configure(size int) {
+	tc.mu.Lock()
+	tc.size = size
+	tc.mu.Unlock()
+	tc.purge()
+}
+
+func (tc *tokenCache) len() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.lru.Len()
+}
+
+/*
+Read the token cache size from the environment variable
+API_AUTHTOKEN_CACHE_SIZE (number of tokens, 0 disables the cache). If not set,
+use the default size. If the value is invalid, log an error and exit the
+process with a non-zero exit code.
+*/
+func readTokenCacheConfigFromEnvOrCrash() {
+	size := tokenCacheDefaultSize
+	if s, present := os.LookupEnv("API_AUTHTOKEN_CACHE_SIZE"); present && s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil || size < 0 {
+			log.Errorf("bad API_AUTHTOKEN_CACHE_SIZE: %s", s)
+			os.Exit(1)
+		}
+	}
+
+	if size == 0 {
+		log.Infof("verified token cache disabled")
+	} else {
+		log.Infof("verified token cache size: %d", size)
+	}
+	verifiedTokens.configure(size)
+}
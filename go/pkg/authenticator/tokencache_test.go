@@ -0,0 +1,120 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func testTokenClaims(exp time.Time) *tenantTokenClaims {
+	return &tenantTokenClaims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "tenant-tenantfoo",
+		ExpiresAt: jwt.NewNumericDate(exp),
+	}}
+}
+
+func TestTokenCache_EvictLeastRecentlyUsed(t *testing.T) {
+	tc := newTokenCache(2)
+	exp := time.Now().Add(time.Hour)
+	tc.add("a", testTokenClaims(exp), 0)
+	tc.add("b", testTokenClaims(exp), 0)
+
+	// Use "a", so that "b" is the least recently used entry.
+	_, hit := tc.get("a")
+	assert.True(t, hit)
+	tc.add("c", testTokenClaims(exp), 0)
+
+	assert.Equal(t, 2, tc.len())
+	_, hit = tc.get("b")
+	assert.False(t, hit)
+	_, hit = tc.get("a")
+	assert.True(t, hit)
+	_, hit = tc.get("c")
+	assert.True(t, hit)
+}
+
+func TestTokenCache_Expired(t *testing.T) {
+	tc := newTokenCache(10)
+	tc.add("a", testTokenClaims(time.Now().Add(-time.Second)), 0)
+	_, hit := tc.get("a")
+	assert.False(t, hit)
+	assert.Equal(t, 0, tc.len())
+
+	// Not valid yet.
+	claims := testTokenClaims(time.Now().Add(time.Hour))
+	claims.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Minute))
+	tc.add("b", claims, 0)
+	_, hit = tc.get("b")
+	assert.False(t, hit)
+}
+
+func TestTokenCache_Disabled(t *testing.T) {
+	tc := newTokenCache(0)
+	tc.add("a", testTokenClaims(time.Now().Add(time.Hour)), 0)
+	_, hit := tc.get("a")
+	assert.False(t, hit)
+	assert.Equal(t, 0, tc.len())
+}
+
+func TestTokenCache_PurgedDuringVerification(t *testing.T) {
+	tc := newTokenCache(10)
+	gen := tc.generation()
+	// The keys change while the token is being verified.
+	tc.purge()
+	tc.add("a", testTokenClaims(time.Now().Add(time.Hour)), gen)
+	_, hit := tc.get("a")
+	assert.False(t, hit)
+
+	tc.add("a", testTokenClaims(time.Now().Add(time.Hour)), tc.generation())
+	_, hit = tc.get("a")
+	assert.True(t, hit)
+}
+
+func TestValidateAuthToken_Cache(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	kid, pubkey := pemRoundTrip(t, &privkey.PublicKey)
+	useStaticKeySet(t, map[string]crypto.PublicKey{kid: pubkey})
+	token := signTestToken(t, jwt.SigningMethodES256, kid, privkey)
+
+	hits := testutil.ToFloat64(tokenCacheRequestsTotal.WithLabelValues("hit"))
+	_, err = validateAuthToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, verifiedTokens.len())
+	_, err = validateAuthToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, hits+1, testutil.ToFloat64(tokenCacheRequestsTotal.WithLabelValues("hit")))
+
+	// The claims checks still apply to a cached token.
+	useExpectedClaims(t, "opstrace-cluster-prod", nil)
+	_, err = validateAuthToken(token)
+	assert.EqualError(t, err, "bad authentication token")
+	useExpectedClaims(t, "", nil)
+
+	// Removing the key purges the cache: expect the token to be rejected.
+	authtokenVerificationKeySet.Replace(map[string]crypto.PublicKey{})
+	assert.Equal(t, 0, verifiedTokens.len())
+	_, err = validateAuthToken(token)
+	assert.EqualError(t, err, "bad authentication token")
+}
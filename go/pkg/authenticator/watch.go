@@ -0,0 +1,114 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Poll the file or directory at `path` every `interval` and call `reload` when
+its contents changed. Return when `stop` is closed. `what` describes the
+watched configuration in log messages.
+
+Polling (instead of relying on inotify) is robust against the symlink swaps
+performed by Kubernetes when updating a mounted secret or config map. The
+first poll always calls `reload` (with `initial` set to true), so that changes
+made before the watcher started are not missed.
+
+When `reload` fails, the error is logged and `reload` is not called again
+until the contents change again. It is up to `reload` to keep the previous
+configuration active in that case.
+*/
+func watchPath(
+	path string,
+	interval time.Duration,
+	stop <-chan struct{},
+	what string,
+	reload func(initial bool) error,
+) {
+	var lastDigest []byte
+	loaded := false
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		digest, err := digestPath(path)
+		if err != nil {
+			log.Warnf("authenticator: %s: cannot read %s: %s", what, path, err)
+			continue
+		}
+		if loaded && bytes.Equal(digest, lastDigest) {
+			continue
+		}
+
+		if err := reload(!loaded); err != nil {
+			log.Errorf("authenticator: %s: error while reloading %s, keep previous config: %s", what, path, err)
+		} else if loaded {
+			log.Infof("authenticator: %s: reloaded %s", what, path)
+		}
+		lastDigest = digest
+		loaded = true
+	}
+}
+
+// Concatenate the names and contents of the (non-hidden) files at `path`.
+// Configuration files are small: comparing their full content is cheap and,
+// unlike comparing modification times, does not miss updates.
+func digestPath(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return ioutil.ReadFile(path)
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, rerr := ioutil.ReadFile(filepath.Join(path, entry.Name()))
+		if rerr != nil {
+			// For example a subdirectory: ignored by ReadKeySetFromPath, too.
+			continue
+		}
+		buf.WriteString(entry.Name())
+		buf.WriteByte(0)
+		buf.Write(data)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), nil
+}
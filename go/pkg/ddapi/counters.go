@@ -0,0 +1,175 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
+)
+
+var trackedCounters = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ddapi_tracked_counters",
+	Help: "Number of Prometheus counters derived from DD count series, tracked in memory.",
+})
+
+// Name suffixes of the series derived from DD count and rate series.
+const (
+	counterSuffix   = "_total"
+	perSecondSuffix = "_per_second"
+)
+
+/*
+CounterConverter gives DD count and rate series Prometheus semantics, so
+that e.g. PromQL's rate() works on them:
+
+  - The points of a count series are the number of events in each flush
+    interval (deltas). They are summed up into a monotonically increasing
+    counter, named with the suffix `_total`.
+  - The points of a rate series are already per-second values (the DD agent
+    divides counts by the flush interval). They are written as gauges, named
+    with the suffix `_per_second`.
+
+In both cases the `type` and `interval` labels are dropped. Gauges are left
+as they are.
+
+The running totals are kept in memory, per series: they restart from zero
+(a counter reset) when the proxy restarts, and are forgotten after `ttl`
+without points. Each tenant must be served by a single proxy instance, or
+different instances would write diverging totals for the same series.
+Points not newer than the previous point of their series (such as payloads
+retried by the agent) are dropped, so that they are not counted twice.
+*/
+type CounterConverter struct {
+	mu        sync.Mutex
+	counters  map[string]*counterState
+	ttl       time.Duration
+	lastSweep time.Time
+	// For testing.
+	now func() time.Time
+}
+
+type counterState struct {
+	total float64
+	// Of the last point, in milliseconds since epoch.
+	lastTimestamp int64
+	lastUpdate    time.Time
+}
+
+func NewCounterConverter(ttl time.Duration) *CounterConverter {
+	return &CounterConverter{
+		counters: make(map[string]*counterState),
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// Convert the count and rate series in `ptsf` (as translated from DD
+// series, with `type` labels) in place.
+func (c *CounterConverter) Convert(ptsf []prompb.TimeSeries) []prompb.TimeSeries {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	out := ptsf[:0]
+	for _, ts := range ptsf {
+		switch remotewrite.LabelValue(ts.Labels, "type") {
+		case "count":
+			ts.Labels = convertLabels(ts.Labels, counterSuffix)
+			ts.Samples = c.accumulate(seriesKey(ts.Labels), ts.Samples, now)
+			if len(ts.Samples) == 0 {
+				continue
+			}
+		case "rate":
+			ts.Labels = convertLabels(ts.Labels, perSecondSuffix)
+		}
+		out = append(out, ts)
+	}
+
+	c.sweep(now)
+	return out
+}
+
+// Replace the samples (deltas) of the counter `key` with running totals.
+func (c *CounterConverter) accumulate(key string, samples []prompb.Sample, now time.Time) []prompb.Sample {
+	state, ok := c.counters[key]
+	if !ok {
+		state = &counterState{lastTimestamp: math.MinInt64}
+		c.counters[key] = state
+		trackedCounters.Inc()
+	}
+	state.lastUpdate = now
+
+	out := samples[:0]
+	for _, s := range samples {
+		if s.Timestamp <= state.lastTimestamp {
+			continue
+		}
+		state.total += s.Value
+		state.lastTimestamp = s.Timestamp
+		out = append(out, prompb.Sample{Value: state.total, Timestamp: s.Timestamp})
+	}
+	return out
+}
+
+// Forget the counters without points for `ttl`. Runs at most every `ttl`.
+func (c *CounterConverter) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	for key, state := range c.counters {
+		if now.Sub(state.lastUpdate) >= c.ttl {
+			delete(c.counters, key)
+			trackedCounters.Dec()
+		}
+	}
+}
+
+// Drop the `type` and `interval` labels, and add `suffix` to the metric name
+// (unless already there).
+func convertLabels(labels []prompb.Label, suffix string) []prompb.Label {
+	out := labels[:0]
+	for _, l := range labels {
+		switch l.Name {
+		case "type", "interval":
+			continue
+		case "__name__":
+			if !strings.HasSuffix(l.Value, suffix) {
+				l.Value += suffix
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// Identify a series by its label set, independent of the order of labels.
+func seriesKey(labels []prompb.Label) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.Name+"\xff"+l.Value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
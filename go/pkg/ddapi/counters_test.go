@@ -0,0 +1,64 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func translateTestSeries(t *testing.T, c *CounterConverter, doc string) map[string][]prompb.Sample {
+	ptsf, err := TranslateDDSeriesJSON([]byte(doc))
+	assert.NoError(t, err)
+	return seriesByLabels(c.Convert(ptsf))
+}
+
+func TestCounterConverter(t *testing.T) {
+	now := time.Unix(1610032230, 0)
+	c := NewCounterConverter(time.Hour)
+	c.now = func() time.Time { return now }
+
+	doc := `{"series": [
+		{"metric": "requests", "points": [[1610032220, 3], [1610032210, 2]], "host": "h", "type": "count", "interval": 10},
+		{"metric": "bytes", "points": [[1610032220, 1.5]], "host": "h", "type": "rate", "interval": 10},
+		{"metric": "load", "points": [[1610032220, 0.5]], "host": "h", "type": "gauge"}
+	]}`
+	assert.Equal(t, map[string][]prompb.Sample{
+		`{__name__="requests_total", instance="h", job="ddagent"}`: {
+			{Value: 2, Timestamp: 1610032210000},
+			{Value: 5, Timestamp: 1610032220000},
+		},
+		`{__name__="bytes_per_second", instance="h", job="ddagent"}`:   {{Value: 1.5, Timestamp: 1610032220000}},
+		`{__name__="load", instance="h", job="ddagent", type="gauge"}`: {{Value: 0.5, Timestamp: 1610032220000}},
+	}, translateTestSeries(t, c, doc))
+
+	// Retried points are not counted twice.
+	doc = `{"series": [
+		{"metric": "requests", "points": [[1610032220, 3], [1610032230, 4]], "host": "h", "type": "count", "interval": 10},
+		{"metric": "requests_total", "points": [[1610032220, 1]], "host": "h", "type": "count", "interval": 10}
+	]}`
+	assert.Equal(t, map[string][]prompb.Sample{
+		`{__name__="requests_total", instance="h", job="ddagent"}`: {{Value: 9, Timestamp: 1610032230000}},
+	}, translateTestSeries(t, c, doc))
+	assert.Len(t, c.counters, 1)
+
+	// Counters without points are forgotten after the TTL.
+	now = now.Add(time.Hour)
+	translateTestSeries(t, c, `{"series": []}`)
+	assert.Empty(t, c.counters)
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultMaxDecompressedSize is the default maximum size of a request body
+// after decompression. The DD API accepts up to 62 MB.
+const DefaultMaxDecompressedSize = 64 << 20
+
+/*
+ContentDecoder decodes a request body compressed with a Content-Encoding.
+`maxSize` is the maximum decompressed size (0 means unlimited): the decoder
+may use it to bound its memory usage, the output is truncated by the caller.
+*/
+type ContentDecoder func(r io.Reader, maxSize int64) (io.ReadCloser, error)
+
+/*
+DefaultContentDecoders returns the decoders for the content encodings sent
+by the DD agent (deflate, that is zlib, and gzip by newer agents) and by other
+clients (zstd). More can be added with DDCortexProxy.DecodeContent().
+*/
+func DefaultContentDecoders() map[string]ContentDecoder {
+	return map[string]ContentDecoder{
+		"deflate": decodeZlib,
+		"gzip":    decodeGzip,
+		"zstd":    decodeZstd,
+	}
+}
+
+func decodeZlib(r io.Reader, _ int64) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+func decodeGzip(r io.Reader, _ int64) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func decodeZstd(r io.Reader, maxSize int64) (io.ReadCloser, error) {
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true)}
+	if maxSize > 0 {
+		// Bound the window size, and thereby the allocated memory.
+		opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	}
+	d, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdReader{d.IOReadCloser()}, nil
+}
+
+// Reports frames exceeding the memory bound of the decoder as errBodyTooLarge.
+type zstdReader struct {
+	io.ReadCloser
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		err = errBodyTooLarge
+	}
+	return n, err
+}
+
+// Returned by decodeContent().
+var (
+	errBodyTooLarge        = errors.New("request body too large")
+	errUnsupportedEncoding = errors.New("unsupported content-encoding")
+)
+
+/*
+Decode `body`, compressed with the comma-separated content `encodings` in the
+order listed (as in the Content-Encoding header). Return errBodyTooLarge if a
+decompressed body exceeds `maxSize` bytes (0 means unlimited), which protects
+against decompression bombs.
+*/
+func decodeContent(body []byte, encodings string, decoders map[string]ContentDecoder, maxSize int64) ([]byte, error) {
+	r, err := newContentReader(bytes.NewReader(body), encodings, decoders, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+/*
+Like decodeContent(), but decode `body` as it is read from the returned
+reader. Errors of the decoders are returned by its Read(), as are
+errBodyTooLarge errors.
+*/
+func newContentReader(
+	body io.Reader,
+	encodings string,
+	decoders map[string]ContentDecoder,
+	maxSize int64,
+) (io.ReadCloser, error) {
+	var r io.ReadCloser = ioutil.NopCloser(body)
+	codings := strings.Split(encodings, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+		decode, ok := decoders[coding]
+		if !ok {
+			r.Close()
+			return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, coding)
+		}
+
+		dr, err := decode(r, maxSize)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("error while %s-decoding request body: %w", coding, err)
+		}
+		r = &decodedReader{ReadCloser: dr, inner: r, coding: coding, maxSize: maxSize}
+	}
+	return r, nil
+}
+
+// Limit `r`, the raw request body, to `maxSize` bytes (unless 0), like the
+// output of the decoders in newContentReader().
+func limitBody(r io.Reader, maxSize int64) io.ReadCloser {
+	return &decodedReader{ReadCloser: ioutil.NopCloser(r), maxSize: maxSize}
+}
+
+// The output of a content decoder (or, without `coding`, the raw body),
+// limited to `maxSize` bytes (unless 0).
+type decodedReader struct {
+	io.ReadCloser
+	// The input of the decoder.
+	inner   io.Closer
+	coding  string
+	maxSize int64
+	read    int64
+}
+
+func (d *decodedReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.read += int64(n)
+	if (d.maxSize > 0 && d.read > d.maxSize) || errors.Is(err, errBodyTooLarge) {
+		if d.coding == "" {
+			return 0, fmt.Errorf("%w: more than %d bytes", errBodyTooLarge, d.maxSize)
+		}
+		return 0, fmt.Errorf("%w: more than %d bytes after %s-decoding", errBodyTooLarge, d.maxSize, d.coding)
+	}
+	if err != nil && err != io.EOF && d.coding != "" {
+		err = fmt.Errorf("error while %s-decoding request body: %w", d.coding, err)
+	}
+	return n, err
+}
+
+func (d *decodedReader) Close() error {
+	err := d.ReadCloser.Close()
+	if d.inner != nil {
+		d.inner.Close()
+	}
+	return err
+}
+
+// Read `r` entirely, unless it has more than `maxSize` bytes (0 means
+// unlimited): then return errBodyTooLarge.
+func readAtMost(r io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
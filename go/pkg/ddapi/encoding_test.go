@@ -0,0 +1,135 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipEncode(t *testing.T, src []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(src)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func zstdEncode(t *testing.T, src []byte) []byte {
+	e, err := zstd.NewWriter(nil)
+	assert.NoError(t, err)
+	defer e.Close()
+	return e.EncodeAll(src, nil)
+}
+
+func TestDecodeContent(t *testing.T) {
+	doc := []byte(`{"series": []}`)
+	deflated, err := ZlibEncode(doc)
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		encodings string
+		body      []byte
+	}{
+		{"", doc},
+		{"identity", doc},
+		{"deflate", deflated},
+		{"gzip", gzipEncode(t, doc)},
+		{"zstd", zstdEncode(t, doc)},
+		{"GZip", gzipEncode(t, doc)},
+		// Applied in the order listed: decoded in reverse order.
+		{"deflate, zstd", zstdEncode(t, deflated)},
+	} {
+		decoded, err := decodeContent(tc.body, tc.encodings, DefaultContentDecoders(), 1024)
+		if assert.NoError(t, err, tc.encodings) {
+			assert.Equal(t, doc, decoded, tc.encodings)
+		}
+	}
+
+	_, err = decodeContent(doc, "gzip", DefaultContentDecoders(), 1024)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errBodyTooLarge)
+
+	_, err = decodeContent(doc, "br", DefaultContentDecoders(), 1024)
+	assert.ErrorIs(t, err, errUnsupportedEncoding)
+}
+
+func TestDecodeContent_bomb(t *testing.T) {
+	bomb := make([]byte, 10<<20)
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", gzipEncode(t, bomb)},
+		{"zstd", zstdEncode(t, bomb)},
+	} {
+		// Compresses by more than 100x.
+		assert.Less(t, len(tc.body), 64<<10, tc.encoding)
+
+		_, err := decodeContent(tc.body, tc.encoding, DefaultContentDecoders(), 1<<20)
+		assert.ErrorIs(t, err, errBodyTooLarge, tc.encoding)
+
+		decoded, err := decodeContent(tc.body, tc.encoding, DefaultContentDecoders(), 0)
+		if assert.NoError(t, err, tc.encoding) {
+			assert.Len(t, decoded, len(bomb))
+		}
+	}
+}
+
+func TestReadRequestBody(t *testing.T) {
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, "http://127.0.0.1:1/api/v1/push", disableAPIAuthentication).
+		MaxDecompressedSize(1 << 20)
+
+	read := func(encoding string, body []byte) (int, []byte) {
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/series", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		decoded, err := ddcp.readRequestBody(w, req)
+		if err != nil {
+			return w.Code, nil
+		}
+		return 0, decoded
+	}
+
+	doc := []byte(`{"series": []}`)
+	code, decoded := read("zstd", zstdEncode(t, doc))
+	assert.Equal(t, 0, code)
+	assert.Equal(t, doc, decoded)
+
+	code, _ = read("gzip", gzipEncode(t, make([]byte, 2<<20)))
+	assert.Equal(t, 413, code)
+	code, _ = read("", make([]byte, 2<<20))
+	assert.Equal(t, 413, code)
+	code, _ = read("br", doc)
+	assert.Equal(t, 415, code)
+	code, _ = read("gzip", doc)
+	assert.Equal(t, 400, code)
+
+	// Custom decoders.
+	ddcp.DecodeContent("x-identity", func(r io.Reader, _ int64) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	})
+	code, decoded = read("x-identity", doc)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, doc, decoded)
+}
@@ -16,6 +16,8 @@ package ddapi
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"mime"
@@ -31,13 +33,26 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/opstrace/opstrace/go/pkg/authenticator"
+	"github.com/opstrace/opstrace/go/pkg/lokipush"
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
 )
 
 type DDCortexProxy struct {
 	tenantName           string
 	authenticatorEnabled bool
-	remoteWriteURL       string
 	rwHTTPClient         *http.Client
+	relabeler            *remotewrite.Relabeler
+	sketchBuckets        []float64
+	counters             *CounterConverter
+	lokiPushURL          string
+	wal                  *WAL
+	targets              []*remotewrite.Target
+	// One per target, when writing through queues.
+	queues              []*remotewrite.QueueManager
+	decoders            map[string]ContentDecoder
+	maxDecompressedSize int64
+	// For testing.
+	seriesBatchSamples int
 }
 
 func NewDDCortexProxy(
@@ -45,22 +60,119 @@ func NewDDCortexProxy(
 	remoteWriteURL string,
 	disableAPIAuthentication bool) *DDCortexProxy {
 	p := &DDCortexProxy{
-		tenantName:     tenantName,
-		remoteWriteURL: remoteWriteURL,
+		tenantName: tenantName,
 		// Instantiate HTTP client for writing to a Prometheus remote_write
 		// endpoint (in this case this is expected to be served by Cortex).
 		rwHTTPClient:         buildRemoteWriteHTTPClient(),
 		authenticatorEnabled: !disableAPIAuthentication,
+		decoders:             DefaultContentDecoders(),
+		maxDecompressedSize:  DefaultMaxDecompressedSize,
+		seriesBatchSamples:   seriesBatchSamples,
+	}
+	p.targets = []*remotewrite.Target{
+		remotewrite.NewTarget(remotewrite.NewClient("cortex", remoteWriteURL,
+			map[string]string{"X-Scope-OrgID": tenantName}, p.rwHTTPClient), true),
 	}
 
 	return p
 }
 
+// Apply the relabeling rules of `relabeler` to the translated series before
+// writing them to Cortex.
+func (ddcp *DDCortexProxy) Relabel(relabeler *remotewrite.Relabeler) *DDCortexProxy {
+	ddcp.relabeler = relabeler
+	return ddcp
+}
+
+// Also write histogram-style bucket series with the upper bounds `buckets` for
+// distribution metrics, see TranslateDDSketchesProtobuf().
+func (ddcp *DDCortexProxy) SketchBuckets(buckets []float64) *DDCortexProxy {
+	ddcp.sketchBuckets = buckets
+	return ddcp
+}
+
+// Give count and rate series Prometheus semantics with `counters`, see
+// CounterConverter.
+func (ddcp *DDCortexProxy) ConvertCounters(counters *CounterConverter) *DDCortexProxy {
+	ddcp.counters = counters
+	return ddcp
+}
+
+/*
+Buffer writes to Cortex in `wal`: acknowledge them to the DD agent once
+appended, and ship them to Cortex in the background. See WAL.
+*/
+func (ddcp *DDCortexProxy) BufferWrites(wal *WAL) *DDCortexProxy {
+	ddcp.wal = wal
+	go wal.Ship(func(spbmsgbytes []byte) error {
+		return remotewrite.WriteToTargets(context.Background(), ddcp.targets, spbmsgbytes)
+	})
+	return ddcp
+}
+
+/*
+Write to Cortex through a queue per target with the configuration `cfg`:
+acknowledge writes to the DD agent once queued, and send them in concurrent
+batches in the background. See remotewrite.QueueManager. The queues of
+best-effort targets drop samples when they are full, rather than blocking.
+*/
+func (ddcp *DDCortexProxy) QueueWrites(cfg remotewrite.QueueConfig) *DDCortexProxy {
+	for _, t := range ddcp.targets {
+		q := remotewrite.NewQueueManager(cfg, t.Client())
+		q.Start()
+		ddcp.queues = append(ddcp.queues, q)
+	}
+	return ddcp
+}
+
+// Transport returns the transport of the proxy's HTTP clients, for the
+// clients of remote_write targets to share it (see WriteToTargets()).
+func (ddcp *DDCortexProxy) Transport() http.RoundTripper {
+	return ddcp.rwHTTPClient.Transport
+}
+
+/*
+Write to `targets` instead of the remote_write URL passed to
+NewDDCortexProxy(): concurrently, failing writes only when a required
+target fails (see remotewrite.WriteToTargets()). Must be called before
+BufferWrites() and QueueWrites().
+*/
+func (ddcp *DDCortexProxy) WriteToTargets(targets []*remotewrite.Target) *DDCortexProxy {
+	ddcp.targets = targets
+	return ddcp
+}
+
+// Decode request bodies with the Content-Encoding `encoding` with `decoder`,
+// in addition to (or instead of) the default decoders.
+func (ddcp *DDCortexProxy) DecodeContent(encoding string, decoder ContentDecoder) *DDCortexProxy {
+	ddcp.decoders[strings.ToLower(encoding)] = decoder
+	return ddcp
+}
+
+// Reject request bodies larger than `maxSize` bytes after decompression
+// (default: DefaultMaxDecompressedSize). Zero means unlimited.
+func (ddcp *DDCortexProxy) MaxDecompressedSize(maxSize int64) *DDCortexProxy {
+	ddcp.maxDecompressedSize = maxSize
+	return ddcp
+}
+
+// Forward the logs POSTed to /api/v2/logs to the Loki push endpoint
+// `lokiPushURL`. Without it, the logs endpoint responds with 404.
+func (ddcp *DDCortexProxy) ForwardLogs(lokiPushURL string) *DDCortexProxy {
+	ddcp.lokiPushURL = lokiPushURL
+	return ddcp
+}
+
 func logErrorEmit500(w http.ResponseWriter, e error) {
 	log.Error(fmt.Errorf("emit 500: %v", e))
 	http.Error(w, e.Error(), 500)
 }
 
+func logErrorEmit(w http.ResponseWriter, code int, e error) {
+	log.Error(fmt.Errorf("emit %d: %v", code, e))
+	http.Error(w, e.Error(), code)
+}
+
 func logErrorEmit400(w http.ResponseWriter, e error) {
 	log.Error(fmt.Errorf("emit 400: %v", e))
 	http.Error(w, e.Error(), 400)
@@ -71,6 +183,10 @@ func logErrorEmit400(w http.ResponseWriter, e error) {
 // https://gist.github.com/rjz/fe283b02cbaa50c5991e1ba921adf7c9
 // https://github.com/dcos/bouncer/blob/master/bouncer/app/wsgiapp.py
 func checkJSONContentType(r *http.Request) error {
+	return checkContentType(r, "application/json")
+}
+
+func checkContentType(r *http.Request, expected string) error {
 	ct := r.Header.Get("Content-type")
 
 	// Require header to be set.
@@ -87,11 +203,11 @@ func checkJSONContentType(r *http.Request) error {
 		if err != nil {
 			break
 		}
-		if t == "application/json" {
+		if t == expected {
 			return nil
 		}
 	}
-	return fmt.Errorf("unexpected content-type header (expecting: application/json)")
+	return fmt.Errorf("unexpected content-type header (expecting: %s)", expected)
 }
 
 /* Common request validation and processing for the URL handlers below. */
@@ -101,23 +217,32 @@ func (ddcp *DDCortexProxy) ReadAndValidateRequest(w http.ResponseWriter, r *http
 		logErrorEmit400(w, fmt.Errorf("bad request: %v", cterr))
 		return nil, fmt.Errorf("content type error")
 	}
+	return ddcp.readRequestBody(w, r)
+}
 
-	bodybytes, rerr := ioutil.ReadAll(r.Body)
+/*
+Read the request body, decompressing it according to its Content-Encoding
+(see DefaultContentDecoders()). Bodies larger than the maximum decompressed
+size, before or after decompression, are rejected with a 413 response.
+*/
+func (ddcp *DDCortexProxy) readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	bodybytes, rerr := readAtMost(r.Body, ddcp.maxDecompressedSize)
 	defer r.Body.Close()
 
+	if errors.Is(rerr, errBodyTooLarge) {
+		logErrorEmit(w, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body too large: more than %d bytes", ddcp.maxDecompressedSize))
+		return nil, rerr
+	}
 	if rerr != nil {
 		logErrorEmit500(w, fmt.Errorf("error while reading request body: %v", rerr))
 		return nil, fmt.Errorf("body read error")
 	}
 
-	if r.Header.Get("Content-Encoding") == "deflate" {
-		var zerr error
-		bodybytes, zerr = ZlibDecode(bodybytes)
-		if zerr != nil {
-			// Most likely bad input (bad request).
-			logErrorEmit400(w, fmt.Errorf("bad request: error while zlib-decoding request body: %v", zerr))
-			return nil, fmt.Errorf("zlib decode error")
-		}
+	bodybytes, derr := decodeContent(bodybytes, r.Header.Get("Content-Encoding"), ddcp.decoders, ddcp.maxDecompressedSize)
+	if derr != nil {
+		emitBodyError(w, derr)
+		return nil, derr
 	}
 
 	// Log detail on debug level. In particular the request body.
@@ -127,11 +252,61 @@ func (ddcp *DDCortexProxy) ReadAndValidateRequest(w http.ResponseWriter, r *http
 	return bodybytes, nil
 }
 
+// Respond to an error while decoding the request body (or reading the
+// decoded body).
+func emitBodyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		logErrorEmit(w, http.StatusRequestEntityTooLarge, err)
+	case errors.Is(err, errUnsupportedEncoding):
+		logErrorEmit(w, http.StatusUnsupportedMediaType, err)
+	default:
+		// Most likely bad input (bad request).
+		logErrorEmit400(w, fmt.Errorf("bad request: %v", err))
+	}
+}
+
 func (ddcp *DDCortexProxy) HandlerCommonAfterJSONTranslate(
 	w http.ResponseWriter,
 	r *http.Request,
 	ptsf []prompb.TimeSeries,
 ) {
+	if ddcp.writeSeries(r.Context(), w, ptsf) != nil {
+		// Error response has already been written.
+		return
+	}
+	respondAccepted(w)
+}
+
+/*
+Relabel `ptsf`, and write it through the queues, to the WAL, or to the
+remote_write targets, until `ctx` (of the request) is done. Upon error, write
+an error response to `w` and return the error.
+
+A write failing on a required queue (stopped, or full until the request is
+canceled) may have been accepted by the queues of other targets already, and
+in part by this one. These samples are sent: the retry of the DD agent writes
+them again, which Cortex and Prometheus accept for identical samples.
+*/
+func (ddcp *DDCortexProxy) writeSeries(ctx context.Context, w http.ResponseWriter, ptsf []prompb.TimeSeries) error {
+	if ddcp.relabeler != nil {
+		ptsf = ddcp.relabeler.Relabel(ddcp.tenantName, ptsf)
+	}
+
+	if ddcp.queues != nil {
+		for i, q := range ddcp.queues {
+			if !ddcp.targets[i].Required() {
+				q.TryAppend(ptsf)
+			} else if err := q.Append(ctx, ptsf); err != nil {
+				log.Errorf("emit 503: appending to remote_write queue failed: %s", err)
+				http.Error(w, fmt.Sprintf("appending to remote_write queue failed: %s", err),
+					http.StatusServiceUnavailable)
+				return err
+			}
+		}
+		return nil
+	}
+
 	// Create Prometheus/Cortex "write request", and serialize it into
 	// protobuf message (a byte sequence).
 	writeRequest := &prompb.WriteRequest{
@@ -142,30 +317,37 @@ func (ddcp *DDCortexProxy) HandlerCommonAfterJSONTranslate(
 	pbmsgbytes, perr := proto.Marshal(writeRequest)
 	if perr != nil {
 		logErrorEmit500(w, fmt.Errorf("error while constructing Prometheus protobuf message: %v", perr))
-		return
+		return perr
 	}
 
 	// Snappy-compress the byte sequence.
 	spbmsgbytes := snappy.Encode(nil, pbmsgbytes)
 
-	// Attempt to write this to Cortex via HTTP.
-	writeerr := ddcp.postPromWriteRequestAndHandleErrors(w, spbmsgbytes)
-
-	if writeerr != nil {
-		// That's the signal to terminate request processing. Error details can
-		// be ignored (rely on `postPromWriteRequestAndHandleErrors()` to have
-		// taken proper action, including logging).
-		return
+	if ddcp.wal != nil {
+		if err := ddcp.wal.Append(spbmsgbytes); err != nil {
+			log.Error(fmt.Errorf("emit 503: %v", err))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return err
+		}
+		return nil
 	}
 
-	// Make the DD agent's HTTP client happy: emit 202 response.
+	// Attempt to write this to Cortex via HTTP. Upon error,
+	// `postPromWriteRequestAndHandleErrors()` has taken proper action,
+	// including logging.
+	return ddcp.postPromWriteRequestAndHandleErrors(ctx, w, spbmsgbytes)
+}
+
+// Make the DD agent's HTTP client happy: emit 202 response.
+func respondAccepted(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte("{\"status\": \"ok\"}"))
 }
 
 func (ddcp *DDCortexProxy) HandlerCheckPost(w http.ResponseWriter, r *http.Request) {
-	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(w, r, ddcp.tenantName) {
+	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(
+		w, r, ddcp.tenantName, authenticator.ScopeMetricsWrite) {
 		// Error response has already been written. Terminate request handling.
 		return
 	}
@@ -189,28 +371,252 @@ func (ddcp *DDCortexProxy) HandlerCheckPost(w http.ResponseWriter, r *http.Reque
 	ddcp.HandlerCommonAfterJSONTranslate(w, r, promTimeSeriesFragments)
 }
 
+/*
+Handle the series POSTed to /api/v1/series. The body is decompressed and
+translated as it is read, and written in batches of about seriesBatchSamples
+samples (see TranslateDDSeriesJSONStream()), so that large payloads are not
+held in memory as a whole.
+
+If a batch cannot be written, or the rest of the body turns out to be
+invalid, the batches before it have already been written when the error
+response is sent. The DD agent then retries the whole payload, which is
+harmless: Cortex accepts samples it already has (same timestamp and value),
+and the CounterConverter drops points it has already counted.
+*/
 func (ddcp *DDCortexProxy) HandlerSeriesPost(w http.ResponseWriter, r *http.Request) {
-	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(w, r, ddcp.tenantName) {
+	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(
+		w, r, ddcp.tenantName, authenticator.ScopeMetricsWrite) {
 		// Error response has already been written. Terminate request handling.
 		return
 	}
 
-	bodybytes, err := ddcp.ReadAndValidateRequest(w, r)
+	if cterr := checkJSONContentType(r); cterr != nil {
+		logErrorEmit400(w, fmt.Errorf("bad request: %v", cterr))
+		return
+	}
+	defer r.Body.Close()
+	body, err := newContentReader(limitBody(r.Body, ddcp.maxDecompressedSize),
+		r.Header.Get("Content-Encoding"), ddcp.decoders, ddcp.maxDecompressedSize)
 	if err != nil {
+		emitBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	var werr error
+	terr := TranslateDDSeriesJSONStream(body, ddcp.seriesBatchSamples, func(batch []prompb.TimeSeries) error {
+		if ddcp.counters != nil {
+			batch = ddcp.counters.Convert(batch)
+		}
+		werr = ddcp.writeSeries(r.Context(), w, batch)
+		return werr
+	})
+	if werr != nil {
 		// Error response has already been written. Terminate request handling.
 		return
 	}
+	if terr != nil {
+		emitBodyError(w, fmt.Errorf("error while translating body: %w", terr))
+		return
+	}
+	respondAccepted(w)
+}
 
-	promTimeSeriesFragments, terr := TranslateDDSeriesJSON(bodybytes)
+/*
+Handle the series POSTed to /api/v2/series, as JSON (API clients) or as a
+protobuf `MetricPayload` message (DD agent 7.x).
+*/
+func (ddcp *DDCortexProxy) HandlerSeriesV2Post(w http.ResponseWriter, r *http.Request) {
+	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(
+		w, r, ddcp.tenantName, authenticator.ScopeMetricsWrite) {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	var translate func([]byte) ([]prompb.TimeSeries, error)
+	switch {
+	case checkJSONContentType(r) == nil:
+		translate = TranslateDDSeriesV2JSON
+	case checkContentType(r, "application/x-protobuf") == nil:
+		translate = TranslateDDSeriesV2Protobuf
+	default:
+		logErrorEmit400(w, fmt.Errorf(
+			"bad request: unexpected content-type header (expecting: application/json or application/x-protobuf)"))
+		return
+	}
+	bodybytes, err := ddcp.readRequestBody(w, r)
+	if err != nil {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	promTimeSeriesFragments, terr := translate(bodybytes)
 	if terr != nil {
 		// Most likely bad input (bad request).
 		logErrorEmit400(w, fmt.Errorf("bad request: error while translating body: %v", terr))
 		return
 	}
+	if ddcp.counters != nil {
+		promTimeSeriesFragments = ddcp.counters.Convert(promTimeSeriesFragments)
+	}
 
 	ddcp.HandlerCommonAfterJSONTranslate(w, r, promTimeSeriesFragments)
 }
 
+/*
+Handle the distribution metrics POSTed by the DD agent to /api/beta/sketches,
+as a protobuf `SketchPayload` message.
+*/
+func (ddcp *DDCortexProxy) HandlerSketchesPost(w http.ResponseWriter, r *http.Request) {
+	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(
+		w, r, ddcp.tenantName, authenticator.ScopeMetricsWrite) {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	if cterr := checkContentType(r, "application/x-protobuf"); cterr != nil {
+		logErrorEmit400(w, fmt.Errorf("bad request: %v", cterr))
+		return
+	}
+	bodybytes, err := ddcp.readRequestBody(w, r)
+	if err != nil {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	promTimeSeriesFragments, terr := TranslateDDSketchesProtobuf(bodybytes, ddcp.sketchBuckets)
+	if terr != nil {
+		// Most likely bad input (bad request).
+		logErrorEmit400(w, fmt.Errorf("bad request: error while translating body: %v", terr))
+		return
+	}
+
+	ddcp.HandlerCommonAfterJSONTranslate(w, r, promTimeSeriesFragments)
+}
+
+/*
+Handle the logs POSTed to /api/v2/logs, as JSON (optionally gzip- or
+zlib-compressed), by the DD agent or API clients. Translate them into a Loki
+push request, see TranslateDDLogsJSON().
+*/
+func (ddcp *DDCortexProxy) HandlerLogsPost(w http.ResponseWriter, r *http.Request) {
+	if ddcp.lokiPushURL == "" {
+		http.Error(w, "log forwarding is not enabled", http.StatusNotFound)
+		return
+	}
+
+	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(
+		w, r, ddcp.tenantName, authenticator.ScopeLogsWrite) {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	bodybytes, err := ddcp.ReadAndValidateRequest(w, r)
+	if err != nil {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	pr, terr := TranslateDDLogsJSON(bodybytes, time.Now())
+	if terr != nil {
+		// Most likely bad input (bad request).
+		logErrorEmit400(w, fmt.Errorf("bad request: error while translating body: %v", terr))
+		return
+	}
+
+	if perr := ddcp.pushToLokiAndHandleErrors(r.Context(), w, pr); perr != nil {
+		// Error response has already been written.
+		return
+	}
+
+	respondAccepted(w)
+}
+
+// Agents may send only metrics or only logs: accept either write scope.
+var validateScope = authenticator.AnyScope(authenticator.ScopeMetricsWrite, authenticator.ScopeLogsWrite)
+
+/*
+Handle the requests of the DD agent to /api/v1/validate, checking that its
+API key is valid: the agent reports that it is not connected otherwise.
+*/
+func (ddcp *DDCortexProxy) HandlerValidateGet(w http.ResponseWriter, r *http.Request) {
+	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(
+		w, r, ddcp.tenantName, validateScope) {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{\"valid\":true}"))
+}
+
+/*
+Handle the host metadata and events POSTed by the DD agent to /intake/, see
+TranslateDDIntakeJSON(). Events are pushed to Loki if log forwarding is
+enabled (see ForwardLogs()), and dropped otherwise.
+*/
+func (ddcp *DDCortexProxy) HandlerIntakePost(w http.ResponseWriter, r *http.Request) {
+	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(
+		w, r, ddcp.tenantName, authenticator.ScopeMetricsWrite) {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	bodybytes, err := ddcp.ReadAndValidateRequest(w, r)
+	if err != nil {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	pr, promTimeSeriesFragments, terr := TranslateDDIntakeJSON(bodybytes, time.Now())
+	if terr != nil {
+		// Most likely bad input (bad request).
+		logErrorEmit400(w, fmt.Errorf("bad request: error while translating body: %v", terr))
+		return
+	}
+
+	// Write the host metadata first: when the push to Loki fails, the retry
+	// of the agent writes identical samples again, which Cortex accepts,
+	// while the events would be stored twice.
+	if len(promTimeSeriesFragments) > 0 && ddcp.writeSeries(r.Context(), w, promTimeSeriesFragments) != nil {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	if len(pr.Streams) > 0 {
+		if ddcp.lokiPushURL == "" {
+			log.Debugf("log forwarding is not enabled, dropping %d event stream(s)", len(pr.Streams))
+		} else if perr := ddcp.pushToLokiAndHandleErrors(r.Context(), w, pr); perr != nil {
+			// Error response has already been written.
+			return
+		}
+	}
+	respondAccepted(w)
+}
+
+// Send the push request `pr` to Loki, until `ctx` (of the request) is done.
+// Upon error, write an error response to `w` and return the error.
+func (ddcp *DDCortexProxy) pushToLokiAndHandleErrors(
+	ctx context.Context,
+	w http.ResponseWriter,
+	pr *lokipush.PushRequest,
+) error {
+	pushbytes, err := lokipush.EncodePushRequest("application/x-protobuf", pr)
+	if err != nil {
+		logErrorEmit500(w, fmt.Errorf("error while encoding Loki push request: %v", err))
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ddcp.lokiPushURL, bytes.NewBuffer(pushbytes))
+	if err != nil {
+		logErrorEmit500(w, fmt.Errorf("could not create request: %v", err))
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	return ddcp.postAndHandleErrors(w, req, "loki")
+}
+
 /*
 Try to send the HTTP POST request to a Prometheus remote_write endpoint, as
 provided by the Cortex distributor/ingester system.
@@ -224,25 +630,38 @@ The challenge with this approach might be response translation -- after all, we
 may need to have more flexibility in translating Cortex responses for the DD
 agent.
 */
-func (ddcp *DDCortexProxy) postPromWriteRequestAndHandleErrors(w http.ResponseWriter, spbmsgbytes []byte) error {
-	req, err := http.NewRequest(
-		http.MethodPost,
-		ddcp.remoteWriteURL,
-		bytes.NewBuffer(spbmsgbytes),
-	)
-
-	// In which cases does this hit in (when does request construction fail)?
-	if err != nil {
-		return err
+func (ddcp *DDCortexProxy) postPromWriteRequestAndHandleErrors(
+	ctx context.Context,
+	w http.ResponseWriter,
+	spbmsgbytes []byte,
+) error {
+	err := remotewrite.WriteToTargets(ctx, ddcp.targets, spbmsgbytes)
+	if err == nil {
+		// Signal to the caller that the write to Cortex was successful.
+		return nil
 	}
 
-	// Cortex's remote_write endpoint expects a snappy-compressed protobuf
-	// message. Be explicit about what's sent.
-	req.Header.Add("X-Prometheus-Remote-Write-Version", "0.1.0")
-	req.Header.Add("Content-Encoding", "snappy")
-	req.Header.Set("Content-Type", "application/x-protobuf")
+	var herr *remotewrite.HTTPError
+	if !errors.As(err, &herr) {
+		// Transport-related errors, see postAndHandleErrors().
+		logErrorEmit500(w, fmt.Errorf("error while interacting with remote_write endpoint: %v", err))
+		return err
+	}
+	log.Infof("%s", err)
+	// TODO: think about how to translate Cortex error codes into errors
+	// that mean something to the DD agent? For now, forward the error
+	// response as-is.
+	w.WriteHeader(herr.StatusCode)
+	w.Write([]byte(herr.Body))
+	return err
+}
 
-	// Specify Cortex tenant to insert to.
+/*
+Send the HTTP request `req` to `backend` (Cortex or Loki), for the tenant of
+the proxy. Upon error, write an error response to `w` and return the error.
+*/
+func (ddcp *DDCortexProxy) postAndHandleErrors(w http.ResponseWriter, req *http.Request, backend string) error {
+	// Specify tenant to insert to.
 	req.Header.Set("X-Scope-OrgID", ddcp.tenantName)
 
 	resp, reqerr := ddcp.rwHTTPClient.Do(req)
@@ -254,7 +673,7 @@ func (ddcp *DDCortexProxy) postPromWriteRequestAndHandleErrors(w http.ResponseWr
 		// transport-related errors while trying to interact with the remote
 		// system. For timeouts, we should therefore emit a 504 Gateway
 		// Timeout.
-		logErrorEmit500(w, fmt.Errorf("error while interacting with remote_write endpoint: %v", reqerr))
+		logErrorEmit500(w, fmt.Errorf("error while interacting with %s: %v", backend, reqerr))
 		return reqerr
 	}
 	defer resp.Body.Close()
@@ -271,13 +690,13 @@ func (ddcp *DDCortexProxy) postPromWriteRequestAndHandleErrors(w http.ResponseWr
 		return nil
 	} else {
 		bodytext := string(bodybytes)
-		log.Infof("cortex HTTP response code: %v, HTTP response body: %v", resp.StatusCode, bodytext)
+		log.Infof("%s HTTP response code: %v, HTTP response body: %v", backend, resp.StatusCode, bodytext)
 		// TODO: think about how to translate Cortex error codes into errors
 		// that mean something to the DD agent? For now, forward the error
 		// response as-is.
 		w.WriteHeader(resp.StatusCode)
 		w.Write(bodybytes)
-		return fmt.Errorf("non-2xx HTTP response received from Cortex: %d", resp.StatusCode)
+		return fmt.Errorf("non-2xx HTTP response received from %s: %d", backend, resp.StatusCode)
 	}
 }
 
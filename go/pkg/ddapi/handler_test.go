@@ -23,9 +23,13 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/opstrace/opstrace/go/pkg/authenticator"
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
+	"github.com/prometheus/prometheus/prompb"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -589,6 +593,151 @@ func TestHandlerSeriesPostAuthenticator_goodtokengoodtenant(t *testing.T) {
 	)
 }
 
+func TestHandlerCommonAfterJSONTranslate_relabel(t *testing.T) {
+	// A remote_write endpoint recording the series it receives.
+	var received []prompb.TimeSeries
+	rwsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		wr, err := remotewrite.DecodeWriteRequest(body)
+		assert.NoError(t, err)
+		received = wr.Timeseries
+	}))
+	defer rwsrv.Close()
+
+	cfg, err := remotewrite.ParseRelabelConfig([]byte(`
+tenants:
+  test:
+    - target_label: source
+      replacement: ddapi
+    - source_labels: [__name__]
+      regex: dropme
+      action: drop
+`))
+	assert.NoError(t, err)
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, rwsrv.URL, disableAPIAuthentication).Relabel(remotewrite.NewRelabeler(cfg))
+
+	w := httptest.NewRecorder()
+	ddcp.HandlerCommonAfterJSONTranslate(w, genSubmitRequest("{}"), []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "keepme"}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "dropme"}}},
+	})
+	expectInsertSuccessResponse(w, t)
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "keepme"}, {Name: "source", Value: "ddapi"}},
+			received[0].Labels)
+	}
+}
+
+func TestHandlerCommonAfterJSONTranslate_queue(t *testing.T) {
+	var mu sync.Mutex
+	var received []prompb.TimeSeries
+	rwsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		wr, err := remotewrite.DecodeWriteRequest(body)
+		assert.NoError(t, err)
+		assert.Equal(t, TenantName, r.Header.Get("X-Scope-OrgID"))
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, wr.Timeseries...)
+	}))
+	defer rwsrv.Close()
+
+	disableAPIAuthentication := true
+	cfg := remotewrite.DefaultQueueConfig
+	cfg.MaxSamplesPerSend = 1
+	ddcp := NewDDCortexProxy(TenantName, rwsrv.URL, disableAPIAuthentication).QueueWrites(cfg)
+	defer ddcp.queues[0].Stop()
+
+	w := httptest.NewRecorder()
+	ddcp.HandlerCommonAfterJSONTranslate(w, genSubmitRequest("{}"), []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "a"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "b"}}, Samples: []prompb.Sample{{Value: 2, Timestamp: 1}}},
+	})
+	expectInsertSuccessResponse(w, t)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestHandlerCommonAfterJSONTranslate_queueFull(t *testing.T) {
+	unblock := make(chan struct{})
+	rwsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer rwsrv.Close()
+
+	disableAPIAuthentication := true
+	cfg := remotewrite.DefaultQueueConfig
+	cfg.Shards = 1
+	cfg.Capacity = 1
+	cfg.MaxSamplesPerSend = 1
+	ddcp := NewDDCortexProxy(TenantName, rwsrv.URL, disableAPIAuthentication).QueueWrites(cfg)
+	defer ddcp.queues[0].Stop()
+	defer close(unblock)
+
+	// The shard sends the first sample and buffers the second one. The request
+	// gives up waiting for room for the third one.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	ddcp.HandlerCommonAfterJSONTranslate(w, genSubmitRequest("{}").WithContext(ctx), []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "a"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "a"}}, Samples: []prompb.Sample{{Value: 2, Timestamp: 2}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "a"}}, Samples: []prompb.Sample{{Value: 3, Timestamp: 3}}},
+	})
+	assert.Equal(t, 503, w.Result().StatusCode)
+}
+
+func TestHandlerCommonAfterJSONTranslate_targets(t *testing.T) {
+	var mu sync.Mutex
+	var tenants []string
+	newEndpoint := func(statusCode int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			tenants = append(tenants, r.Header.Get("X-Scope-OrgID"))
+			w.WriteHeader(statusCode)
+			w.Write([]byte("rejected"))
+		}))
+	}
+	cortex := newEndpoint(200)
+	defer cortex.Close()
+	failing := newEndpoint(400)
+	defer failing.Close()
+
+	cfg, err := remotewrite.ParseTargetsConfig([]byte(fmt.Sprintf(`
+targets:
+  - name: cortex
+    url: %s
+  - name: migration
+    url: %s
+    tenant: other
+    policy: best_effort
+`, cortex.URL, failing.URL)))
+	assert.NoError(t, err)
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, "http://localhost", disableAPIAuthentication).
+		WriteToTargets(cfg.NewTargets(TenantName, nil))
+
+	w := httptest.NewRecorder()
+	ddcp.HandlerCommonAfterJSONTranslate(w, genSubmitRequest("{}"), nil)
+	expectInsertSuccessResponse(w, t)
+	assert.ElementsMatch(t, []string{TenantName, "other"}, tenants)
+
+	// The error response of a required target is forwarded.
+	cfg.Targets[1].Policy = remotewrite.PolicyRequired
+	ddcp.WriteToTargets(cfg.NewTargets(TenantName, nil))
+	w = httptest.NewRecorder()
+	ddcp.HandlerCommonAfterJSONTranslate(w, genSubmitRequest("{}"), nil)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, "rejected", getStrippedBody(w.Result()))
+}
+
 // Read all response body bytes, and return response body as string, with
 // leading and trailing whitespace stripped.
 func getStrippedBody(resp *http.Response) string {
@@ -0,0 +1,173 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/opstrace/opstrace/go/pkg/lokipush"
+)
+
+/*
+A JSON document POSTed by the DD agent to /intake/. Not documented by DD. The
+agent sends host metadata (with `meta`), events, or both. Only the fields used
+below are declared.
+*/
+type ddIntakePayload struct {
+	InternalHostname string      `json:"internalHostname"`
+	AgentVersion     string      `json:"agentVersion"`
+	OS               string      `json:"os"`
+	Meta             *ddHostMeta `json:"meta"`
+	// Tags by provider, such as {"system": ["env:prod"]}.
+	HostTags map[string][]string `json:"host-tags"`
+	// Events by source type name.
+	Events map[string][]*ddEvent `json:"events"`
+}
+
+type ddHostMeta struct {
+	SocketFqdn string `json:"socket-fqdn"`
+}
+
+// An event, see https://docs.datadoghq.com/api/latest/events/ (but with the
+// `msg_` prefix used by the agent for title and text).
+type ddEvent struct {
+	Title          string   `json:"msg_title"`
+	Text           string   `json:"msg_text"`
+	Host           string   `json:"host"`
+	Tags           []string `json:"tags"`
+	AlertType      string   `json:"alert_type"`
+	Priority       string   `json:"priority"`
+	SourceTypeName string   `json:"source_type_name"`
+	// Seconds since epoch.
+	Timestamp int64 `json:"timestamp"`
+}
+
+/*
+Translate a JSON document POSTed to /intake/. Example:
+
+{
+  "internalHostname": "x1carb6",
+  "agentVersion": "7.25.1",
+  "os": "linux",
+  "meta": {"socket-fqdn": "x1carb6.example.com"},
+  "host-tags": {"system": ["env:prod"]},
+  "events": {
+    "api": [
+      {
+        "msg_title": "Deployment finished",
+        "msg_text": "payment 5.1 is live",
+        "alert_type": "info",
+        "tags": ["service:payment"],
+        "timestamp": 1610032230
+      }
+    ]
+  }
+}
+
+Host metadata becomes the info-style series `ddagent_host_info` (value 1, at
+`now`), with the labels `instance`, `job`, `agent_version`, `os`, `fqdn`, and
+a `ddtag_`-prefixed label per host tag.
+
+Each event becomes a log entry, with the title and the text on separate
+lines. The stream labels are `instance`, `job`, `source` (the source type
+name), `alert_type`, `priority`, and a `ddtag_`-prefixed label per tag.
+Events without timestamp get `now`.
+*/
+func TranslateDDIntakeJSON(doc []byte, now time.Time) (*lokipush.PushRequest, []prompb.TimeSeries, error) {
+	var payload ddIntakePayload
+	if err := json.Unmarshal(doc, &payload); err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON doc: %v", err)
+	}
+
+	var promTimeSeriesFragments []prompb.TimeSeries
+	if payload.Meta != nil {
+		labels := map[string]string{
+			"__name__":      "ddagent_host_info",
+			"instance":      payload.InternalHostname,
+			"job":           "ddagent",
+			"agent_version": payload.AgentVersion,
+			"os":            payload.OS,
+			"fqdn":          payload.Meta.SocketFqdn,
+		}
+		// Iterate over the providers in a stable order, for tags set by
+		// several of them.
+		providers := make([]string, 0, len(payload.HostTags))
+		for provider := range payload.HostTags {
+			providers = append(providers, provider)
+		}
+		sort.Strings(providers)
+		for _, provider := range providers {
+			addDDTagLabels(labels, payload.HostTags[provider], "host: "+payload.InternalHostname)
+		}
+		for k, v := range labels {
+			if v == "" {
+				delete(labels, k)
+			}
+		}
+		promTimeSeriesFragments = append(promTimeSeriesFragments, prompb.TimeSeries{
+			Labels:  promLabelsFromMap(labels),
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now.UnixNano() / int64(time.Millisecond)}},
+		})
+	}
+
+	sourceTypeNames := make([]string, 0, len(payload.Events))
+	for sourceTypeName := range payload.Events {
+		sourceTypeNames = append(sourceTypeNames, sourceTypeName)
+	}
+	sort.Strings(sourceTypeNames)
+
+	sb := newLogStreamBuilder()
+	for _, sourceTypeName := range sourceTypeNames {
+		for _, event := range payload.Events[sourceTypeName] {
+			if event == nil {
+				continue
+			}
+			host := event.Host
+			if host == "" {
+				host = payload.InternalHostname
+			}
+			source := event.SourceTypeName
+			if source == "" {
+				source = sourceTypeName
+			}
+			lbls := map[string]string{
+				"instance":   host,
+				"job":        "ddagent",
+				"source":     source,
+				"alert_type": event.AlertType,
+				"priority":   event.Priority,
+			}
+			addDDTagLabels(lbls, event.Tags, "event: "+event.Title)
+
+			ts := now
+			if event.Timestamp != 0 {
+				ts = time.Unix(event.Timestamp, 0).UTC()
+			}
+			line := event.Title
+			if event.Text != "" {
+				line = strings.TrimSpace(line + "\n" + event.Text)
+			}
+			sb.add(lbls, ts, line)
+		}
+	}
+
+	return sb.pushRequest(), promTimeSeriesFragments, nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/lokipush"
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
+)
+
+const testIntakePayload = `{
+  "internalHostname": "x1carb6",
+  "agentVersion": "7.25.1",
+  "os": "linux",
+  "meta": {"socket-fqdn": "x1carb6.example.com"},
+  "host-tags": {"system": ["env:prod"]},
+  "events": {
+    "api": [
+      {
+        "msg_title": "Deployment finished",
+        "msg_text": "payment 5.1 is live",
+        "alert_type": "info",
+        "tags": ["service:payment"],
+        "timestamp": 1610032230
+      }
+    ]
+  }
+}`
+
+func TestTranslateDDIntakeJSON(t *testing.T) {
+	now := time.Unix(1610032300, 0).UTC()
+	pr, series, err := TranslateDDIntakeJSON([]byte(testIntakePayload), now)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]prompb.Sample{
+		`{__name__="ddagent_host_info", agent_version="7.25.1", ddtag_env="prod", fqdn="x1carb6.example.com", ` +
+			`instance="x1carb6", job="ddagent", os="linux"}`: {{Value: 1, Timestamp: 1610032300000}},
+	}, seriesByLabels(series))
+	assert.Equal(t, []lokipush.Stream{
+		{
+			Labels: labels.FromStrings("alert_type", "info", "ddtag_service", "payment", "instance", "x1carb6",
+				"job", "ddagent", "source", "api"),
+			Entries: []lokipush.Entry{
+				{Timestamp: time.Unix(1610032230, 0).UTC(), Line: "Deployment finished\npayment 5.1 is live"},
+			},
+		},
+	}, pr.Streams)
+
+	// Events only: no host metadata.
+	pr, series, err = TranslateDDIntakeJSON([]byte(`{"internalHostname": "x1carb6", "events": {}}`), now)
+	assert.NoError(t, err)
+	assert.Empty(t, series)
+	assert.Empty(t, pr.Streams)
+}
+
+func TestHandlerIntakePost(t *testing.T) {
+	var received []prompb.TimeSeries
+	rwsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		wr, err := remotewrite.DecodeWriteRequest(body)
+		assert.NoError(t, err)
+		received = wr.Timeseries
+	}))
+	defer rwsrv.Close()
+
+	var pushed *lokipush.PushRequest
+	lokisrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		pushed, err = lokipush.DecodePushRequest(r.Header.Get("Content-Type"), body)
+		assert.NoError(t, err)
+	}))
+	defer lokisrv.Close()
+
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, rwsrv.URL, disableAPIAuthentication)
+
+	// Without log forwarding, events are dropped.
+	w := httptest.NewRecorder()
+	ddcp.HandlerIntakePost(w, genSubmitRequest(testIntakePayload))
+	expectInsertSuccessResponse(w, t)
+	assert.Len(t, received, 1)
+	assert.Nil(t, pushed)
+
+	received = nil
+	ddcp.ForwardLogs(lokisrv.URL)
+	w = httptest.NewRecorder()
+	ddcp.HandlerIntakePost(w, genSubmitRequest(testIntakePayload))
+	expectInsertSuccessResponse(w, t)
+	assert.Len(t, received, 1)
+	if assert.NotNil(t, pushed) {
+		assert.Len(t, pushed.Streams, 1)
+	}
+
+	// Nothing to write.
+	received = nil
+	w = httptest.NewRecorder()
+	ddcp.HandlerIntakePost(w, genSubmitRequest(`{"internalHostname": "x1carb6"}`))
+	expectInsertSuccessResponse(w, t)
+	assert.Nil(t, received)
+}
+
+func TestHandlerIntakePost_writeFails(t *testing.T) {
+	rwsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer rwsrv.Close()
+	pushes := 0
+	lokisrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+	}))
+	defer lokisrv.Close()
+
+	// The events are not pushed when the host metadata cannot be written, so
+	// that the retry does not push them twice.
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, rwsrv.URL, disableAPIAuthentication).ForwardLogs(lokisrv.URL)
+	w := httptest.NewRecorder()
+	ddcp.HandlerIntakePost(w, genSubmitRequest(testIntakePayload))
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, 0, pushes)
+}
+
+func TestHandlerValidateGet(t *testing.T) {
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, "http://localhost", disableAPIAuthentication)
+	w := httptest.NewRecorder()
+	ddcp.HandlerValidateGet(w, httptest.NewRequest("GET", "http://localhost/api/v1/validate", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"valid":true}`, getStrippedBody(w.Result()))
+
+	disableAPIAuthentication = false
+	ddcp = NewDDCortexProxy(TenantName, "http://localhost", disableAPIAuthentication)
+	w = httptest.NewRecorder()
+	ddcp.HandlerValidateGet(w, httptest.NewRequest("GET", "http://localhost/api/v1/validate", nil))
+	assert.Equal(t, 401, w.Code)
+	assert.True(t, strings.Contains(getStrippedBody(w.Result()), "DD API key missing"))
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/opstrace/opstrace/go/pkg/lokipush"
+)
+
+// A log entry as POSTed to /api/v2/logs. See
+// https://docs.datadoghq.com/api/latest/logs/#send-logs
+type ddLogEntry struct {
+	Message  string `json:"message"`
+	Hostname string `json:"hostname"`
+	Service  string `json:"service"`
+	Source   string `json:"ddsource"`
+	// Comma-separated, such as "env:staging,version:5.1".
+	Tags   string `json:"ddtags"`
+	Status string `json:"status"`
+	// Milliseconds since epoch, set by the DD agent. API clients usually
+	// leave it out.
+	Timestamp int64 `json:"timestamp"`
+}
+
+/*
+Translate a JSON document POSTed to /api/v2/logs (a log entry, or an array of
+log entries) into a Loki push request. Example:
+
+[
+  {
+    "message": "GET /api/health 200",
+    "hostname": "x1carb6",
+    "service": "payment",
+    "ddsource": "nginx",
+    "ddtags": "env:staging,version:5.1",
+    "status": "info",
+    "timestamp": 1610032230000
+  }
+]
+
+The message is the log line. The stream labels are `instance` (the
+hostname, as for metrics), `job` (`ddagent`), `service`, `source`, `status`,
+and a `ddtag_`-prefixed label per tag. Entries without timestamp get `now`.
+*/
+func TranslateDDLogsJSON(doc []byte, now time.Time) (*lokipush.PushRequest, error) {
+	var entries []*ddLogEntry
+	var jerr error
+	if trimmed := bytes.TrimSpace(doc); len(trimmed) > 0 && trimmed[0] == '{' {
+		var entry ddLogEntry
+		jerr = json.Unmarshal(doc, &entry)
+		entries = append(entries, &entry)
+	} else {
+		jerr = json.Unmarshal(doc, &entries)
+	}
+	if jerr != nil {
+		return nil, fmt.Errorf("invalid JSON doc: %v", jerr)
+	}
+
+	sb := newLogStreamBuilder()
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		lbls := map[string]string{
+			"instance": entry.Hostname,
+			"job":      "ddagent",
+			"service":  entry.Service,
+			"source":   entry.Source,
+			"status":   entry.Status,
+		}
+		if entry.Tags != "" {
+			addDDTagLabels(lbls, strings.Split(entry.Tags, ","), "logs of service: "+entry.Service)
+		}
+
+		ts := now
+		if entry.Timestamp != 0 {
+			ts = time.Unix(0, entry.Timestamp*int64(time.Millisecond)).UTC()
+		}
+		sb.add(lbls, ts, entry.Message)
+	}
+	return sb.pushRequest(), nil
+}
+
+// Collects log entries into the streams of a Loki push request.
+type logStreamBuilder struct {
+	pr *lokipush.PushRequest
+	// Index of each stream in `pr.Streams`, by label set.
+	index map[string]int
+}
+
+func newLogStreamBuilder() *logStreamBuilder {
+	return &logStreamBuilder{pr: &lokipush.PushRequest{}, index: make(map[string]int)}
+}
+
+// Add an entry to the stream with the labels `lbls`, leaving out empty label
+// values. Streams are kept in order of appearance.
+func (sb *logStreamBuilder) add(lbls map[string]string, ts time.Time, line string) {
+	for k, v := range lbls {
+		if v == "" {
+			delete(lbls, k)
+		}
+	}
+	streamLabels := labels.FromMap(lbls)
+
+	key := streamLabels.String()
+	i, ok := sb.index[key]
+	if !ok {
+		i = len(sb.pr.Streams)
+		sb.index[key] = i
+		sb.pr.Streams = append(sb.pr.Streams, lokipush.Stream{Labels: streamLabels})
+	}
+	sb.pr.Streams[i].Entries = append(sb.pr.Streams[i].Entries, lokipush.Entry{Timestamp: ts, Line: line})
+}
+
+func (sb *logStreamBuilder) pushRequest() *lokipush.PushRequest {
+	// Loki expects the entries of a stream in time order.
+	for _, s := range sb.pr.Streams {
+		entries := s.Entries
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Timestamp.Before(entries[j].Timestamp)
+		})
+	}
+	return sb.pr
+}
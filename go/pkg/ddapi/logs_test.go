@@ -0,0 +1,138 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/lokipush"
+)
+
+func TestTranslateDDLogsJSON(t *testing.T) {
+	now := time.Unix(1610032300, 0).UTC()
+	pr, err := TranslateDDLogsJSON([]byte(`[
+  {"message": "b", "hostname": "x1carb6", "service": "payment", "ddsource": "nginx",
+   "ddtags": "env:staging,version:5.1", "status": "info", "timestamp": 1610032231000},
+  {"message": "a", "hostname": "x1carb6", "service": "payment", "ddsource": "nginx",
+   "ddtags": "env:staging,version:5.1", "status": "info", "timestamp": 1610032230000},
+  {"message": "no timestamp", "service": "cron"}
+]`), now)
+	assert.NoError(t, err)
+	assert.Equal(t, []lokipush.Stream{
+		{
+			Labels: labels.FromStrings("ddtag_env", "staging", "ddtag_version", "5.1", "instance", "x1carb6",
+				"job", "ddagent", "service", "payment", "source", "nginx", "status", "info"),
+			// In time order.
+			Entries: []lokipush.Entry{
+				{Timestamp: time.Unix(1610032230, 0).UTC(), Line: "a"},
+				{Timestamp: time.Unix(1610032231, 0).UTC(), Line: "b"},
+			},
+		},
+		{
+			Labels:  labels.FromStrings("job", "ddagent", "service", "cron"),
+			Entries: []lokipush.Entry{{Timestamp: now, Line: "no timestamp"}},
+		},
+	}, pr.Streams)
+
+	// A single entry.
+	pr, err = TranslateDDLogsJSON([]byte(`{"message": "hello", "service": "cron"}`), now)
+	assert.NoError(t, err)
+	if assert.Len(t, pr.Streams, 1) {
+		assert.Equal(t, []lokipush.Entry{{Timestamp: now, Line: "hello"}}, pr.Streams[0].Entries)
+	}
+
+	_, err = TranslateDDLogsJSON([]byte(`"hello"`), now)
+	assert.Error(t, err)
+}
+
+func TestHandlerLogsPost(t *testing.T) {
+	var received *lokipush.PushRequest
+	var tenant string
+	lokisrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received, err = lokipush.DecodePushRequest(r.Header.Get("Content-Type"), body)
+		assert.NoError(t, err)
+		tenant = r.Header.Get("X-Scope-OrgID")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer lokisrv.Close()
+
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, "http://127.0.0.1:1/api/v1/push", disableAPIAuthentication)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(`[{"message": "hello", "service": "cron", "timestamp": 1610032230000}]`))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("POST", "http://localhost/api/v2/logs", bytes.NewReader(buf.Bytes()))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		return req
+	}
+
+	// Not enabled.
+	w := httptest.NewRecorder()
+	ddcp.HandlerLogsPost(w, newRequest())
+	assert.Equal(t, 404, w.Code)
+
+	ddcp.ForwardLogs(lokisrv.URL)
+	w = httptest.NewRecorder()
+	ddcp.HandlerLogsPost(w, newRequest())
+	expectInsertSuccessResponse(w, t)
+	assert.Equal(t, TenantName, tenant)
+	if assert.NotNil(t, received) && assert.Len(t, received.Streams, 1) {
+		assert.Equal(t, labels.FromStrings("job", "ddagent", "service", "cron"), received.Streams[0].Labels)
+		assert.Equal(t, []lokipush.Entry{{Timestamp: time.Unix(1610032230, 0).UTC(), Line: "hello"}},
+			received.Streams[0].Entries)
+	}
+}
+
+func TestHandlerLogsPost_canceled(t *testing.T) {
+	unblock := make(chan struct{})
+	lokisrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer lokisrv.Close()
+	defer close(unblock)
+
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, "http://127.0.0.1:1/api/v1/push", disableAPIAuthentication).
+		ForwardLogs(lokisrv.URL)
+
+	// The push to Loki stops when the client gives up.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("POST", "http://localhost/api/v2/logs",
+		strings.NewReader(`[{"message": "hello", "service": "cron"}]`)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ddcp.HandlerLogsPost(w, req)
+	assert.Equal(t, 500, w.Code)
+	assert.Contains(t, w.Body.String(), "context deadline exceeded")
+}
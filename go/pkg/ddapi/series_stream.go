@@ -0,0 +1,175 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"fmt"
+	"io"
+
+	json "github.com/json-iterator/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Size of the read buffer of the streaming JSON decoder.
+const streamReadBufferSize = 32 << 10
+
+// Number of samples per batch written by HandlerSeriesPost().
+const seriesBatchSamples = 5000
+
+/*
+Translate a JSON document POSTed to /api/v1/series (see TranslateDDSeriesJSON)
+as it is read from `r`, instead of holding the document, the decoded
+fragments and the translated series in memory at once. Fragments are decoded
+one at a time, and the translated series are passed to `emit` in batches of
+at least `maxSamplesPerBatch` samples (but for the last one). Fragments are
+not split: a batch may exceed `maxSamplesPerBatch` by the samples of its last
+series.
+
+The batch slice is reused once `emit` returns, the series in it are not. An
+error returned by `emit` stops the translation, and is returned. Note that on
+error, the batches emitted so far have already been passed on.
+*/
+func TranslateDDSeriesJSONStream(
+	r io.Reader,
+	maxSamplesPerBatch int,
+	emit func([]prompb.TimeSeries) error,
+) error {
+	iter := json.Parse(json.ConfigDefault, r, streamReadBufferSize)
+
+	var (
+		fragment ddSeriesFragment
+		batch    []prompb.TimeSeries
+		samples  int
+		emitErr  error
+	)
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		emitErr = emit(batch)
+		batch = batch[:0]
+		samples = 0
+		return emitErr == nil
+	}
+
+	iter.ReadObjectCB(func(iter *json.Iterator, field string) bool {
+		if field != "series" {
+			iter.Skip()
+			return true
+		}
+		iter.ReadArrayCB(func(iter *json.Iterator) bool {
+			// Reuse the buffers of the previous fragment: its points have
+			// been copied into samples, its tags into labels.
+			fragment = ddSeriesFragment{Points: fragment.Points[:0], Tags: fragment.Tags[:0]}
+			readDDSeriesFragment(iter, &fragment)
+			if iter.Error != nil {
+				return false
+			}
+			pts, ok := translateDDSeriesFragment(&fragment)
+			if !ok {
+				return true
+			}
+			batch = append(batch, pts)
+			samples += len(pts.Samples)
+			if samples >= maxSamplesPerBatch {
+				return flush()
+			}
+			return true
+		})
+		return iter.Error == nil && emitErr == nil
+	})
+
+	if emitErr != nil {
+		return emitErr
+	}
+	if iter.Error == nil {
+		// Only whitespace may follow the document.
+		iter.WhatIsNext()
+		if iter.Error == io.EOF {
+			iter.Error = nil
+		} else if iter.Error == nil {
+			iter.ReportError("TranslateDDSeriesJSONStream", "unexpected data after top-level value")
+		}
+	}
+	if iter.Error != nil {
+		return fmt.Errorf("invalid JSON doc: %w", iter.Error)
+	}
+	flush()
+	return emitErr
+}
+
+/*
+Decode a fragment of the `series` array into `f`, like json.Unmarshal() with
+ddPoint.UnmarshalJSON() does, but without allocating per point. Unknown
+fields are skipped. Errors are reported in `iter.Error`.
+*/
+func readDDSeriesFragment(iter *json.Iterator, f *ddSeriesFragment) {
+	iter.ReadObjectCB(func(iter *json.Iterator, field string) bool {
+		switch field {
+		case "metric":
+			f.Name = iter.ReadString()
+		case "host":
+			f.Host = iter.ReadString()
+		case "device":
+			f.Device = iter.ReadString()
+		case "type":
+			f.Type = iter.ReadString()
+		case "source_type_name":
+			f.SourceTypeName = iter.ReadString()
+		case "interval":
+			f.Interval = iter.ReadInt64()
+		case "tags":
+			iter.ReadArrayCB(func(iter *json.Iterator) bool {
+				f.Tags = append(f.Tags, iter.ReadString())
+				return true
+			})
+		case "points":
+			iter.ReadArrayCB(func(iter *json.Iterator) bool {
+				f.Points = append(f.Points, readDDPoint(iter))
+				return iter.Error == nil
+			})
+		default:
+			iter.Skip()
+		}
+		return iter.Error == nil
+	})
+}
+
+// Decode a [timestamp, value] 2-tuple.
+func readDDPoint(iter *json.Iterator) ddPoint {
+	var p ddPoint
+	n := 0
+	iter.ReadArrayCB(func(iter *json.Iterator) bool {
+		switch n {
+		case 0:
+			p.Timestamp = iter.ReadInt64()
+		case 1:
+			if iter.WhatIsNext() == json.NilValue {
+				iter.Skip()
+			} else {
+				p.Value = iter.ReadFloat64()
+			}
+		default:
+			iter.Skip()
+		}
+		n++
+		return iter.Error == nil
+	})
+	if iter.Error == nil && n != 2 {
+		iter.ReportError("readDDPoint",
+			fmt.Sprintf("unexpected length of `points` array: %d (expected 2)", n))
+	}
+	return p
+}
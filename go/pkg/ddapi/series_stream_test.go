@@ -0,0 +1,254 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
+)
+
+// Build a /api/v1/series document with `numSeries` fragments of `numPoints`
+// points (in descending time order, as some agents send them).
+func makeTestSeriesDoc(numSeries int, numPoints int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"series": [`)
+	for i := 0; i < numSeries; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"metric": "n_o_i_n_d_e_x.system.disk.used_%d", "points": [`, i%100)
+		for j := numPoints - 1; j >= 0; j-- {
+			fmt.Fprintf(&b, "[%d, %d.5]", 1610032230+10*j, i+j)
+			if j > 0 {
+				b.WriteString(",")
+			}
+		}
+		fmt.Fprintf(&b, `], "tags": ["env:prod", "version:7.24.1", "disk:%d"], "host": "host-%d",`, i, i%10)
+		fmt.Fprintf(&b, `"device": "sd%d", "type": "rate", "interval": 10, "source_type_name": "System", "extra": [{}]}`, i%3)
+	}
+	b.WriteString(`], "api_key": "ignored"}`)
+	return b.Bytes()
+}
+
+func collectDDSeriesJSONStream(t *testing.T, doc string, maxSamplesPerBatch int) ([]prompb.TimeSeries, []int, error) {
+	var series []prompb.TimeSeries
+	var batchSizes []int
+	err := TranslateDDSeriesJSONStream(strings.NewReader(doc), maxSamplesPerBatch, func(batch []prompb.TimeSeries) error {
+		samples := 0
+		for _, ts := range batch {
+			samples += len(ts.Samples)
+		}
+		batchSizes = append(batchSizes, samples)
+		series = append(series, batch...)
+		return nil
+	})
+	return series, batchSizes, err
+}
+
+func TestTranslateDDSeriesJSONStream(t *testing.T) {
+	doc := string(makeTestSeriesDoc(50, 3))
+	expected, err := TranslateDDSeriesJSON([]byte(doc))
+	assert.NoError(t, err)
+
+	series, batchSizes, err := collectDDSeriesJSONStream(t, doc, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, seriesByLabels(expected), seriesByLabels(series))
+	// Whole fragments of 3 points: 12 samples per batch, 6 in the last one.
+	assert.Len(t, batchSizes, 13)
+	for _, size := range batchSizes[:12] {
+		assert.Equal(t, 12, size)
+	}
+	assert.Equal(t, 6, batchSizes[12])
+
+	// Fragments without points are dropped, fields are reset between
+	// fragments.
+	series, batchSizes, err = collectDDSeriesJSONStream(t, `{"series": [
+		{"metric": "a", "points": [[1610032230, 1]], "host": "h", "tags": ["env:prod"]},
+		{"metric": "b", "points": []},
+		{"metric": "c", "points": [[1610032230, null]]}
+	]}`, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, batchSizes)
+	assert.Equal(t, map[string][]prompb.Sample{
+		`{__name__="a", ddtag_env="prod", instance="h", job="ddagent"}`: {{Value: 1, Timestamp: 1610032230000}},
+		`{__name__="c", job="ddagent"}`:                                 {{Value: 0, Timestamp: 1610032230000}},
+	}, seriesByLabels(series))
+
+	for _, doc := range []string{`{}`, `{"series": []}`, `{"series": null}`, "{}\n"} {
+		_, batchSizes, err = collectDDSeriesJSONStream(t, doc, 100)
+		assert.NoError(t, err, doc)
+		assert.Empty(t, batchSizes, doc)
+	}
+}
+
+func TestTranslateDDSeriesJSONStream_errors(t *testing.T) {
+	for _, doc := range []string{
+		``,
+		`{"series": [`,
+		`{"series": [{"metric": "a", "points": [[1610032230, 1, 2]]}]}`,
+		`{"series": [{"metric": "a", "points": [[1610032230]]}]}`,
+		`{"series": [{"metric": "a", "points": [["1610032230", 1]]}]}`,
+		`{"series": [{"metric": 1}]}`,
+		`{"series": []} {}`,
+		`{"series": []}}`,
+	} {
+		_, _, err := collectDDSeriesJSONStream(t, doc, 100)
+		assert.Error(t, err, doc)
+		_, err = TranslateDDSeriesJSON([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+
+	// Errors of `emit` stop the translation.
+	emitErr := errors.New("remote_write failed")
+	calls := 0
+	err := TranslateDDSeriesJSONStream(bytes.NewReader(makeTestSeriesDoc(10, 1)), 1, func([]prompb.TimeSeries) error {
+		calls++
+		return emitErr
+	})
+	assert.Equal(t, emitErr, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestHandlerSeriesPost_stream(t *testing.T) {
+	// A remote_write endpoint recording the number of series per request.
+	var requests []int
+	rwsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		wr, err := remotewrite.DecodeWriteRequest(body)
+		assert.NoError(t, err)
+		requests = append(requests, len(wr.Timeseries))
+	}))
+	defer rwsrv.Close()
+
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, rwsrv.URL, disableAPIAuthentication)
+	ddcp.seriesBatchSamples = 10
+	post := func(encoding string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/series", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		ddcp.HandlerSeriesPost(w, req)
+		return w
+	}
+
+	// Batches of 4 fragments of 3 points.
+	doc := makeTestSeriesDoc(50, 3)
+	expectInsertSuccessResponse(post("gzip", gzipEncode(t, doc)), t)
+	assert.Equal(t, []int{4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 2}, requests)
+
+	// The full batches before an error are written.
+	requests = nil
+	w := post("", append(doc[:len(doc)-1], []byte(`, "series": [{]}`)...))
+	assert.Equal(t, 400, w.Code)
+	assert.Len(t, requests, 12)
+
+	requests = nil
+	ddcp.MaxDecompressedSize(int64(len(doc) - 1))
+	w = post("gzip", gzipEncode(t, doc))
+	assert.Equal(t, 413, w.Code)
+	w = post("", doc)
+	assert.Equal(t, 413, w.Code)
+	w = post("br", doc)
+	assert.Equal(t, 415, w.Code)
+}
+
+const benchSeriesMaxSamplesPerBatch = 500
+
+/*
+Compare the batch and streaming translators on a document of 10000 series.
+Besides allocations, report the live heap at the end of the translation
+(batch), or at its peak when emitting a batch (streaming), as `live-B`. Run
+with:
+
+	go test ./pkg/ddapi -run '^$' -bench TranslateDDSeriesJSON
+*/
+func BenchmarkTranslateDDSeriesJSON(b *testing.B) {
+	doc := makeTestSeriesDoc(10000, 5)
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// The batch translator needs the whole document in memory: copy it,
+		// as when reading the request body.
+		series, err := TranslateDDSeriesJSON(append([]byte(nil), doc...))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(series) != 10000 {
+			b.Fatalf("unexpected number of series: %d", len(series))
+		}
+	}
+	b.StopTimer()
+
+	base := liveHeap()
+	series, _ := TranslateDDSeriesJSON(append([]byte(nil), doc...))
+	b.ReportMetric(float64(liveHeap()-base), "live-B")
+	runtime.KeepAlive(series)
+}
+
+func BenchmarkTranslateDDSeriesJSONStream(b *testing.B) {
+	doc := makeTestSeriesDoc(10000, 5)
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		err := TranslateDDSeriesJSONStream(bytes.NewReader(doc), benchSeriesMaxSamplesPerBatch,
+			func(batch []prompb.TimeSeries) error {
+				n += len(batch)
+				return nil
+			})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n != 10000 {
+			b.Fatalf("unexpected number of series: %d", n)
+		}
+	}
+	b.StopTimer()
+
+	base := liveHeap()
+	peak := uint64(0)
+	_ = TranslateDDSeriesJSONStream(bytes.NewReader(doc), benchSeriesMaxSamplesPerBatch,
+		func(batch []prompb.TimeSeries) error {
+			if live := liveHeap(); live > peak {
+				peak = live
+			}
+			return nil
+		})
+	b.ReportMetric(float64(peak-base), "live-B")
+}
+
+// Return the size of the live heap objects.
+func liveHeap() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+	json "github.com/json-iterator/go"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+The `MetricPayload` message POSTed to /api/v2/series, as protobuf by the DD
+agent (see agent_payload.proto in https://github.com/DataDog/agent-payload),
+or as JSON by API clients (see
+https://docs.datadoghq.com/api/latest/metrics/#submit-metrics). Both
+encodings use the same field names. Only the fields used below are declared,
+the others are skipped when decoding. In particular, the `metadata` of a series
+(field 9, the origin of the series as numeric product codes) is dropped.
+*/
+type ddMetricPayload struct {
+	Series []*ddMetricSeries `protobuf:"bytes,1,rep,name=series,proto3" json:"series"`
+}
+
+func (m *ddMetricPayload) Reset()         { *m = ddMetricPayload{} }
+func (m *ddMetricPayload) String() string { return proto.CompactTextString(m) }
+func (*ddMetricPayload) ProtoMessage()    {}
+
+type ddMetricSeries struct {
+	Resources      []*ddResource    `protobuf:"bytes,1,rep,name=resources,proto3" json:"resources"`
+	Metric         string           `protobuf:"bytes,2,opt,name=metric,proto3" json:"metric"`
+	Tags           []string         `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags"`
+	Points         []*ddMetricPoint `protobuf:"bytes,4,rep,name=points,proto3" json:"points"`
+	Type           int32            `protobuf:"varint,5,opt,name=type,proto3" json:"type"`
+	SourceTypeName string           `protobuf:"bytes,7,opt,name=source_type_name,proto3" json:"source_type_name"`
+	Interval       int64            `protobuf:"varint,8,opt,name=interval,proto3" json:"interval"`
+}
+
+func (m *ddMetricSeries) Reset()         { *m = ddMetricSeries{} }
+func (m *ddMetricSeries) String() string { return proto.CompactTextString(m) }
+func (*ddMetricSeries) ProtoMessage()    {}
+
+// A resource the series is about, such as {type: host, name: x1carb6}.
+type ddResource struct {
+	Type string `protobuf:"bytes,1,opt,name=type,proto3" json:"type"`
+	Name string `protobuf:"bytes,2,opt,name=name,proto3" json:"name"`
+}
+
+func (m *ddResource) Reset()         { *m = ddResource{} }
+func (m *ddResource) String() string { return proto.CompactTextString(m) }
+func (*ddResource) ProtoMessage()    {}
+
+type ddMetricPoint struct {
+	Value float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value"`
+	// Seconds since epoch.
+	Timestamp int64 `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp"`
+}
+
+func (m *ddMetricPoint) Reset()         { *m = ddMetricPoint{} }
+func (m *ddMetricPoint) String() string { return proto.CompactTextString(m) }
+func (*ddMetricPoint) ProtoMessage()    {}
+
+// The values of the `MetricType` enum, as used in the v1 API. The v1 API has
+// no equivalent of UNSPECIFIED (0).
+var ddMetricTypeNames = map[int32]string{
+	1: "count",
+	2: "rate",
+	3: "gauge",
+}
+
+/*
+Translate a JSON document POSTed to /api/v2/series. Example:
+
+{
+  "series": [
+    {
+      "metric": "system.load.1",
+      "type": 3,
+      "points": [{"timestamp": 1610032230, "value": 0.7}],
+      "resources": [{"type": "host", "name": "x1carb6"}],
+      "tags": ["env:prod"]
+    }
+  ]
+}
+*/
+func TranslateDDSeriesV2JSON(doc []byte) ([]prompb.TimeSeries, error) {
+	var payload ddMetricPayload
+	if err := json.Unmarshal(doc, &payload); err != nil {
+		return nil, fmt.Errorf("invalid JSON doc: %v", err)
+	}
+	return translateDDSeriesFragments(payload.toV1()), nil
+}
+
+// Translate a protobuf `MetricPayload` message POSTed to /api/v2/series.
+func TranslateDDSeriesV2Protobuf(doc []byte) ([]prompb.TimeSeries, error) {
+	var payload ddMetricPayload
+	if err := proto.Unmarshal(doc, &payload); err != nil {
+		return nil, fmt.Errorf("invalid protobuf message: %v", err)
+	}
+	return translateDDSeriesFragments(payload.toV1()), nil
+}
+
+/*
+Convert the series to v1 series fragments, so that they are translated the
+same way: the `host` and `device` resources become the `instance` and
+`device` labels, as the corresponding v1 properties do. Resources of other
+types have no v1 equivalent and are dropped.
+*/
+func (p *ddMetricPayload) toV1() []*ddSeriesFragment {
+	fragments := make([]*ddSeriesFragment, 0, len(p.Series))
+	for _, s := range p.Series {
+		if s == nil {
+			continue
+		}
+		fragment := &ddSeriesFragment{
+			Name:           s.Metric,
+			Points:         make([]ddPoint, 0, len(s.Points)),
+			Tags:           s.Tags,
+			Type:           ddMetricTypeNames[s.Type],
+			Interval:       s.Interval,
+			SourceTypeName: s.SourceTypeName,
+		}
+		for _, r := range s.Resources {
+			if r == nil {
+				continue
+			}
+			switch r.Type {
+			case "host":
+				fragment.Host = r.Name
+			case "device":
+				fragment.Device = r.Name
+			default:
+				log.Debugf("ignoring resource %s:%s of metric %s", r.Type, r.Name, s.Metric)
+			}
+		}
+		for _, point := range s.Points {
+			if point != nil {
+				fragment.Points = append(fragment.Points, ddPoint{Timestamp: point.Timestamp, Value: point.Value})
+			}
+		}
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateDDSeriesV2(t *testing.T) {
+	v1, err := TranslateDDSeriesJSON([]byte(`{"series": [{
+		"metric": "system.net.bytes_rcvd",
+		"points": [[1610032230, 1.5], [1610032220, 0.5]],
+		"tags": ["env:prod"],
+		"host": "x1carb6",
+		"device": "eth0",
+		"type": "rate",
+		"interval": 10
+	}]}`))
+	assert.NoError(t, err)
+	expected := seriesByLabels(v1)
+
+	v2JSON, err := TranslateDDSeriesV2JSON([]byte(`{"series": [{
+		"metric": "system.net.bytes_rcvd",
+		"points": [{"timestamp": 1610032230, "value": 1.5}, {"timestamp": 1610032220, "value": 0.5}],
+		"tags": ["env:prod"],
+		"resources": [{"type": "host", "name": "x1carb6"}, {"type": "device", "name": "eth0"}],
+		"type": 2,
+		"interval": 10
+	}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, seriesByLabels(v2JSON))
+
+	// The metadata is dropped.
+	v2JSON, err = TranslateDDSeriesV2JSON([]byte(`{"series": [{
+		"metric": "system.net.bytes_rcvd",
+		"points": [{"timestamp": 1610032230, "value": 1.5}, {"timestamp": 1610032220, "value": 0.5}],
+		"tags": ["env:prod"],
+		"resources": [{"type": "host", "name": "x1carb6"}, {"type": "device", "name": "eth0"}],
+		"type": 2,
+		"interval": 10,
+		"metadata": {"origin": {"origin_product": 10, "origin_service": 3}}
+	}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, seriesByLabels(v2JSON))
+
+	pb, err := proto.Marshal(&ddMetricPayload{Series: []*ddMetricSeries{{
+		Metric:    "system.net.bytes_rcvd",
+		Points:    []*ddMetricPoint{{Timestamp: 1610032230, Value: 1.5}, {Timestamp: 1610032220, Value: 0.5}},
+		Tags:      []string{"env:prod"},
+		Resources: []*ddResource{{Type: "host", Name: "x1carb6"}, {Type: "device", Name: "eth0"}},
+		Type:      2,
+		Interval:  10,
+	}}})
+	assert.NoError(t, err)
+	v2Protobuf, err := TranslateDDSeriesV2Protobuf(pb)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, seriesByLabels(v2Protobuf))
+
+	// Unspecified type: no type label.
+	gauge, err := TranslateDDSeriesV2JSON(
+		[]byte(`{"series": [{"metric": "m", "points": [{"timestamp": 1, "value": 1}]}]}`))
+	assert.NoError(t, err)
+	assert.Contains(t, seriesByLabels(gauge), `{__name__="m", job="ddagent"}`)
+
+	_, err = TranslateDDSeriesV2JSON([]byte(`{"series": [{"metric": "m", "points": [[1, 1]]}]}`))
+	assert.Error(t, err)
+	_, err = TranslateDDSeriesV2Protobuf([]byte("not protobuf"))
+	assert.Error(t, err)
+}
+
+func TestHandlerSeriesV2Post_BadCTH(t *testing.T) {
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, "http://localhost", disableAPIAuthentication)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v2/series", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	ddcp.HandlerSeriesV2Post(w, req)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t,
+		"bad request: unexpected content-type header (expecting: application/json or application/x-protobuf)",
+		getStrippedBody(w.Result()))
+}
@@ -0,0 +1,266 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+/*
+The protobuf `SketchPayload` message POSTed by the DD agent to
+/api/beta/sketches, for distribution metrics. See agent_payload.proto in
+https://github.com/DataDog/agent-payload. Only the fields used below are
+declared, the others are skipped when decoding.
+*/
+type ddSketchPayload struct {
+	Sketches []*ddSketch `protobuf:"bytes,1,rep,name=sketches,proto3"`
+}
+
+func (m *ddSketchPayload) Reset()         { *m = ddSketchPayload{} }
+func (m *ddSketchPayload) String() string { return proto.CompactTextString(m) }
+func (*ddSketchPayload) ProtoMessage()    {}
+
+type ddSketch struct {
+	Metric string `protobuf:"bytes,1,opt,name=metric,proto3"`
+	Host   string `protobuf:"bytes,2,opt,name=host,proto3"`
+	// Sent by old agents: summaries (and GK sketches, not used here).
+	Distributions []*ddSketchDistribution `protobuf:"bytes,3,rep,name=distributions,proto3"`
+	Tags          []string                `protobuf:"bytes,4,rep,name=tags,proto3"`
+	Dogsketches   []*ddDogsketch          `protobuf:"bytes,7,rep,name=dogsketches,proto3"`
+}
+
+func (m *ddSketch) Reset()         { *m = ddSketch{} }
+func (m *ddSketch) String() string { return proto.CompactTextString(m) }
+func (*ddSketch) ProtoMessage()    {}
+
+type ddSketchDistribution struct {
+	Ts  int64   `protobuf:"varint,1,opt,name=ts,proto3"`
+	Cnt int64   `protobuf:"varint,2,opt,name=cnt,proto3"`
+	Min float64 `protobuf:"fixed64,3,opt,name=min,proto3"`
+	Max float64 `protobuf:"fixed64,4,opt,name=max,proto3"`
+	Sum float64 `protobuf:"fixed64,6,opt,name=sum,proto3"`
+}
+
+func (m *ddSketchDistribution) Reset()         { *m = ddSketchDistribution{} }
+func (m *ddSketchDistribution) String() string { return proto.CompactTextString(m) }
+func (*ddSketchDistribution) ProtoMessage()    {}
+
+/*
+A DDSketch of the values of a distribution metric over a flush interval:
+the number of values `N[i]` per bin with key `K[i]`, as well as summary
+statistics. Bins are sorted by key.
+*/
+type ddDogsketch struct {
+	Ts  int64    `protobuf:"varint,1,opt,name=ts,proto3"`
+	Cnt int64    `protobuf:"varint,2,opt,name=cnt,proto3"`
+	Min float64  `protobuf:"fixed64,3,opt,name=min,proto3"`
+	Max float64  `protobuf:"fixed64,4,opt,name=max,proto3"`
+	Sum float64  `protobuf:"fixed64,6,opt,name=sum,proto3"`
+	K   []int32  `protobuf:"zigzag32,7,rep,packed,name=k,proto3"`
+	N   []uint32 `protobuf:"varint,8,rep,packed,name=n,proto3"`
+}
+
+func (m *ddDogsketch) Reset()         { *m = ddDogsketch{} }
+func (m *ddDogsketch) String() string { return proto.CompactTextString(m) }
+func (*ddDogsketch) ProtoMessage()    {}
+
+/*
+Parameters of the DDSketch key mapping used by the DD agent (see
+pkg/quantile/config.go in https://github.com/DataDog/datadog-agent): a
+relative accuracy of 1/128, and values smaller than 1e-9 mapped to key 0.
+Key k > 0 is the bin [gamma^(k-bias), gamma^(k-bias+1)), negative keys
+mirror positive ones.
+*/
+var (
+	ddSketchGammaLn = math.Log1p(2.0 / 128.0)
+	ddSketchBias    = 1 - int(math.Floor(math.Log(1e-9)/ddSketchGammaLn))
+)
+
+// Keys for the infinite values.
+const ddSketchInfKey = 0x7fff
+
+// The quantiles written for each distribution metric.
+var ddSketchQuantiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99}
+
+// Return the lower bound (in magnitude) of the values in the bin `k`.
+func ddSketchBinLow(k int32) float64 {
+	switch {
+	case k < 0:
+		return -ddSketchBinLow(-k)
+	case k == 0:
+		return 0
+	case k >= ddSketchInfKey:
+		return math.Inf(1)
+	}
+	return math.Exp(float64(int(k)-ddSketchBias) * ddSketchGammaLn)
+}
+
+/*
+Estimate the quantile `q` of the values in `s`, interpolating within the bin
+of the quantile like the DD agent does. The estimate is within the relative
+accuracy of the sketch.
+*/
+func (s *ddDogsketch) quantile(q float64) float64 {
+	if s.Cnt == 0 || len(s.K) == 0 || len(s.K) != len(s.N) {
+		return math.NaN()
+	}
+	rank := math.RoundToEven(q * float64(s.Cnt-1))
+
+	n := 0.0
+	for i, k := range s.K {
+		n += float64(s.N[i])
+		if n <= rank {
+			continue
+		}
+		weight := (n - rank) / float64(s.N[i])
+		low := ddSketchBinLow(k)
+		high := low * math.Exp(ddSketchGammaLn)
+		if k < 0 {
+			low, high = high, low
+		}
+		v := low*weight + high*(1-weight)
+		return math.Max(s.Min, math.Min(s.Max, v))
+	}
+	return s.Max
+}
+
+// Return the number of values in `s` less than or equal to `le` (within the
+// relative accuracy of the sketch).
+func (s *ddDogsketch) countLE(le float64) float64 {
+	count := 0.0
+	for i, k := range s.K {
+		if i < len(s.N) && ddSketchBinLow(k) <= le {
+			count += float64(s.N[i])
+		}
+	}
+	return count
+}
+
+/*
+Translate the protobuf `SketchPayload` `doc` into Prometheus series. For
+each distribution metric `<name>`, write the gauges `<name>_count`,
+`<name>_sum`, `<name>_min` and `<name>_max`, and the quantile gauges
+`<name>{quantile="0.5"}` (also 0.75, 0.9, 0.95 and 0.99), all over the flush
+interval of the agent. If `buckets` is set, also write the histogram-style
+gauges `<name>_bucket{le="..."}`: the number of values (in the interval) less
+than or equal to each bucket boundary, and to +Inf.
+
+Payloads of old agents without DDSketches only yield the count, sum, min and
+max.
+*/
+func TranslateDDSketchesProtobuf(doc []byte, buckets []float64) ([]prompb.TimeSeries, error) {
+	var payload ddSketchPayload
+	if err := proto.Unmarshal(doc, &payload); err != nil {
+		return nil, fmt.Errorf("invalid protobuf message: %v", err)
+	}
+
+	var promTimeSeriesFragments []prompb.TimeSeries
+	for _, sketch := range payload.Sketches {
+		name := sanitizeMetricName(strings.TrimPrefix(sketch.Metric, "n_o_i_n_d_e_x."))
+		labels := map[string]string{
+			"instance": sketch.Host,
+			"job":      "ddagent",
+			"type":     "distribution",
+		}
+		addDDTagLabels(labels, sketch.Tags, "metric: "+sketch.Metric)
+
+		sb := newSketchSeriesBuilder(name, labels)
+		sort.Slice(sketch.Distributions, func(i, j int) bool {
+			return sketch.Distributions[i].Ts < sketch.Distributions[j].Ts
+		})
+		for _, d := range sketch.Distributions {
+			sb.addSummary(d.Ts, float64(d.Cnt), d.Sum, d.Min, d.Max)
+		}
+
+		sort.Slice(sketch.Dogsketches, func(i, j int) bool {
+			return sketch.Dogsketches[i].Ts < sketch.Dogsketches[j].Ts
+		})
+		for _, ds := range sketch.Dogsketches {
+			if len(ds.K) != len(ds.N) {
+				return nil, fmt.Errorf("bad sketch for metric %s: %d keys, %d counts", sketch.Metric, len(ds.K), len(ds.N))
+			}
+			sb.addSummary(ds.Ts, float64(ds.Cnt), ds.Sum, ds.Min, ds.Max)
+			if ds.Cnt == 0 {
+				continue
+			}
+			for _, q := range ddSketchQuantiles {
+				sb.add(ds.Ts, "", "quantile", formatFloat(q), ds.quantile(q))
+			}
+			for _, le := range buckets {
+				sb.add(ds.Ts, "_bucket", "le", formatFloat(le), ds.countLE(le))
+			}
+			if len(buckets) > 0 {
+				sb.add(ds.Ts, "_bucket", "le", "+Inf", float64(ds.Cnt))
+			}
+		}
+
+		promTimeSeriesFragments = append(promTimeSeriesFragments, sb.series...)
+	}
+	return promTimeSeriesFragments, nil
+}
+
+// Collects the samples of the series derived from a distribution metric.
+type sketchSeriesBuilder struct {
+	name   string
+	labels map[string]string
+	// Index of each series in `series`, by name suffix and extra label.
+	index  map[string]int
+	series []prompb.TimeSeries
+}
+
+func newSketchSeriesBuilder(name string, labels map[string]string) *sketchSeriesBuilder {
+	return &sketchSeriesBuilder{name: name, labels: labels, index: make(map[string]int)}
+}
+
+func (sb *sketchSeriesBuilder) addSummary(ts int64, count float64, sum float64, min float64, max float64) {
+	sb.add(ts, "_count", "", "", count)
+	sb.add(ts, "_sum", "", "", sum)
+	if count > 0 {
+		sb.add(ts, "_min", "", "", min)
+		sb.add(ts, "_max", "", "", max)
+	}
+}
+
+// Add a sample at `ts` (in seconds) to the series `<name><suffix>`, with
+// the extra label `labelName`, if set.
+func (sb *sketchSeriesBuilder) add(ts int64, suffix string, labelName string, labelValue string, value float64) {
+	key := suffix + "/" + labelName + "/" + labelValue
+	i, ok := sb.index[key]
+	if !ok {
+		labels := make(map[string]string, len(sb.labels)+2)
+		for k, v := range sb.labels {
+			labels[k] = v
+		}
+		labels["__name__"] = sb.name + suffix
+		if labelName != "" {
+			labels[labelName] = labelValue
+		}
+		i = len(sb.series)
+		sb.index[key] = i
+		sb.series = append(sb.series, prompb.TimeSeries{Labels: promLabelsFromMap(labels)})
+	}
+	sb.series[i].Samples = append(sb.series[i].Samples, prompb.Sample{Value: value, Timestamp: ts * 1000})
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
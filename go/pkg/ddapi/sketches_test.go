@@ -0,0 +1,182 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
+)
+
+// Create a sketch of `values` (positive), like the DD agent does.
+func newTestDogsketch(ts int64, values ...float64) *ddDogsketch {
+	ds := &ddDogsketch{Ts: ts, Min: math.Inf(1), Max: math.Inf(-1)}
+	counts := make(map[int32]uint32)
+	for _, v := range values {
+		counts[int32(math.Floor(math.Log(v)/ddSketchGammaLn))+int32(ddSketchBias)]++
+		ds.Cnt++
+		ds.Sum += v
+		ds.Min = math.Min(ds.Min, v)
+		ds.Max = math.Max(ds.Max, v)
+	}
+	for k := range counts {
+		ds.K = append(ds.K, k)
+	}
+	sort.Slice(ds.K, func(i, j int) bool { return ds.K[i] < ds.K[j] })
+	for _, k := range ds.K {
+		ds.N = append(ds.N, counts[k])
+	}
+	return ds
+}
+
+// Index series by their labels, formatted as in PromQL.
+func seriesByLabels(series []prompb.TimeSeries) map[string][]prompb.Sample {
+	m := make(map[string][]prompb.Sample)
+	for _, ts := range series {
+		sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+		var b bytes.Buffer
+		b.WriteString("{")
+		for i, l := range ts.Labels {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(l.Name + "=\"" + l.Value + "\"")
+		}
+		b.WriteString("}")
+		m[b.String()] = ts.Samples
+	}
+	return m
+}
+
+func encodeTestSketchPayload(t *testing.T) []byte {
+	values := make([]float64, 0, 100)
+	for i := 1; i <= 100; i++ {
+		values = append(values, float64(i))
+	}
+	payload := &ddSketchPayload{Sketches: []*ddSketch{{
+		Metric: "request.latency",
+		Host:   "host1",
+		Tags:   []string{"env:prod"},
+		Dogsketches: []*ddDogsketch{
+			newTestDogsketch(1610032240, values...),
+			newTestDogsketch(1610032230, 5),
+		},
+	}}}
+	data, err := proto.Marshal(payload)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestTranslateDDSketchesProtobuf(t *testing.T) {
+	series, err := TranslateDDSketchesProtobuf(encodeTestSketchPayload(t), []float64{10, 50})
+	assert.NoError(t, err)
+	byLabels := seriesByLabels(series)
+	assert.Len(t, byLabels, 12)
+
+	const common = `ddtag_env="prod", instance="host1", job="ddagent"`
+	get := func(name string, extra string) []prompb.Sample {
+		key := `{__name__="` + name + `", ` + common + extra + `, type="distribution"}`
+		samples, ok := byLabels[key]
+		assert.True(t, ok, key)
+		return samples
+	}
+
+	// Samples in time order.
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: 1610032230000}, {Value: 100, Timestamp: 1610032240000}},
+		get("request_latency_count", ""))
+	assert.Equal(t, []prompb.Sample{{Value: 5, Timestamp: 1610032230000}, {Value: 5050, Timestamp: 1610032240000}},
+		get("request_latency_sum", ""))
+	assert.Equal(t, 1.0, get("request_latency_min", "")[1].Value)
+	assert.Equal(t, 100.0, get("request_latency_max", "")[1].Value)
+
+	// Quantiles and buckets are estimates, within the accuracy of the sketch.
+	for _, tc := range []struct {
+		name     string
+		label    string
+		expected float64
+	}{
+		{"request_latency", `, quantile="0.5"`, 50},
+		{"request_latency", `, quantile="0.99"`, 99},
+		{"request_latency_bucket", `, le="10"`, 10},
+		{"request_latency_bucket", `, le="50"`, 50},
+		{"request_latency_bucket", `, le="+Inf"`, 100},
+	} {
+		samples := get(tc.name, tc.label)
+		if assert.Len(t, samples, 2, tc.label) {
+			assert.InEpsilon(t, tc.expected, samples[1].Value, 0.02, tc.label)
+		}
+	}
+	assert.InEpsilon(t, 5, get("request_latency", `, quantile="0.5"`)[0].Value, 0.02)
+
+	_, err = TranslateDDSketchesProtobuf([]byte("not protobuf"), nil)
+	assert.Error(t, err)
+}
+
+func TestDDSketchBinLow(t *testing.T) {
+	assert.Equal(t, 0.0, ddSketchBinLow(0))
+	assert.True(t, math.IsInf(ddSketchBinLow(ddSketchInfKey), 1))
+	// The bin of a value contains it.
+	for _, v := range []float64{1e-6, 0.5, 1, 3, 1e9} {
+		k := newTestDogsketch(0, v).K[0]
+		assert.LessOrEqual(t, ddSketchBinLow(k), v)
+		assert.Greater(t, ddSketchBinLow(k+1), v)
+		assert.Equal(t, -ddSketchBinLow(k), ddSketchBinLow(-k))
+	}
+}
+
+func TestHandlerSketchesPost(t *testing.T) {
+	var received []prompb.TimeSeries
+	rwsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		wr, err := remotewrite.DecodeWriteRequest(body)
+		assert.NoError(t, err)
+		received = wr.Timeseries
+	}))
+	defer rwsrv.Close()
+
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, rwsrv.URL, disableAPIAuthentication)
+
+	// The DD agent compresses payloads.
+	body, err := ZlibEncode(encodeTestSketchPayload(t))
+	assert.NoError(t, err)
+	req := httptest.NewRequest("POST", "http://localhost/api/beta/sketches", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "deflate")
+	w := httptest.NewRecorder()
+	ddcp.HandlerSketchesPost(w, req)
+	expectInsertSuccessResponse(w, t)
+	// Count, sum, min, max and 5 quantiles.
+	assert.Len(t, received, 9)
+
+	req = httptest.NewRequest("POST", "http://localhost/api/beta/sketches", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	ddcp.HandlerSketchesPost(w, req)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, "bad request: unexpected content-type header (expecting: application/x-protobuf)",
+		getStrippedBody(w.Result()))
+}
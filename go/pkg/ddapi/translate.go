@@ -95,6 +95,46 @@ func sanitizeLabelName(value string) string {
 	return metricNameinvalidCharRE.ReplaceAllString(value, "_")
 }
 
+// Translate DD agent tags into label k/v pairs, added to `labels`. Upon
+// unexpected tag structure, log a warning (mentioning `source`, such as
+// "metric: <name>") but otherwise proceed.
+func addDDTagLabels(labels map[string]string, tags []string, source string) {
+	for _, tag := range tags {
+		t := strings.SplitN(tag, ":", 2)
+
+		if len(t) != 2 {
+			log.Warnf("Invalid tag %s for %s", tag, source)
+			continue
+		}
+
+		// Prefix the tag name so that the source of this label is known
+		// (and can be queried for, with guarantees) and so that it can't
+		// override an "important" label, such as "instance".
+		tname := "ddtag_" + sanitizeLabelName(t[0])
+		tvalue := t[1]
+		labels[tname] = tvalue
+	}
+}
+
+// Create slice from `labels` map, with values being of type prompb.Label.
+// Skip prompb.Label construction for empty values (for example, the device
+// of a series may be empty).
+func promLabelsFromMap(labels map[string]string) []prompb.Label {
+	promLabelset := make([]prompb.Label, 0, len(labels))
+	for k, v := range labels {
+		if len(v) == 0 {
+			continue
+		}
+
+		l := prompb.Label{
+			Name:  k,
+			Value: v,
+		}
+		promLabelset = append(promLabelset, l)
+	}
+	return promLabelset
+}
+
 func TranslateDDCheckRunJSON(doc []byte) ([]prompb.TimeSeries, error) {
 	// Attempt to deserialize entire JSON document, using the type definitions
 	// above.
@@ -243,126 +283,107 @@ func TranslateDDSeriesJSON(doc []byte) ([]prompb.TimeSeries, error) {
 		return nil, fmt.Errorf("invalid JSON doc: %v", jerr)
 	}
 
-	promTimeSeriesFragments := make([]prompb.TimeSeries, 0, len(sfragments.Fragments))
-	for _, fragment := range sfragments.Fragments {
-		// Build up label set as a map to ensure uniqueness of keys.
-		labels := map[string]string{
-			// A time series fragment corresponds to a specific metric with a
-			// name. Store this metric name in the corresponding (reserved)
-			// Prometheus label. Replace disallowed characters with
-			// underscores; this typically affects the . separators. Some DD
-			// metrics have a special noindex name prefix (example:
-			// n_o_i_n_d_e_x.datadog.agent.payload.dropped) -- remove that.
-			"__name__": sanitizeMetricName(strings.TrimPrefix(fragment.Name, "n_o_i_n_d_e_x.")),
-			// In the Prometheus world, host is 'instance'. Maybe also add
-			// `host` label later again carrying the same value. For now, try
-			// to keep cardinality minimal.
-			"instance":         fragment.Host,
-			"job":              "ddagent",
-			"device":           fragment.Device,
-			"type":             fragment.Type,
-			"source_type_name": fragment.SourceTypeName,
-		}
-
-		// One goal is to keep cardinality minimal, i.e. to not set useless
-		// labels. That implies removing the `interval` label for DD metrics of
-		// type gauge (where interval isn't well defined). Another goal is to
-		// remove all interval values of 0 (which isn't well defined). In code,
-		// it looks like only the latter needs to be done -- satisfies the
-		// other goals, too.
-		if fragment.Interval != 0 {
-			labels["interval"] = strconv.FormatInt(fragment.Interval, 10)
-		}
-
-		// Translate DD agent tags into label k/v pairs. Upon unexpected tag
-		// structure, log a warning but otherwise proceed.
-		for _, tag := range fragment.Tags {
-			t := strings.SplitN(tag, ":", 2)
-
-			if len(t) != 2 {
-				log.Warnf("Invalid tag %s for metric: %s", tag, fragment.Name)
-				continue
-			}
+	return translateDDSeriesFragments(sfragments.Fragments), nil
+}
 
-			// Prefix the tag name so that the source of this label is known
-			// (and can be queried for, with guarantees) and so that it can't
-			// override an "important" label, such as "instance".
-			tname := "ddtag_" + sanitizeLabelName(t[0])
-			tvalue := t[1]
-			labels[tname] = tvalue
+// Translate DD time series fragments, as submitted to /api/v1/series or (after
+// conversion) to /api/v2/series.
+func translateDDSeriesFragments(fragments []*ddSeriesFragment) []prompb.TimeSeries {
+	promTimeSeriesFragments := make([]prompb.TimeSeries, 0, len(fragments))
+	for _, fragment := range fragments {
+		if pts, ok := translateDDSeriesFragment(fragment); ok {
+			promTimeSeriesFragments = append(promTimeSeriesFragments, pts)
 		}
+	}
+	return promTimeSeriesFragments
+}
 
-		// Create slice from `labels` map, with values being of type
-		// prompb.Label. For `prompb.TimeSeries` construction below. Skip
-		// prompb.Label construction for empty values (for example,
-		// `fragment.Device` may be empty).
-		promLabelset := make([]prompb.Label, 0, len(labels))
-		for k, v := range labels {
-			if len(v) == 0 {
-				continue
-			}
+// Translate a DD time series fragment. Return false if the fragment has no
+// points, and is to be dropped. Sorts `fragment.Points` in place.
+func translateDDSeriesFragment(fragment *ddSeriesFragment) (prompb.TimeSeries, bool) {
+	// Build up label set as a map to ensure uniqueness of keys.
+	labels := map[string]string{
+		// A time series fragment corresponds to a specific metric with a
+		// name. Store this metric name in the corresponding (reserved)
+		// Prometheus label. Replace disallowed characters with
+		// underscores; this typically affects the . separators. Some DD
+		// metrics have a special noindex name prefix (example:
+		// n_o_i_n_d_e_x.datadog.agent.payload.dropped) -- remove that.
+		"__name__": sanitizeMetricName(strings.TrimPrefix(fragment.Name, "n_o_i_n_d_e_x.")),
+		// In the Prometheus world, host is 'instance'. Maybe also add
+		// `host` label later again carrying the same value. For now, try
+		// to keep cardinality minimal.
+		"instance":         fragment.Host,
+		"job":              "ddagent",
+		"device":           fragment.Device,
+		"type":             fragment.Type,
+		"source_type_name": fragment.SourceTypeName,
+	}
 
-			l := prompb.Label{
-				Name:  k,
-				Value: v,
-			}
-			promLabelset = append(promLabelset, l)
-		}
+	// One goal is to keep cardinality minimal, i.e. to not set useless
+	// labels. That implies removing the `interval` label for DD metrics of
+	// type gauge (where interval isn't well defined). Another goal is to
+	// remove all interval values of 0 (which isn't well defined). In code,
+	// it looks like only the latter needs to be done -- satisfies the
+	// other goals, too.
+	if fragment.Interval != 0 {
+		labels["interval"] = strconv.FormatInt(fragment.Interval, 10)
+	}
 
-		// Inspiration from
-		// https://github.com/open-telemetry/opentelemetry-go-contrib/blob/v0.15.0/exporters/metric/cortex/cortex.go#L385
+	addDDTagLabels(labels, fragment.Tags, "metric: "+fragment.Name)
+	promLabelset := promLabelsFromMap(labels)
 
-		// Handle special case of fragment.Points being of zero length: simply
-		// drop this fragment.
-		if len(fragment.Points) == 0 {
-			log.Debugf("No samples in fragment, skip: %v", labels)
-			continue
-		}
+	// Inspiration from
+	// https://github.com/open-telemetry/opentelemetry-go-contrib/blob/v0.15.0/exporters/metric/cortex/cortex.go#L385
 
-		// log.Infof("fragment samples: %v", fragment.Points)
-
-		// Note(JP): assume and require that `fragment.Points` contains samples
-		// in strict descending time order, i.e. the first sample being the
-		// newest. This is what the DD agent is expected to send. Update(JP):
-		// with Datadog Agent v7.24.1 I've seen ascending order, too. Don't
-		// assume anything. Sort the input.  The Prometheus `prompb.TimeSeries`
-		// construct seems to require `Samples` in strict ascending order, with
-		// the newest sample being last.
-		sort.Slice(fragment.Points, func(i, j int) bool {
-			// Sort ascendingly in time: newest sample last. Allow adjacent
-			// samples to have equivalent timestamp (for now, not sure if
-			// that's allowed by Prometheus / Cortex). Might want to use stable
-			// sort instead to make sure that when adjacent samples have equal
-			// timestamps that the sort behavior does not change between http
-			// requests.
-			return fragment.Points[i].Timestamp < fragment.Points[j].Timestamp
-		})
-		// log.Infof("fragment samples sorted: %v", fragment.Points)
-
-		promSamples := make([]prompb.Sample, 0, len(fragment.Points))
-
-		for _, p := range fragment.Points {
-			// TODO: think about if `point.Value` should undergo a
-			// transformation, depending on the DD metric type (count, rate,
-			// gauge) and the `interval` property set in the input ts fragment.
-			s := prompb.Sample{
-				Value: p.Value,
-				// A DD sample timestamp represents seconds since epoch. The
-				// prompb.Sample.Timestamp represents milliseconds since epoch.
-				Timestamp: p.Timestamp * 1000,
-			}
+	// Handle special case of fragment.Points being of zero length: simply
+	// drop this fragment.
+	if len(fragment.Points) == 0 {
+		log.Debugf("No samples in fragment, skip: %v", labels)
+		return prompb.TimeSeries{}, false
+	}
 
-			promSamples = append(promSamples, s)
+	// log.Infof("fragment samples: %v", fragment.Points)
+
+	// Note(JP): assume and require that `fragment.Points` contains samples
+	// in strict descending time order, i.e. the first sample being the
+	// newest. This is what the DD agent is expected to send. Update(JP):
+	// with Datadog Agent v7.24.1 I've seen ascending order, too. Don't
+	// assume anything. Sort the input.  The Prometheus `prompb.TimeSeries`
+	// construct seems to require `Samples` in strict ascending order, with
+	// the newest sample being last.
+	sort.Slice(fragment.Points, func(i, j int) bool {
+		// Sort ascendingly in time: newest sample last. Allow adjacent
+		// samples to have equivalent timestamp (for now, not sure if
+		// that's allowed by Prometheus / Cortex). Might want to use stable
+		// sort instead to make sure that when adjacent samples have equal
+		// timestamps that the sort behavior does not change between http
+		// requests.
+		return fragment.Points[i].Timestamp < fragment.Points[j].Timestamp
+	})
+	// log.Infof("fragment samples sorted: %v", fragment.Points)
+
+	promSamples := make([]prompb.Sample, 0, len(fragment.Points))
+
+	for _, p := range fragment.Points {
+		// The value is written as is: see ConvertCounters() for turning
+		// counts into counters and rates into per-second gauges.
+		s := prompb.Sample{
+			Value: p.Value,
+			// A DD sample timestamp represents seconds since epoch. The
+			// prompb.Sample.Timestamp represents milliseconds since epoch.
+			Timestamp: p.Timestamp * 1000,
 		}
 
-		// Construct the Prometheus protobuf time series fragment, comprised of
-		// a set of labels and a set of samples.
-		pts := prompb.TimeSeries{
-			Samples: promSamples,
-			Labels:  promLabelset,
-		}
+		promSamples = append(promSamples, s)
+	}
 
-		promTimeSeriesFragments = append(promTimeSeriesFragments, pts)
+	// Construct the Prometheus protobuf time series fragment, comprised of
+	// a set of labels and a set of samples.
+	pts := prompb.TimeSeries{
+		Samples: promSamples,
+		Labels:  promLabelset,
 	}
-	return promTimeSeriesFragments, nil
+
+	return pts, true
 }
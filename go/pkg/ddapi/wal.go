@@ -0,0 +1,558 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
+)
+
+var (
+	walPendingRecords = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ddapi_wal_pending_records",
+		Help: "Number of write requests in the write-ahead log, not yet shipped to the remote_write endpoint.",
+	})
+
+	walSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ddapi_wal_size_bytes",
+		Help: "Size of the write-ahead log segments on disk.",
+	})
+
+	walAppendedRecordsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ddapi_wal_appended_records_total",
+		Help: "Number of write requests appended to the write-ahead log.",
+	})
+
+	walRejectedAppendsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ddapi_wal_rejected_appends_total",
+		Help: "Number of write requests rejected because the write-ahead log is full.",
+	})
+
+	walShippedRecordsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ddapi_wal_shipped_records_total",
+		Help: "Number of write requests from the write-ahead log written to the remote_write endpoint.",
+	})
+
+	walShipRetriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ddapi_wal_ship_retries_total",
+		Help: "Number of failed attempts to write a write request from the write-ahead log, retried.",
+	})
+
+	walDroppedRecordsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ddapi_wal_dropped_records_total",
+		Help: "Number of write requests dropped from the write-ahead log: rejected by the remote_write endpoint, or corrupt.",
+	}, []string{"reason"})
+)
+
+// ErrWALFull is returned by WAL.Append() when the WAL has reached its
+// maximum size.
+var ErrWALFull = errors.New("write-ahead log is full")
+
+const (
+	// Upper bound for the size of a segment file.
+	walSegmentSize = 64 << 20
+	// Record header: payload length and CRC32 (Castagnoli) of the payload.
+	walHeaderSize = 8
+	// The shipper's read position, see saveCheckpoint().
+	walCheckpointFile = "checkpoint"
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+type walSegment struct {
+	n    int
+	size int64
+}
+
+// The segment file appended to, an *os.File. An interface for testing.
+type walFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+/*
+WAL is a write-ahead log for remote_write requests: Append() persists a
+request (fsynced), and Ship() sends the requests in order, retrying with
+backoff until the remote_write endpoint accepts them. The proxy can then
+acknowledge writes while Cortex is unavailable.
+
+The log is a directory of numbered segment files, each a sequence of records
+(length, CRC32, payload). Segments are deleted once shipped. The read
+position of Ship() is saved in a checkpoint file, so that the requests
+shipped before a restart are not sent again (except for the last one, if the
+proxy stopped right after sending it).
+
+The total size of the segments is bounded by `maxSize`: when it is reached,
+Append() fails until older requests are shipped.
+*/
+type WAL struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	mu sync.Mutex
+	// Segments on disk, ascending. Appends go to the last one.
+	segments []walSegment
+	// The last segment.
+	file walFile
+	// Number of the last segment created (possibly shipped and deleted).
+	lastSegment int
+	// Total size of the segments.
+	size    int64
+	pending int
+	// Read position of Ship(), in segments[0].
+	readOffset int64
+
+	// Signals appends to Ship().
+	appended chan struct{}
+	closed   chan struct{}
+
+	// For testing.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+/*
+Open the WAL in `dir` (created if needed), with the maximum size `maxSize`
+in bytes (0 means unlimited). The segments of a previous run are checked,
+and truncated at the first corrupt record (such as a record that was only
+partially written when the proxy stopped).
+*/
+func NewWAL(dir string, maxSize int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: walSegmentSize,
+		appended:    make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+		minBackoff:  time.Second,
+		maxBackoff:  time.Minute,
+	}
+	// Rotate often enough that shipped segments can be deleted before the
+	// log is full.
+	if maxSize > 0 && maxSize/4 < w.segmentSize {
+		w.segmentSize = maxSize / 4
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	// Start a new segment, rather than appending to a segment that may have
+	// been truncated.
+	if err := w.createSegment(); err != nil {
+		return nil, err
+	}
+	w.updateMetrics()
+	return w, nil
+}
+
+// Load the segments of a previous run, and the checkpoint.
+func (w *WAL) load() error {
+	entries, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil && !e.IsDir() {
+			w.segments = append(w.segments, walSegment{n: n, size: e.Size()})
+		}
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i].n < w.segments[j].n })
+
+	readSegment, readOffset, err := w.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	// Delete the segments shipped before the checkpoint.
+	for len(w.segments) > 0 && w.segments[0].n < readSegment {
+		if err := os.Remove(w.segmentPath(w.segments[0].n)); err != nil {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+	if len(w.segments) > 0 && w.segments[0].n == readSegment {
+		w.readOffset = readOffset
+	}
+	// Keep numbering segments after the checkpoint.
+	w.lastSegment = readSegment
+	if len(w.segments) > 0 {
+		w.lastSegment = w.segments[len(w.segments)-1].n
+	}
+
+	for i := range w.segments {
+		offset := int64(0)
+		if i == 0 {
+			offset = w.readOffset
+		}
+		if err := w.checkSegment(&w.segments[i], offset); err != nil {
+			return err
+		}
+		w.size += w.segments[i].size
+	}
+	return nil
+}
+
+// Count the records of `seg` from `offset` on, and truncate the segment at
+// the first corrupt record.
+func (w *WAL) checkSegment(seg *walSegment, offset int64) error {
+	f, err := os.OpenFile(w.segmentPath(seg.n), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for offset < seg.size {
+		payload, rerr := readWALRecord(f, offset, seg.size)
+		if rerr != nil {
+			log.Warnf("truncating WAL segment %d at offset %d: %s", seg.n, offset, rerr)
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			seg.size = offset
+			break
+		}
+		offset += walHeaderSize + int64(len(payload))
+		w.pending++
+	}
+	return nil
+}
+
+// Read the record at `offset` of the segment `f` of size `size`.
+func readWALRecord(f *os.File, offset int64, size int64) ([]byte, error) {
+	if size-offset < walHeaderSize {
+		return nil, fmt.Errorf("incomplete record header")
+	}
+	header := make([]byte, walHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > size-offset-walHeaderSize {
+		return nil, fmt.Errorf("incomplete record: %d bytes expected", length)
+	}
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, offset+walHeaderSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if crc32.Checksum(payload, walCRCTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return payload, nil
+}
+
+func (w *WAL) segmentPath(n int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d", n))
+}
+
+// Create the next segment, and make it the one appended to.
+func (w *WAL) createSegment() error {
+	n := w.lastSegment + 1
+	f, err := os.OpenFile(w.segmentPath(n), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = f
+	w.lastSegment = n
+	w.segments = append(w.segments, walSegment{n: n})
+	return nil
+}
+
+/*
+Append the write request `payload` (as sent to the remote_write endpoint),
+and fsync it. Return ErrWALFull if the WAL has reached its maximum size.
+*/
+func (w *WAL) Append(payload []byte) error {
+	recordSize := walHeaderSize + int64(len(payload))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxSize > 0 && w.size+recordSize > w.maxSize {
+		walRejectedAppendsTotal.Inc()
+		return ErrWALFull
+	}
+	seg := &w.segments[len(w.segments)-1]
+	if seg.size > 0 && seg.size+recordSize > w.segmentSize {
+		if err := w.createSegment(); err != nil {
+			return err
+		}
+		seg = &w.segments[len(w.segments)-1]
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, walCRCTable))
+	copy(record[walHeaderSize:], payload)
+	if _, err := w.file.Write(record); err != nil {
+		w.dropPartialRecord(seg)
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.dropPartialRecord(seg)
+		return err
+	}
+
+	seg.size += recordSize
+	w.size += recordSize
+	w.pending++
+	walAppendedRecordsTotal.Inc()
+	w.updateMetrics()
+
+	select {
+	case w.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+/*
+Drop what may have been written of a record to the last segment `seg`, after
+a failed write or fsync: truncate the segment to its size before the record,
+and move the file offset back there, so that the next record does not follow
+a hole (which would read as empty records).
+*/
+func (w *WAL) dropPartialRecord(seg *walSegment) {
+	if err := w.file.Truncate(seg.size); err != nil {
+		log.Errorf("could not truncate WAL segment %d: %s", seg.n, err)
+	}
+	if _, err := w.file.Seek(seg.size, io.SeekStart); err != nil {
+		log.Errorf("could not seek in WAL segment %d: %s", seg.n, err)
+	}
+}
+
+/*
+Return the next record to ship, or nil if all records have been shipped.
+Also return the size of the record in the log, to pass to advance(). Delete
+the segments that have been shipped entirely.
+*/
+func (w *WAL) next() ([]byte, int64, error) {
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		return nil, 0, nil
+	}
+	for len(w.segments) > 1 && w.readOffset >= w.segments[0].size {
+		if err := w.removeFirstSegment(); err != nil {
+			w.mu.Unlock()
+			return nil, 0, err
+		}
+	}
+	seg := w.segments[0]
+	offset := w.readOffset
+	w.mu.Unlock()
+
+	if offset >= seg.size {
+		return nil, 0, nil
+	}
+
+	f, err := os.Open(w.segmentPath(seg.n))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	payload, err := readWALRecord(f, offset, seg.size)
+	if err != nil {
+		// Records are checked when the WAL is opened: the file was
+		// changed since.
+		log.Errorf("skipping the rest of WAL segment %d from offset %d: %s", seg.n, offset, err)
+		walDroppedRecordsTotal.WithLabelValues("corrupt").Inc()
+		return nil, seg.size - offset, nil
+	}
+	return payload, walHeaderSize + int64(len(payload)), nil
+}
+
+// Move the read position past the record of size `recordSize` returned by
+// next(), and save it.
+func (w *WAL) advance(recordSize int64, records int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.isClosed() {
+		// The record is shipped again after a restart.
+		return
+	}
+	w.readOffset += recordSize
+	w.pending -= records
+	w.updateMetrics()
+	if err := w.saveCheckpoint(w.segments[0].n, w.readOffset); err != nil {
+		log.Errorf("could not save WAL checkpoint: %s", err)
+	}
+}
+
+func (w *WAL) removeFirstSegment() error {
+	if err := os.Remove(w.segmentPath(w.segments[0].n)); err != nil {
+		return err
+	}
+	w.size -= w.segments[0].size
+	w.segments = w.segments[1:]
+	w.readOffset = 0
+	w.updateMetrics()
+	return w.saveCheckpoint(w.segments[0].n, 0)
+}
+
+/*
+Save the read position of Ship(). Not fsynced: after a crash, the position
+may be behind, and some requests sent again. Cortex accepts samples it
+already has (with the same value).
+*/
+func (w *WAL) saveCheckpoint(segment int, offset int64) error {
+	path := filepath.Join(w.dir, walCheckpointFile)
+	data := []byte(fmt.Sprintf("%d %d\n", segment, offset))
+	if err := ioutil.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (w *WAL) loadCheckpoint() (int, int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(w.dir, walCheckpointFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var segment int
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &segment, &offset); err != nil {
+		return 0, 0, fmt.Errorf("bad WAL checkpoint: %w", err)
+	}
+	return segment, offset, nil
+}
+
+func (w *WAL) updateMetrics() {
+	walPendingRecords.Set(float64(w.pending))
+	walSizeBytes.Set(float64(w.size))
+}
+
+/*
+Ship the records, in order, with `send` until Close() is called. Failed
+sends are retried with exponential backoff, unless the error is permanent
+(see remotewrite.IsRecoverable()): then the record is dropped.
+*/
+func (w *WAL) Ship(send func([]byte) error) {
+	for {
+		payload, recordSize, err := w.next()
+		if err != nil {
+			if w.isClosed() {
+				return
+			}
+			log.Errorf("error while reading WAL: %s", err)
+			if !w.sleep(w.maxBackoff) {
+				return
+			}
+			continue
+		}
+		if recordSize == 0 {
+			select {
+			case <-w.appended:
+				continue
+			case <-w.closed:
+				return
+			}
+		}
+		if payload == nil {
+			// A corrupt rest of segment, skipped.
+			w.advance(recordSize, 0)
+			continue
+		}
+
+		if !w.sendWithBackoff(send, payload) {
+			return
+		}
+		w.advance(recordSize, 1)
+	}
+}
+
+// Send `payload` until it is accepted or dropped. Return false if the WAL is
+// closed meanwhile.
+func (w *WAL) sendWithBackoff(send func([]byte) error, payload []byte) bool {
+	backoff := w.minBackoff
+	for {
+		err := send(payload)
+		if err == nil {
+			walShippedRecordsTotal.Inc()
+			return true
+		}
+		if !remotewrite.IsRecoverable(err) {
+			log.Errorf("dropping write request from WAL: %s", err)
+			walDroppedRecordsTotal.WithLabelValues("rejected").Inc()
+			return true
+		}
+
+		log.Warnf("error while shipping write request from WAL, retrying in %s: %s", backoff, err)
+		walShipRetriesTotal.Inc()
+		if !w.sleep(backoff) {
+			return false
+		}
+		backoff *= 2
+		if backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// Sleep for `d`. Return false if the WAL is closed meanwhile.
+func (w *WAL) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-w.closed:
+		return false
+	}
+}
+
+func (w *WAL) isClosed() bool {
+	select {
+	case <-w.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close the WAL, and stop Ship(). Closing it again has no effect.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed() {
+		return nil
+	}
+	close(w.closed)
+	return w.file.Close()
+}
@@ -0,0 +1,246 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/remotewrite"
+)
+
+func newTestWAL(t *testing.T, dir string, maxSize int64) *WAL {
+	w, err := NewWAL(dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.minBackoff = time.Millisecond
+	w.maxBackoff = 10 * time.Millisecond
+	// Stop Ship() before the directory is removed.
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// Records the payloads shipped from a WAL, failing as configured.
+type testShipper struct {
+	mu      sync.Mutex
+	shipped []string
+	// Errors to return, before succeeding.
+	errs []error
+}
+
+func (s *testShipper) send(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	s.shipped = append(s.shipped, string(payload))
+	return nil
+}
+
+func (s *testShipper) get() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.shipped...)
+}
+
+func TestWAL_Ship(t *testing.T) {
+	dir := t.TempDir()
+
+	w := newTestWAL(t, dir, 0)
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, w.Append([]byte(fmt.Sprintf("r%d", i))))
+	}
+
+	// Retried on transport errors and 5xx, dropped on 4xx.
+	s := &testShipper{errs: []error{
+		fmt.Errorf("connection refused"),
+		&remotewrite.HTTPError{StatusCode: 503},
+		nil,
+		&remotewrite.HTTPError{StatusCode: 400},
+	}}
+	go w.Ship(s.send)
+	assert.Eventually(t, func() bool { return len(s.get()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"r1", "r3"}, s.get())
+
+	// Appends are shipped as they come.
+	assert.NoError(t, w.Append([]byte("r4")))
+	assert.Eventually(t, func() bool { return len(s.get()) == 3 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.pending == 0
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, w.Close())
+}
+
+func TestWAL_Reopen(t *testing.T) {
+	dir := t.TempDir()
+
+	w := newTestWAL(t, dir, 0)
+	assert.NoError(t, w.Append([]byte("r1")))
+	assert.NoError(t, w.Append([]byte("r2")))
+	// Ship the first record only.
+	payload, recordSize, err := w.next()
+	assert.NoError(t, err)
+	assert.Equal(t, "r1", string(payload))
+	w.advance(recordSize, 1)
+	assert.NoError(t, w.Append([]byte("r3")))
+	assert.NoError(t, w.Close())
+
+	// A partially written record.
+	segment := filepath.Join(dir, "00000001")
+	f, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	w = newTestWAL(t, dir, 0)
+	assert.Equal(t, 2, w.pending)
+	assert.NoError(t, w.Append([]byte("r4")))
+	s := &testShipper{}
+	go w.Ship(s.send)
+	assert.Eventually(t, func() bool { return len(s.get()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"r2", "r3", "r4"}, s.get())
+	assert.NoError(t, w.Close())
+
+	// Shipped segments are deleted, and not shipped again.
+	_, err = os.Stat(segment)
+	assert.True(t, os.IsNotExist(err))
+	w = newTestWAL(t, dir, 0)
+	assert.Equal(t, 0, w.pending)
+	assert.NoError(t, w.Close())
+}
+
+func TestWAL_Full(t *testing.T) {
+	dir := t.TempDir()
+
+	// Room for 4 records of 2 bytes, 1 per segment.
+	w := newTestWAL(t, dir, 4*(walHeaderSize+2))
+	for i := 1; i <= 4; i++ {
+		assert.NoError(t, w.Append([]byte(fmt.Sprintf("r%d", i))))
+	}
+	assert.Equal(t, ErrWALFull, w.Append([]byte("r5")))
+
+	s := &testShipper{}
+	go w.Ship(s.send)
+	assert.Eventually(t, func() bool { return len(s.get()) == 4 }, time.Second, time.Millisecond)
+	// The shipped segments have been deleted (except for the last one).
+	assert.Eventually(t, func() bool { return w.Append([]byte("r5")) == nil }, time.Second, time.Millisecond)
+	assert.NoError(t, w.Close())
+}
+
+// A segment file failing the first write after writing half of it, or the
+// first fsync.
+type failingWALFile struct {
+	*os.File
+	failWrite bool
+	failSync  bool
+}
+
+func (f *failingWALFile) Write(p []byte) (int, error) {
+	if f.failWrite {
+		f.failWrite = false
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, fmt.Errorf("short write")
+	}
+	return f.File.Write(p)
+}
+
+func (f *failingWALFile) Sync() error {
+	if f.failSync {
+		f.failSync = false
+		return fmt.Errorf("sync failed")
+	}
+	return f.File.Sync()
+}
+
+func TestWAL_FailedAppend(t *testing.T) {
+	dir := t.TempDir()
+
+	w := newTestWAL(t, dir, 0)
+	assert.NoError(t, w.Append([]byte("r1")))
+	f := &failingWALFile{File: w.file.(*os.File), failWrite: true}
+	w.file = f
+	assert.Error(t, w.Append([]byte("lost")))
+	assert.NoError(t, w.Append([]byte("r2")))
+	f.failSync = true
+	assert.Error(t, w.Append([]byte("lost")))
+	assert.NoError(t, w.Append([]byte("r3")))
+	assert.NoError(t, w.Close())
+
+	// No hole or partial record between the records.
+	w = newTestWAL(t, dir, 0)
+	assert.Equal(t, 3, w.pending)
+	s := &testShipper{}
+	go w.Ship(s.send)
+	assert.Eventually(t, func() bool { return len(s.get()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"r1", "r2", "r3"}, s.get())
+}
+
+func TestHandlerCommonAfterJSONTranslate_wal(t *testing.T) {
+	// A remote_write endpoint, unavailable for the first request.
+	var mu sync.Mutex
+	var requests int
+	var received []prompb.TimeSeries
+	rwsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		wr, err := remotewrite.DecodeWriteRequest(body)
+		assert.NoError(t, err)
+		assert.Equal(t, TenantName, r.Header.Get("X-Scope-OrgID"))
+		received = wr.Timeseries
+	}))
+	defer rwsrv.Close()
+
+	dir := t.TempDir()
+	wal := newTestWAL(t, dir, 0)
+
+	disableAPIAuthentication := true
+	ddcp := NewDDCortexProxy(TenantName, rwsrv.URL, disableAPIAuthentication).BufferWrites(wal)
+	w := httptest.NewRecorder()
+	ddcp.HandlerCommonAfterJSONTranslate(w, genSubmitRequest("{}"), []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}},
+	})
+	expectInsertSuccessResponse(w, t)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 1
+	}, time.Second, time.Millisecond)
+}
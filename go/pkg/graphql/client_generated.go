@@ -794,6 +794,67 @@ func (client *Client) GetTenants() (*GetTenantsResponse, error) {
 	return GetTenants(client.Url, client.Client)
 }
 
+//
+// query GetTokenRevocations
+//
+
+type GetTokenRevocationsResponse struct {
+	TokenRevocation []struct {
+		Tenant    string `json:"tenant"`
+		Jti       string `json:"jti"`
+		NotBefore string `json:"not_before"`
+	} `json:"token_revocation"`
+}
+
+type GetTokenRevocationsRequest struct {
+	*http.Request
+}
+
+func NewGetTokenRevocationsRequest(url string) (*GetTokenRevocationsRequest, error) {
+	b, err := json.Marshal(&GraphQLOperation{
+		Query: `query GetTokenRevocations {
+  token_revocation {
+    tenant
+    jti
+    not_before
+  }
+}`,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return &GetTokenRevocationsRequest{req}, nil
+}
+
+func (req *GetTokenRevocationsRequest) Execute(client *http.Client) (*GetTokenRevocationsResponse, error) {
+	resp, err := execute(client, req.Request)
+	if err != nil {
+		return nil, err
+	}
+	var result GetTokenRevocationsResponse
+	if err := json.Unmarshal(resp.Data, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func GetTokenRevocations(url string, client *http.Client) (*GetTokenRevocationsResponse, error) {
+	req, err := NewGetTokenRevocationsRequest(url)
+	if err != nil {
+		return nil, err
+	}
+	return req.Execute(client)
+}
+
+func (client *Client) GetTokenRevocations() (*GetTokenRevocationsResponse, error) {
+	return GetTokenRevocations(client.Url, client.Client)
+}
+
 //
 // mutation UpdateAlertmanager($tenant_id: String!, $input: AlertmanagerInput!)
 //
@@ -0,0 +1,287 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lokipush decodes and checks the log streams pushed through the Loki
+// API proxy (`/loki/api/v1/push`), in both formats accepted by Loki: JSON and
+// snappy-compressed protobuf.
+package lokipush
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/snappy"
+	json "github.com/json-iterator/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/opstrace/opstrace/go/pkg/selector"
+)
+
+// PushRequest is a decoded push request, independent of its wire format.
+type PushRequest struct {
+	Streams []Stream
+}
+
+type Stream struct {
+	Labels  labels.Labels
+	Entries []Entry
+}
+
+type Entry struct {
+	Timestamp time.Time
+	Line      string
+}
+
+// Loki reads JSON bodies as JSON, and everything else as snappy-compressed
+// protobuf.
+func isJSON(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json"
+}
+
+// DefaultMaxMessageSize is the default maximum size of a push request,
+// compressed and decompressed.
+const DefaultMaxMessageSize = 100 << 20
+
+var errMessageTooLarge = errors.New("message too large")
+
+/*
+Read the body `r` of a request, unless it has more than `maxSize` bytes (0
+means unlimited): then return an error wrapping errMessageTooLarge, without
+reading further.
+*/
+func readBody(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", errMessageTooLarge, maxSize)
+	}
+	return body, nil
+}
+
+// Decode the body of a push request with the Content-Type `contentType`, of
+// at most DefaultMaxMessageSize bytes after decompression.
+func DecodePushRequest(contentType string, body []byte) (*PushRequest, error) {
+	return decodePushRequest(contentType, body, DefaultMaxMessageSize)
+}
+
+func decodePushRequest(contentType string, body []byte, maxSize int) (*PushRequest, error) {
+	if isJSON(contentType) {
+		return decodeJSON(body)
+	}
+	return decodeProtobuf(body, maxSize)
+}
+
+// EncodePushRequest is the inverse of DecodePushRequest.
+func EncodePushRequest(contentType string, pr *PushRequest) ([]byte, error) {
+	if isJSON(contentType) {
+		return encodeJSON(pr)
+	}
+	return encodeProtobuf(pr)
+}
+
+// The JSON push format, see
+// https://grafana.com/docs/loki/latest/api/#post-lokiapiv1push
+type jsonPushRequest struct {
+	Streams []jsonStream `json:"streams"`
+}
+
+type jsonStream struct {
+	Stream map[string]string `json:"stream"`
+	// [<unix epoch in nanoseconds, as a string>, <log line>] pairs.
+	Values [][]string `json:"values"`
+}
+
+func decodeJSON(body []byte) (*PushRequest, error) {
+	var jr jsonPushRequest
+	if err := json.Unmarshal(body, &jr); err != nil {
+		return nil, fmt.Errorf("JSON decoding failed: %w", err)
+	}
+
+	pr := &PushRequest{Streams: make([]Stream, 0, len(jr.Streams))}
+	for i, js := range jr.Streams {
+		s := Stream{Labels: labels.FromMap(js.Stream), Entries: make([]Entry, 0, len(js.Values))}
+		for j, v := range js.Values {
+			if len(v) != 2 {
+				return nil, fmt.Errorf("stream %d, entry %d: expected [timestamp, line], got %d values", i, j, len(v))
+			}
+			ns, err := strconv.ParseInt(v[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("stream %d, entry %d: bad timestamp %q", i, j, v[0])
+			}
+			s.Entries = append(s.Entries, Entry{Timestamp: time.Unix(0, ns).UTC(), Line: v[1]})
+		}
+		pr.Streams = append(pr.Streams, s)
+	}
+	return pr, nil
+}
+
+func encodeJSON(pr *PushRequest) ([]byte, error) {
+	jr := jsonPushRequest{Streams: make([]jsonStream, 0, len(pr.Streams))}
+	for _, s := range pr.Streams {
+		js := jsonStream{Stream: s.Labels.Map(), Values: make([][]string, 0, len(s.Entries))}
+		for _, e := range s.Entries {
+			js.Values = append(js.Values, []string{strconv.FormatInt(e.Timestamp.UnixNano(), 10), e.Line})
+		}
+		jr.Streams = append(jr.Streams, js)
+	}
+	return json.Marshal(jr)
+}
+
+/*
+The protobuf push format: the messages of logproto.PushRequest in Loki's
+pkg/logproto/logproto.proto. The hash field of streams is omitted, Loki
+computes it from the labels.
+*/
+type pbPushRequest struct {
+	Streams []*pbStream `protobuf:"bytes,1,rep,name=streams,proto3"`
+}
+
+func (m *pbPushRequest) Reset()         { *m = pbPushRequest{} }
+func (m *pbPushRequest) String() string { return proto.CompactTextString(m) }
+func (*pbPushRequest) ProtoMessage()    {}
+
+type pbStream struct {
+	// A label set in the PromQL syntax, such as `{app="api", env="prod"}`.
+	Labels  string     `protobuf:"bytes,1,opt,name=labels,proto3"`
+	Entries []*pbEntry `protobuf:"bytes,2,rep,name=entries,proto3"`
+}
+
+func (m *pbStream) Reset()         { *m = pbStream{} }
+func (m *pbStream) String() string { return proto.CompactTextString(m) }
+func (*pbStream) ProtoMessage()    {}
+
+type pbEntry struct {
+	Timestamp *types.Timestamp `protobuf:"bytes,1,opt,name=timestamp,proto3"`
+	Line      string           `protobuf:"bytes,2,opt,name=line,proto3"`
+}
+
+func (m *pbEntry) Reset()         { *m = pbEntry{} }
+func (m *pbEntry) String() string { return proto.CompactTextString(m) }
+func (*pbEntry) ProtoMessage()    {}
+
+func decodeProtobuf(body []byte, maxSize int) (*PushRequest, error) {
+	// snappy.Decode() allocates the decoded length announced by the header:
+	// check it first.
+	size, err := snappy.DecodedLen(body)
+	if err == nil && maxSize > 0 && size > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes after snappy decoding (limit: %d)", errMessageTooLarge, size, maxSize)
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+			return nil, fmt.Errorf("snappy decoding failed (for a JSON body, set Content-Type: application/json): %w", err)
+		}
+		return nil, fmt.Errorf("snappy decoding failed: %w", err)
+	}
+	var pbr pbPushRequest
+	if err := proto.Unmarshal(data, &pbr); err != nil {
+		return nil, fmt.Errorf("protobuf decoding failed: %w", err)
+	}
+
+	pr := &PushRequest{Streams: make([]Stream, 0, len(pbr.Streams))}
+	for i, ps := range pbr.Streams {
+		lbls, err := parseLabels(ps.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("stream %d: %w", i, err)
+		}
+		s := Stream{Labels: lbls, Entries: make([]Entry, 0, len(ps.Entries))}
+		for j, pe := range ps.Entries {
+			var ts time.Time
+			if pe.Timestamp != nil {
+				ts, err = types.TimestampFromProto(pe.Timestamp)
+				if err != nil {
+					return nil, fmt.Errorf("stream %d, entry %d: %w", i, j, err)
+				}
+			}
+			s.Entries = append(s.Entries, Entry{Timestamp: ts, Line: pe.Line})
+		}
+		pr.Streams = append(pr.Streams, s)
+	}
+	return pr, nil
+}
+
+func encodeProtobuf(pr *PushRequest) ([]byte, error) {
+	pbr := pbPushRequest{Streams: make([]*pbStream, 0, len(pr.Streams))}
+	for _, s := range pr.Streams {
+		ps := &pbStream{Labels: s.Labels.String(), Entries: make([]*pbEntry, 0, len(s.Entries))}
+		for _, e := range s.Entries {
+			ts, err := types.TimestampProto(e.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+			ps.Entries = append(ps.Entries, &pbEntry{Timestamp: ts, Line: e.Line})
+		}
+		pbr.Streams = append(pbr.Streams, ps)
+	}
+	data, err := proto.Marshal(&pbr)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+/*
+Describe a stream in error messages by its position in the request and its
+labels, shortened to `maxLabelsLength` bytes: label sets can be large.
+*/
+func describeStream(i int, s *Stream) string {
+	const maxLabelsLength = 100
+	lbls := s.Labels.String()
+	if len(lbls) > maxLabelsLength {
+		lbls = truncate(lbls, maxLabelsLength) + "...}"
+	}
+	return fmt.Sprintf("stream %d %s", i, lbls)
+}
+
+// Truncate `s` to at most `n` bytes, without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Parse a label set in the PromQL syntax, such as `{app="api", env="prod"}`.
+func parseLabels(s string) (labels.Labels, error) {
+	matchers, err := selector.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad labels: %w", err)
+	}
+	lbls := make(labels.Labels, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Type != labels.MatchEqual {
+			return nil, fmt.Errorf("bad labels %s: unexpected operator %s", s, m.Type)
+		}
+		lbls = append(lbls, labels.Label{Name: m.Name, Value: m.Value})
+	}
+	return labels.New(lbls...), nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lokipush
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	rejectedPushRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loki_push_rejected_requests_total",
+		Help: "Number of Loki push requests rejected because they exceed a limit of the tenant, or cannot be decoded.",
+	}, []string{"tenant", "limit"})
+
+	truncatedLinesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loki_push_truncated_lines_total",
+		Help: "Number of pushed log lines truncated to the maximum line size of the tenant.",
+	}, []string{"tenant"})
+
+	futureTimestampsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loki_push_future_timestamps_total",
+		Help: "Number of pushed log entries with a timestamp too far in the future, set to the current time.",
+	}, []string{"tenant"})
+)
+
+// Names of the limits, used in the `limit` label of the metric.
+const (
+	limitDecode          = "decode"
+	limitMessageSize     = "max_message_size"
+	limitStreams         = "max_streams_per_request"
+	limitLabels          = "max_label_names_per_stream"
+	limitLabelNameLength = "max_label_name_length"
+	limitLabelValLength  = "max_label_value_length"
+	limitLineSize        = "max_line_size"
+)
+
+/*
+Limits are the limits for the push requests of a single tenant. A maximum of
+zero means unlimited.
+
+Lines longer than MaxLineSize are rejected, or truncated if TruncateLines is
+set. Entries with a timestamp more than MaxFuture ahead of the current time
+are set to the current time: Loki would reject them.
+*/
+type Limits struct {
+	MaxStreamsPerRequest   int           `yaml:"max_streams_per_request"`
+	MaxLabelNamesPerStream int           `yaml:"max_label_names_per_stream"`
+	MaxLabelNameLength     int           `yaml:"max_label_name_length"`
+	MaxLabelValueLength    int           `yaml:"max_label_value_length"`
+	MaxLineSize            int           `yaml:"max_line_size"`
+	TruncateLines          bool          `yaml:"truncate_lines"`
+	MaxFuture              time.Duration `yaml:"max_future"`
+}
+
+/*
+LimitsConfig is the YAML push limits configuration. `Default` applies to
+tenants not listed in `Tenants`. An entry in `Tenants` replaces the default as
+a whole. Example:
+
+	default:
+	  max_streams_per_request: 1000
+	  max_label_names_per_stream: 15
+	  max_label_name_length: 1024
+	  max_label_value_length: 2048
+	  max_line_size: 262144
+	  max_future: 10m
+	tenants:
+	  dev:
+	    max_line_size: 65536
+	    truncate_lines: true
+*/
+type LimitsConfig struct {
+	Default Limits            `yaml:"default"`
+	Tenants map[string]Limits `yaml:"tenants"`
+}
+
+func (c *LimitsConfig) limitsFor(tenantName string) Limits {
+	if l, ok := c.Tenants[tenantName]; ok {
+		return l
+	}
+	return c.Default
+}
+
+func ParseLimitsConfig(data []byte) (*LimitsConfig, error) {
+	var cfg LimitsConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("bad Loki push limits config: %w", err)
+	}
+	for tenant, l := range cfg.Tenants {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("bad Loki push limits config for tenant %s: %w", tenant, err)
+		}
+	}
+	if err := cfg.Default.validate(); err != nil {
+		return nil, fmt.Errorf("bad default Loki push limits config: %w", err)
+	}
+	return &cfg, nil
+}
+
+func (l Limits) validate() error {
+	if l.MaxStreamsPerRequest < 0 || l.MaxLabelNamesPerStream < 0 || l.MaxLabelNameLength < 0 ||
+		l.MaxLabelValueLength < 0 || l.MaxLineSize < 0 || l.MaxFuture < 0 {
+		return fmt.Errorf("maximums must not be negative")
+	}
+	if l.TruncateLines && l.MaxLineSize == 0 {
+		return fmt.Errorf("truncate_lines requires max_line_size")
+	}
+	return nil
+}
+
+// A violated limit. The message is meant for the client.
+type limitError struct {
+	limit string
+	msg   string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+func newLimitError(limit string, format string, a ...interface{}) *limitError {
+	return &limitError{limit: limit, msg: fmt.Sprintf(format, a...)}
+}
+
+// Check the streams of `pr` against the limits. Return an error describing
+// the first violation.
+func (l Limits) check(pr *PushRequest) *limitError {
+	if l.MaxStreamsPerRequest > 0 && len(pr.Streams) > l.MaxStreamsPerRequest {
+		return newLimitError(limitStreams, "too many streams in request: %d (limit: %d), send smaller batches",
+			len(pr.Streams), l.MaxStreamsPerRequest)
+	}
+
+	for i := range pr.Streams {
+		s := &pr.Streams[i]
+		if l.MaxLabelNamesPerStream > 0 && len(s.Labels) > l.MaxLabelNamesPerStream {
+			return newLimitError(limitLabels, "%s: too many labels: %d (limit: %d)",
+				describeStream(i, s), len(s.Labels), l.MaxLabelNamesPerStream)
+		}
+
+		for _, label := range s.Labels {
+			if l.MaxLabelNameLength > 0 && len(label.Name) > l.MaxLabelNameLength {
+				return newLimitError(limitLabelNameLength, "%s: label name too long: %d bytes (limit: %d)",
+					describeStream(i, s), len(label.Name), l.MaxLabelNameLength)
+			}
+			if l.MaxLabelValueLength > 0 && len(label.Value) > l.MaxLabelValueLength {
+				return newLimitError(limitLabelValLength, "%s: value of label %s too long: %d bytes (limit: %d)",
+					describeStream(i, s), label.Name, len(label.Value), l.MaxLabelValueLength)
+			}
+		}
+
+		if l.MaxLineSize > 0 && !l.TruncateLines {
+			for j, e := range s.Entries {
+				if len(e.Line) > l.MaxLineSize {
+					return newLimitError(limitLineSize,
+						"%s, entry %d (%s): line too long: %d bytes (limit: %d), split or shorten the line",
+						describeStream(i, s), j, e.Timestamp.Format(time.RFC3339Nano), len(e.Line), l.MaxLineSize)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Validator enforces per-tenant limits on the log streams in push requests, and
+normalizes their entries, so that clients get an actionable error message
+from the proxy instead of an error from the Loki distributor. See
+LimitsConfig.
+*/
+type Validator struct {
+	cfg *LimitsConfig
+	// For testing.
+	now func() time.Time
+}
+
+func NewValidator(cfg *LimitsConfig) *Validator {
+	return &Validator{cfg: cfg, now: time.Now}
+}
+
+// Create a validator configured from the YAML file at `path` (see
+// LimitsConfig).
+func NewValidatorFromFile(path string) (*Validator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseLimitsConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewValidator(cfg), nil
+}
+
+/*
+Check the push request `pr` of `tenantName` against the tenant's limits.
+Return an error describing the first violation. Otherwise truncate long lines
+and fix future timestamps in place, as configured, and return whether `pr`
+was modified. The entries of a stream with fixed timestamps are sorted again,
+as Loki expects them in time order.
+*/
+func (v *Validator) Validate(tenantName string, pr *PushRequest) (bool, error) {
+	limits := v.cfg.limitsFor(tenantName)
+	if lerr := limits.check(pr); lerr != nil {
+		rejectedPushRequestsTotal.WithLabelValues(tenantName, lerr.limit).Inc()
+		return false, lerr
+	}
+
+	now := v.now()
+	var maxTimestamp time.Time
+	if limits.MaxFuture > 0 {
+		maxTimestamp = now.Add(limits.MaxFuture)
+	}
+
+	truncated, fixed := 0, 0
+	for i := range pr.Streams {
+		entries := pr.Streams[i].Entries
+		fixedInStream := 0
+		for j := range entries {
+			e := &entries[j]
+			if limits.TruncateLines && len(e.Line) > limits.MaxLineSize {
+				e.Line = truncate(e.Line, limits.MaxLineSize)
+				truncated++
+			}
+			if !maxTimestamp.IsZero() && e.Timestamp.After(maxTimestamp) {
+				e.Timestamp = now
+				fixedInStream++
+			}
+		}
+		if fixedInStream > 0 {
+			// A fixed entry may now be older than the entries before it.
+			sort.SliceStable(entries, func(i, j int) bool {
+				return entries[i].Timestamp.Before(entries[j].Timestamp)
+			})
+			fixed += fixedInStream
+		}
+	}
+
+	truncatedLinesTotal.WithLabelValues(tenantName).Add(float64(truncated))
+	futureTimestampsTotal.WithLabelValues(tenantName).Add(float64(fixed))
+	return truncated > 0 || fixed > 0, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lokipush
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLimitsConfig = `
+default:
+  max_streams_per_request: 2
+  max_label_names_per_stream: 3
+  max_label_name_length: 10
+  max_label_value_length: 20
+  max_line_size: 8
+tenants:
+  lenient:
+    max_line_size: 4
+    truncate_lines: true
+    max_future: 10m
+`
+
+var testNow = time.Unix(1600000000, 0).UTC()
+
+// Create a stream from label name/value pairs, with a single entry.
+func stream(line string, nameValues ...string) Stream {
+	return Stream{Labels: labels.FromStrings(nameValues...), Entries: []Entry{{Timestamp: testNow, Line: line}}}
+}
+
+func newTestValidator(t *testing.T) *Validator {
+	cfg, err := ParseLimitsConfig([]byte(testLimitsConfig))
+	assert.NoError(t, err)
+	v := NewValidator(cfg)
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+func TestValidator_Validate(t *testing.T) {
+	v := newTestValidator(t)
+	ok := stream("line", "app", "api")
+
+	for _, tc := range []struct {
+		tenant  string
+		streams []Stream
+		err     string
+	}{
+		{"test", []Stream{ok, ok}, ""},
+		{"test", []Stream{ok, ok, ok}, "too many streams in request: 3 (limit: 2), send smaller batches"},
+		{"test", []Stream{ok, stream("line", "a", "1", "b", "2", "c", "3", "d", "4")},
+			`stream 1 {a="1", b="2", c="3", d="4"}: too many labels: 4 (limit: 3)`},
+		{"test", []Stream{stream("line", "averyverylongname", "1")},
+			`stream 0 {averyverylongname="1"}: label name too long: 17 bytes (limit: 10)`},
+		{"test", []Stream{stream("line", "path", strings.Repeat("x", 101))},
+			`stream 0 {path="` + strings.Repeat("x", 93) + `...}: value of label path too long: 101 bytes (limit: 20)`},
+		{"test", []Stream{stream("a long line", "app", "api")},
+			`stream 0 {app="api"}, entry 0 (2020-09-13T12:26:40Z): line too long: 11 bytes (limit: 8), ` +
+				`split or shorten the line`},
+		// The tenant entry replaces the default: no stream limit.
+		{"lenient", []Stream{ok, ok, ok}, ""},
+	} {
+		_, err := v.Validate(tc.tenant, &PushRequest{Streams: tc.streams})
+		if tc.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tc.err)
+		}
+	}
+}
+
+func TestValidator_Normalize(t *testing.T) {
+	v := newTestValidator(t)
+
+	pr := &PushRequest{Streams: []Stream{stream("line", "app", "api")}}
+	modified, err := v.Validate("lenient", pr)
+	assert.NoError(t, err)
+	assert.False(t, modified)
+
+	future := testNow.Add(time.Hour)
+	pr = &PushRequest{Streams: []Stream{{
+		Labels: labels.FromStrings("app", "api"),
+		Entries: []Entry{
+			{Timestamp: testNow.Add(5 * time.Minute), Line: "a long line"},
+			{Timestamp: future, Line: "héé"},
+		},
+	}}}
+	modified, err = v.Validate("lenient", pr)
+	assert.NoError(t, err)
+	assert.True(t, modified)
+	// The fixed entry is moved before the entry that stays in the future, so
+	// that Loki does not reject it as out of order.
+	assert.Equal(t, []Entry{
+		// Not truncated in the middle of "é".
+		{Timestamp: testNow, Line: "hé"},
+		{Timestamp: testNow.Add(5 * time.Minute), Line: "a lo"},
+	}, pr.Streams[0].Entries)
+}
+
+func TestParseLimitsConfig(t *testing.T) {
+	for _, bad := range []string{
+		"default:\n  max_line_size: -1\n",
+		"default:\n  truncate_lines: true\n",
+		"default:\n  max_future: soon\n",
+		"tenants:\n  test:\n    max_lines: 1\n",
+	} {
+		_, err := ParseLimitsConfig([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestPushFilter_Validate(t *testing.T) {
+	f := NewPushFilter(nil, newTestValidator(t))
+
+	// Valid: the body is left intact.
+	req := newTestPush("application/json", []byte(testJSONPush), "")
+	assert.NoError(t, f.FilterRequest("test", req))
+	body, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, testJSONPush, string(body))
+
+	// Normalized: the body is re-encoded in its format.
+	for _, contentType := range []string{"application/json", "application/x-protobuf"} {
+		pr, err := DecodePushRequest("application/json", []byte(testJSONPush))
+		assert.NoError(t, err)
+		body, err := EncodePushRequest(contentType, pr)
+		assert.NoError(t, err)
+
+		req = newTestPush(contentType, body, "")
+		assert.NoError(t, f.FilterRequest("lenient", req))
+		body, err = ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(body)), req.ContentLength)
+		pr, err = DecodePushRequest(contentType, body)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "line", pr.Streams[0].Entries[1].Line, contentType)
+		}
+	}
+
+	req = newTestPush("application/x-protobuf", []byte(testJSONPush), "")
+	assert.EqualError(t, f.FilterRequest("test", req), "bad push request: snappy decoding failed "+
+		"(for a JSON body, set Content-Type: application/json): snappy: corrupt input")
+}
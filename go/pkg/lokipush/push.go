@@ -0,0 +1,150 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lokipush
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/opstrace/opstrace/go/pkg/middleware"
+	"github.com/opstrace/opstrace/go/pkg/selector"
+)
+
+/*
+PushFilter processes the push requests sent through the Loki API proxy: it
+decodes each request once, checks it and, if needed, re-encodes it in its
+original format.
+
+With an enforcer, the streams pushed by a request restricted to a selector
+(see selector.Enforcer) must carry the labels of the selector, so that they
+can be read back with the same token. With a validator, the streams must be
+within the limits of the tenant, and their entries are normalized. Requests
+larger than the maximum message size, compressed or decompressed, are
+rejected before they are decoded.
+*/
+type PushFilter struct {
+	enforcer       *selector.Enforcer
+	validator      *Validator
+	maxMessageSize int
+}
+
+// Create a push filter. `enforcer` and `validator` may be nil.
+func NewPushFilter(enforcer *selector.Enforcer, validator *Validator) *PushFilter {
+	return &PushFilter{enforcer: enforcer, validator: validator, maxMessageSize: DefaultMaxMessageSize}
+}
+
+// Reject requests larger than `maxSize` bytes, compressed or decompressed
+// (default: DefaultMaxMessageSize). Zero means unlimited.
+func (f *PushFilter) MaxMessageSize(maxSize int) *PushFilter {
+	f.maxMessageSize = maxSize
+	return f
+}
+
+/*
+Decode and check the body of the push request `r` for `tenantName`. The body
+is only decoded if there is something to check. If the validator modified the
+streams, replace the request body. Otherwise leave the body intact for
+forwarding the request.
+
+The signature matches middleware.RequestFilter.
+*/
+func (f *PushFilter) FilterRequest(tenantName string, r *http.Request) error {
+	var matchers []*labels.Matcher
+	if f.enforcer != nil {
+		var err error
+		if matchers, err = f.enforcer.Matchers(tenantName, r); err != nil {
+			return err
+		}
+	}
+	if len(matchers) == 0 && f.validator == nil {
+		return nil
+	}
+
+	if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return &middleware.RequestError{
+			StatusCode: http.StatusUnsupportedMediaType,
+			Message:    fmt.Sprintf("unsupported Content-Encoding %s", enc),
+		}
+	}
+	body, err := readBody(r.Body, f.maxMessageSize)
+	if err != nil {
+		if errors.Is(err, errMessageTooLarge) {
+			return rejectDecode(tenantName, err)
+		}
+		return fmt.Errorf("reading request body failed: %w", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	contentType := r.Header.Get("Content-Type")
+	pr, err := decodePushRequest(contentType, body, f.maxMessageSize)
+	if err != nil {
+		return rejectDecode(tenantName, err)
+	}
+
+	if err := checkSelector(pr, matchers); err != nil {
+		return err
+	}
+
+	if f.validator == nil {
+		return nil
+	}
+	modified, err := f.validator.Validate(tenantName, pr)
+	if err != nil || !modified {
+		return err
+	}
+	body, err = EncodePushRequest(contentType, pr)
+	if err != nil {
+		return fmt.Errorf("encoding normalized push request failed: %w", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return nil
+}
+
+// Return the error rejecting a request of `tenantName` that cannot be decoded,
+// or is too large to be.
+func rejectDecode(tenantName string, err error) error {
+	if errors.Is(err, errMessageTooLarge) {
+		rejectedPushRequestsTotal.WithLabelValues(tenantName, limitMessageSize).Inc()
+		return &middleware.RequestError{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Message:    fmt.Sprintf("push request too large: %s", err),
+		}
+	}
+	rejectedPushRequestsTotal.WithLabelValues(tenantName, limitDecode).Inc()
+	return fmt.Errorf("bad push request: %w", err)
+}
+
+// Check that the labels of each stream of `pr` match `matchers`.
+func checkSelector(pr *PushRequest, matchers []*labels.Matcher) error {
+	for i := range pr.Streams {
+		s := &pr.Streams[i]
+		for _, m := range matchers {
+			if !m.Matches(s.Labels.Get(m.Name)) {
+				return &middleware.RequestError{
+					StatusCode: http.StatusForbidden,
+					Message: fmt.Sprintf("%s does not match the enforced selector %s",
+						describeStream(i, s), selector.Format(matchers)),
+				}
+			}
+		}
+	}
+	return nil
+}
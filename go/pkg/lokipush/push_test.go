@@ -0,0 +1,153 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lokipush
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+	"github.com/opstrace/opstrace/go/pkg/middleware"
+	"github.com/opstrace/opstrace/go/pkg/selector"
+)
+
+const testJSONPush = `{"streams": [
+	{"stream": {"app": "api", "team": "payments"},
+	 "values": [["1600000000000000001", "line 1"], ["1600000000000000002", "line 2"]]},
+	{"stream": {"app": "web", "team": "payments"}, "values": [["1600000000000000003", "line 3"]]}
+]}`
+
+func encodeTestProtobuf(t *testing.T, streams ...*pbStream) []byte {
+	data, err := proto.Marshal(&pbPushRequest{Streams: streams})
+	assert.NoError(t, err)
+	return snappy.Encode(nil, data)
+}
+
+func newTestPush(contentType string, body []byte, claim string) *http.Request {
+	req := httptest.NewRequest("POST", "http://localhost/loki/api/v1/push", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", contentType)
+	return req.WithContext(authenticator.WithTenant(req.Context(), authenticator.Tenant{Name: "test", Selector: claim}))
+}
+
+func TestDecodePushRequest(t *testing.T) {
+	pr, err := DecodePushRequest("application/json; charset=utf-8", []byte(testJSONPush))
+	assert.NoError(t, err)
+	if assert.Len(t, pr.Streams, 2) {
+		assert.Equal(t, labels.FromStrings("app", "api", "team", "payments"), pr.Streams[0].Labels)
+		assert.Equal(t, []Entry{
+			{Timestamp: time.Unix(0, 1600000000000000001).UTC(), Line: "line 1"},
+			{Timestamp: time.Unix(0, 1600000000000000002).UTC(), Line: "line 2"},
+		}, pr.Streams[0].Entries)
+	}
+
+	ts := time.Unix(1600000000, 5).UTC()
+	pbts, err := types.TimestampProto(ts)
+	assert.NoError(t, err)
+	body := encodeTestProtobuf(t, &pbStream{
+		Labels:  `{team="payments", app="api"}`,
+		Entries: []*pbEntry{{Timestamp: pbts, Line: "line 1"}},
+	})
+	pr, err = DecodePushRequest("application/x-protobuf", body)
+	assert.NoError(t, err)
+	assert.Equal(t, &PushRequest{Streams: []Stream{{
+		Labels:  labels.FromStrings("app", "api", "team", "payments"),
+		Entries: []Entry{{Timestamp: ts, Line: "line 1"}},
+	}}}, pr)
+
+	for _, bad := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"application/json", []byte(`{"streams": [{"stream": {}, "values": [["now", "x"]]}]}`)},
+		{"application/json", []byte(`{"streams": [{"stream": {}, "values": [["1"]]}]}`)},
+		{"application/json", []byte(`{"streams": `)},
+		{"application/x-protobuf", []byte(testJSONPush)},
+		{"application/x-protobuf", encodeTestProtobuf(t, &pbStream{Labels: `{app=~"api"}`})},
+	} {
+		_, err := DecodePushRequest(bad.contentType, bad.body)
+		assert.Error(t, err, string(bad.body))
+	}
+}
+
+func TestPushFilter_Selector(t *testing.T) {
+	f := NewPushFilter(selector.NewEnforcer(nil), nil)
+
+	// The body is left intact.
+	req := newTestPush("application/json", []byte(testJSONPush), `{team="payments"}`)
+	assert.NoError(t, f.FilterRequest("test", req))
+	body, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, testJSONPush, string(body))
+
+	req = newTestPush("application/json", []byte(testJSONPush), `{team="payments", app="api"}`)
+	err = f.FilterRequest("test", req)
+	var rerr *middleware.RequestError
+	if assert.True(t, errors.As(err, &rerr)) {
+		assert.Equal(t, 403, rerr.StatusCode)
+		assert.Equal(t, `stream 1 {app="web", team="payments"} does not match the enforced selector `+
+			`{team="payments", app="api"}`, rerr.Message)
+	}
+
+	req = newTestPush("application/x-protobuf", encodeTestProtobuf(t, &pbStream{Labels: `{app="api"}`}),
+		`{team="payments"}`)
+	assert.True(t, errors.As(f.FilterRequest("test", req), &rerr))
+
+	// Unrestricted requests are not decoded.
+	req = newTestPush("application/json", []byte("not JSON"), "")
+	assert.NoError(t, f.FilterRequest("test", req))
+
+	req = newTestPush("application/json", []byte("not JSON"), `{team="payments"}`)
+	assert.Error(t, f.FilterRequest("test", req))
+
+	req = newTestPush("application/json", []byte(testJSONPush), `{team="payments"}`)
+	req.Header.Set("Content-Encoding", "br")
+	if assert.True(t, errors.As(f.FilterRequest("test", req), &rerr)) {
+		assert.Equal(t, 415, rerr.StatusCode)
+	}
+}
+
+func TestPushFilter_MaxMessageSize(t *testing.T) {
+	f := NewPushFilter(nil, NewValidator(&LimitsConfig{})).MaxMessageSize(1000)
+
+	req := newTestPush("application/json", []byte(testJSONPush), "")
+	assert.NoError(t, f.FilterRequest("test", req))
+
+	var rerr *middleware.RequestError
+	req = newTestPush("application/json", []byte(strings.Repeat(" ", 1001)), "")
+	if assert.True(t, errors.As(f.FilterRequest("test", req), &rerr)) {
+		assert.Equal(t, 413, rerr.StatusCode)
+	}
+
+	// A snappy header announcing 2 GiB is rejected without decoding.
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, 1<<31)
+	req = newTestPush("application/x-protobuf", append(header[:n], 0, 0, 0), "")
+	if assert.True(t, errors.As(f.FilterRequest("test", req), &rerr)) {
+		assert.Equal(t, 413, rerr.StatusCode)
+		assert.Contains(t, rerr.Message, "2147483648 bytes after snappy decoding (limit: 1000)")
+	}
+}
@@ -15,6 +15,9 @@
 package middleware
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -55,6 +58,9 @@ import (
 // either from the  tenant API authentication token, or from a custom
 // "X-Scope-OrgID" header if disableAPIAuthentication is true.
 //
+// In the multi-tenant setting (`tenantName` is nil), RestrictTenants() limits
+// the set of tenants that requests are accepted for.
+//
 // If backendPathReplacement is non-nil, then it is expected to be a function.
 // It will be invoked with the request URL, and the request Path and RawPath
 // (respectively) will be updated with its return values. This is to allow e.g.
@@ -65,6 +71,31 @@ type TenantReverseProxy struct {
 	backendURL               *url.URL
 	revproxy                 *httputil.ReverseProxy
 	disableAPIAuthentication bool
+	allowedTenants           *TenantAllowList
+	rateLimiter              *RateLimiter
+	rateLimitedStatusCode    int
+	requestFilters           []RequestFilter
+}
+
+/*
+RequestFilter inspects a request for `tenantName` before it is forwarded to
+the backend, and may modify it (e.g. replace its URL query or body). The
+authenticated tenant is also available via authenticator.TenantFromContext().
+
+Returning an error rejects the request, with the error message as response
+body. The response status is 400, or that of a *RequestError.
+*/
+type RequestFilter func(tenantName string, r *http.Request) error
+
+// RequestError is returned by a RequestFilter to reject a request with a
+// status code other than 400.
+type RequestError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
 }
 
 func NewReverseProxyFixedTenant(
@@ -73,11 +104,11 @@ func NewReverseProxyFixedTenant(
 	backendURL *url.URL,
 	disableAPIAuthentication bool) *TenantReverseProxy {
 	trp := &TenantReverseProxy{
-		&tenantName,
-		headerName,
-		backendURL,
-		httputil.NewSingleHostReverseProxy(backendURL),
-		disableAPIAuthentication,
+		tenantName:               &tenantName,
+		headerName:               headerName,
+		backendURL:               backendURL,
+		revproxy:                 httputil.NewSingleHostReverseProxy(backendURL),
+		disableAPIAuthentication: disableAPIAuthentication,
 	}
 	trp.revproxy.ErrorHandler = proxyErrorHandler
 	if backendURL.Path != "" && backendURL.Path != "/" {
@@ -91,11 +122,10 @@ func NewReverseProxyDynamicTenant(
 	backendURL *url.URL,
 	disableAPIAuthentication bool) *TenantReverseProxy {
 	trp := &TenantReverseProxy{
-		nil,
-		headerName,
-		backendURL,
-		httputil.NewSingleHostReverseProxy(backendURL),
-		disableAPIAuthentication,
+		headerName:               headerName,
+		backendURL:               backendURL,
+		revproxy:                 httputil.NewSingleHostReverseProxy(backendURL),
+		disableAPIAuthentication: disableAPIAuthentication,
 	}
 	trp.revproxy.ErrorHandler = proxyErrorHandler
 	if backendURL.Path != "" && backendURL.Path != "/" {
@@ -142,6 +172,28 @@ func pathReplacementDirector(backendURL *url.URL, reqPathReplacement func(*url.U
 	}
 }
 
+// Only accept requests for tenants on `allowedTenants`. Requests for other
+// tenants are rejected with a 401 response, even if authenticated.
+func (trp *TenantReverseProxy) RestrictTenants(allowedTenants *TenantAllowList) *TenantReverseProxy {
+	trp.allowedTenants = allowedTenants
+	return trp
+}
+
+// Enforce the per-tenant rate limits of `rateLimiter`. Respond to requests
+// exceeding a limit with `statusCode` (such as 429), without forwarding them.
+func (trp *TenantReverseProxy) LimitRate(rateLimiter *RateLimiter, statusCode int) *TenantReverseProxy {
+	trp.rateLimiter = rateLimiter
+	trp.rateLimitedStatusCode = statusCode
+	return trp
+}
+
+// Apply `filter` to requests that passed authentication and rate limiting.
+// Filters run in the order in which they were added.
+func (trp *TenantReverseProxy) FilterRequests(filter RequestFilter) *TenantReverseProxy {
+	trp.requestFilters = append(trp.requestFilters, filter)
+	return trp
+}
+
 // Updates the internal ReverseProxy to apply the provided conversion against responses before sending
 // them back to the client. This does not apply when e.g. the proxy is failing to reach the backend.
 func (trp *TenantReverseProxy) ReplaceResponses(f func(req *http.Response) error) *TenantReverseProxy {
@@ -150,17 +202,99 @@ func (trp *TenantReverseProxy) ReplaceResponses(f func(req *http.Response) error
 }
 
 func (trp *TenantReverseProxy) HandleWithProxy(w http.ResponseWriter, r *http.Request) {
-	tenantName, ok := authenticator.GetTenantNameOr401(w, r, trp.tenantName, trp.disableAPIAuthentication)
+	trp.handleWithProxy(w, r)
+}
+
+// HandleWithProxyRequiringScope returns a handler that behaves like
+// HandleWithProxy, but additionally requires the authentication token to grant
+// `scopes`. A 403 response is emitted for a valid token lacking a scope.
+// Scopes are not checked when API authentication is disabled.
+func (trp *TenantReverseProxy) HandleWithProxyRequiringScope(scopes ...authenticator.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trp.handleWithProxy(w, r, scopes...)
+	}
+}
+
+func (trp *TenantReverseProxy) handleWithProxy(w http.ResponseWriter, r *http.Request, scopes ...authenticator.Scope) {
+	tenant, ok := authenticator.GetTenantOr401(
+		w, r, trp.tenantName, trp.disableAPIAuthentication, scopes...)
 	if !ok {
 		// Error response has already been written. Terminate request handling.
 		return
 	}
+	tenantName := tenant.Name
+
+	if trp.allowedTenants != nil && !trp.allowedTenants.Allowed(tenantName) {
+		// Error response is written by ExitUnknownTenant(). Terminate request handling.
+		authenticator.ExitUnknownTenant(w, tenantName)
+		return
+	}
+
+	if trp.rateLimiter != nil && !trp.allowRate(w, r, tenantName) {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	if len(trp.requestFilters) > 0 {
+		r = r.WithContext(authenticator.WithTenant(r.Context(), tenant))
+	}
+	for _, filter := range trp.requestFilters {
+		if err := filter(tenantName, r); err != nil {
+			statusCode := http.StatusBadRequest
+			var rerr *RequestError
+			if errors.As(err, &rerr) {
+				statusCode = rerr.StatusCode
+			}
+			log.Debugf("emit %d: request for tenant %s rejected: %s", statusCode, tenantName, err)
+			w.WriteHeader(statusCode)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
 
 	// Add the tenant in the request header and then forward the request to the backend.
 	r.Header.Set(trp.headerName, tenantName)
 	trp.revproxy.ServeHTTP(w, r)
 }
 
+/*
+Apply the rate limits to the request. The size of the request is taken from
+the Content-Length header. Without it, the request is admitted as far as the
+tenant has bytes left, and the bytes of the body are accounted for while it is
+streamed to the backend. Write the error response and return false if a limit
+is exceeded.
+*/
+func (trp *TenantReverseProxy) allowRate(w http.ResponseWriter, r *http.Request, tenantName string) bool {
+	size := r.ContentLength
+	if size < 0 {
+		size = 0
+		r.Body = &chargedBody{ReadCloser: r.Body, rateLimiter: trp.rateLimiter, tenantName: tenantName}
+	}
+
+	if exceeded := trp.rateLimiter.Allow(tenantName, size); exceeded != "" {
+		log.Debugf("emit %d: tenant %s exceeded %s rate limit", trp.rateLimitedStatusCode, tenantName, exceeded)
+		w.WriteHeader(trp.rateLimitedStatusCode)
+		fmt.Fprintf(w, "rate limit exceeded (%s) for tenant %s", exceeded, tenantName)
+		return false
+	}
+	return true
+}
+
+// A request body charging the bytes read to the rate limits of a tenant.
+type chargedBody struct {
+	io.ReadCloser
+	rateLimiter *RateLimiter
+	tenantName  string
+}
+
+func (b *chargedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.rateLimiter.Charge(b.tenantName, int64(n))
+	}
+	return n, err
+}
+
 func proxyErrorHandler(resp http.ResponseWriter, r *http.Request, proxyerr error) {
 	// Native error handler behavior: set status and log
 	resp.WriteHeader(http.StatusBadGateway)
@@ -25,6 +25,8 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
 )
 
 const tenantName string = "test"
@@ -206,3 +208,46 @@ func TestReverseProxyAuthenticator_badtoken(t *testing.T) {
 	// Confirm that a helpful error message is in the body.
 	assert.Equal(t, "bad authentication token", GetStrippedBody(resp))
 }
+
+func TestReverseProxy_requiringScopeAuthDisabled(t *testing.T) {
+	upstreamURL, upstreamClose := createUpstreamTenantEcho(tenantName, t)
+	defer upstreamClose()
+
+	// With API authentication disabled there is no token to carry scopes:
+	// expect the request to be proxied.
+	disableAPIAuth := true
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, disableAPIAuth)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/push", nil)
+	w := httptest.NewRecorder()
+	rp.HandleWithProxyRequiringScope(authenticator.ScopeMetricsWrite)(w, req)
+	resp := w.Result()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/api/v1/push test", GetStrippedBody(resp))
+}
+
+func TestReverseProxy_filterRequests(t *testing.T) {
+	upstreamURL, upstreamClose := createUpstreamTenantEcho(tenantName, t)
+	defer upstreamClose()
+
+	disableAPIAuth := true
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, disableAPIAuth).
+		FilterRequests(func(tenant string, r *http.Request) error {
+			if r.URL.Query().Get("reject") != "" {
+				return fmt.Errorf("rejected for tenant %s", tenant)
+			}
+			return nil
+		})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/push", nil)
+	w := httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "http://localhost/api/v1/push?reject=1", nil)
+	w = httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	resp := w.Result()
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Equal(t, "rejected for tenant test", GetStrippedBody(resp))
+}
@@ -0,0 +1,311 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var rateLimitedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tenant_ratelimit_exceeded_total",
+	Help: "Number of requests rejected because the tenant exceeded a rate limit.",
+}, []string{"tenant", "limit"})
+
+// RateLimits are the limits for a single tenant. A rate of zero means
+// unlimited. A burst of zero means one second worth of the rate.
+type RateLimits struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	RequestsBurst     float64 `yaml:"requests_burst"`
+	BytesPerSecond    float64 `yaml:"bytes_per_second"`
+	BytesBurst        float64 `yaml:"bytes_burst"`
+}
+
+/*
+RateLimitConfig is the YAML rate limit configuration. `Default` applies to
+tenants not listed in `Tenants`. An entry in `Tenants` replaces the default as
+a whole. Example:
+
+	default:
+	  requests_per_second: 100
+	  bytes_per_second: 10485760
+	tenants:
+	  prod:
+	    requests_per_second: 1000
+	    requests_burst: 2000
+	    bytes_per_second: 104857600
+*/
+type RateLimitConfig struct {
+	Default RateLimits            `yaml:"default"`
+	Tenants map[string]RateLimits `yaml:"tenants"`
+}
+
+func (c *RateLimitConfig) limitsFor(tenantName string) RateLimits {
+	if l, ok := c.Tenants[tenantName]; ok {
+		return l
+	}
+	return c.Default
+}
+
+func ParseRateLimitConfig(data []byte) (*RateLimitConfig, error) {
+	var cfg RateLimitConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("bad rate limit config: %w", err)
+	}
+	for tenant, l := range cfg.Tenants {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("bad rate limit config for tenant %s: %w", tenant, err)
+		}
+	}
+	if err := cfg.Default.validate(); err != nil {
+		return nil, fmt.Errorf("bad default rate limit config: %w", err)
+	}
+	return &cfg, nil
+}
+
+func (l RateLimits) validate() error {
+	if l.RequestsPerSecond < 0 || l.RequestsBurst < 0 || l.BytesPerSecond < 0 || l.BytesBurst < 0 {
+		return fmt.Errorf("rates and bursts must not be negative")
+	}
+	return nil
+}
+
+// A token bucket: holds up to `burst` tokens, refilled at `rate` tokens per
+// second. A rate of zero means unlimited.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	if burst == 0 {
+		burst = rate
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Whether `n` tokens are available. A request larger than the burst is
+// admitted when the bucket is full, so that it is not rejected forever.
+func (b *tokenBucket) available(n float64) bool {
+	if b.rate == 0 {
+		return true
+	}
+	if n > b.burst {
+		n = b.burst
+	}
+	return b.tokens >= n
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b.rate != 0 {
+		b.tokens -= n
+	}
+}
+
+// Apply a new rate and burst, keeping the tokens that fit into the new burst.
+// A bucket that was unlimited starts full.
+func (b *tokenBucket) resize(rate float64, burst float64, now time.Time) {
+	b.refill(now)
+	if burst == 0 {
+		burst = rate
+	}
+	if b.rate == 0 {
+		b.tokens = burst
+	}
+	b.rate = rate
+	b.burst = burst
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+type tenantBuckets struct {
+	requests *tokenBucket
+	bytes    *tokenBucket
+}
+
+/*
+RateLimiter enforces per-tenant request and byte rate limits using token
+buckets. It is safe for concurrent use. The configuration can be replaced at
+runtime (see `SetConfig()`).
+*/
+type RateLimiter struct {
+	mu      sync.Mutex
+	cfg     *RateLimitConfig
+	buckets map[string]*tenantBuckets
+	// For testing.
+	now  func() time.Time
+	stop chan struct{}
+}
+
+func NewRateLimiter(cfg *RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		cfg:     cfg,
+		buckets: make(map[string]*tenantBuckets),
+		now:     time.Now,
+		stop:    make(chan struct{}),
+	}
+}
+
+/*
+Create a rate limiter configured from the YAML file at `path` (see
+RateLimitConfig). If reading the file fails, return the error. Otherwise
+re-read the file every `interval` (until `Close()` is called) and apply the
+configuration if it changed. If the changed file is invalid, log an error and
+keep the previous configuration.
+*/
+func NewRateLimiterFromFile(path string, interval time.Duration) (*RateLimiter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseRateLimitConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rl := NewRateLimiter(cfg)
+	go rl.watchFile(path, data, interval)
+	return rl, nil
+}
+
+/*
+Replace the configuration. The existing buckets are resized to the new limits
+and keep their tokens, so that a reload neither refills the buckets of tenants
+over their limits nor empties the others.
+*/
+func (rl *RateLimiter) SetConfig(cfg *RateLimitConfig) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.cfg = cfg
+	now := rl.now()
+	for tenantName, b := range rl.buckets {
+		l := cfg.limitsFor(tenantName)
+		b.requests.resize(l.RequestsPerSecond, l.RequestsBurst, now)
+		b.bytes.resize(l.BytesPerSecond, l.BytesBurst, now)
+	}
+}
+
+// Close stops watching the configuration file.
+func (rl *RateLimiter) Close() {
+	close(rl.stop)
+}
+
+/*
+Account for a request of `size` bytes for `tenantName`. Return an empty
+string if the request is within the tenant's limits. Otherwise return the
+exceeded limit ("requests" or "bytes"); the request is then not accounted
+for.
+*/
+func (rl *RateLimiter) Allow(tenantName string, size int64) string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b := rl.bucketsFor(tenantName)
+	exceeded := ""
+	if !b.requests.available(1) {
+		exceeded = "requests"
+	} else if !b.bytes.available(float64(size)) {
+		exceeded = "bytes"
+	}
+	if exceeded != "" {
+		rateLimitedRequestsTotal.WithLabelValues(tenantName, exceeded).Inc()
+		return exceeded
+	}
+
+	b.requests.take(1)
+	b.bytes.take(float64(size))
+	return ""
+}
+
+/*
+Account for `size` more bytes of a request of `tenantName` that was already
+admitted, for requests whose size is only known while reading the body. The
+bytes bucket can go below zero, so that the following requests of the tenant
+are rejected until it is refilled.
+*/
+func (rl *RateLimiter) Charge(tenantName string, size int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.bucketsFor(tenantName).bytes.take(float64(size))
+}
+
+// Return the refilled buckets of `tenantName`, created as needed. The caller
+// must hold `rl.mu`.
+func (rl *RateLimiter) bucketsFor(tenantName string) *tenantBuckets {
+	now := rl.now()
+	b, ok := rl.buckets[tenantName]
+	if !ok {
+		l := rl.cfg.limitsFor(tenantName)
+		b = &tenantBuckets{
+			requests: newTokenBucket(l.RequestsPerSecond, l.RequestsBurst, now),
+			bytes:    newTokenBucket(l.BytesPerSecond, l.BytesBurst, now),
+		}
+		rl.buckets[tenantName] = b
+	}
+	b.requests.refill(now)
+	b.bytes.refill(now)
+	return b
+}
+
+func (rl *RateLimiter) watchFile(path string, lastData []byte, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case <-ticker.C:
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Warnf("rate limit config: cannot read %s: %s", path, err)
+			continue
+		}
+		if bytes.Equal(data, lastData) {
+			continue
+		}
+		// Do not retry an invalid file until it changes again.
+		lastData = data
+
+		cfg, err := ParseRateLimitConfig(data)
+		if err != nil {
+			log.Errorf("rate limit config: error while reloading %s, keep previous config: %s", path, err)
+			continue
+		}
+		rl.SetConfig(cfg)
+		log.Infof("rate limit config: reloaded %s", path)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRateLimitConfig = `
+default:
+  requests_per_second: 1
+  requests_burst: 2
+tenants:
+  big:
+    bytes_per_second: 100
+`
+
+// Use a rate limiter with a fake clock. Return a function advancing it.
+func newTestRateLimiter(t *testing.T, config string) (*RateLimiter, func(time.Duration)) {
+	cfg, err := ParseRateLimitConfig([]byte(config))
+	assert.NoError(t, err)
+	rl := NewRateLimiter(cfg)
+	now := time.Unix(1600000000, 0)
+	rl.now = func() time.Time { return now }
+	return rl, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRateLimiter_Requests(t *testing.T) {
+	rl, advance := newTestRateLimiter(t, testRateLimitConfig)
+
+	// Burst of two requests, then one per second.
+	assert.Equal(t, "", rl.Allow("test", 10))
+	assert.Equal(t, "", rl.Allow("test", 10))
+	assert.Equal(t, "requests", rl.Allow("test", 10))
+	advance(500 * time.Millisecond)
+	assert.Equal(t, "requests", rl.Allow("test", 10))
+	advance(500 * time.Millisecond)
+	assert.Equal(t, "", rl.Allow("test", 10))
+
+	// Tenants have separate buckets.
+	assert.Equal(t, "", rl.Allow("other", 10))
+
+	// The tenant entry replaces the default: no request limit.
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "", rl.Allow("big", 1))
+	}
+}
+
+func TestRateLimiter_Bytes(t *testing.T) {
+	rl, advance := newTestRateLimiter(t, testRateLimitConfig)
+
+	assert.Equal(t, "", rl.Allow("big", 60))
+	assert.Equal(t, "bytes", rl.Allow("big", 60))
+	advance(200 * time.Millisecond)
+	assert.Equal(t, "", rl.Allow("big", 60))
+
+	// A request larger than the burst is admitted with a full bucket only.
+	assert.Equal(t, "bytes", rl.Allow("big", 1000))
+	advance(time.Second)
+	assert.Equal(t, "", rl.Allow("big", 1000))
+	assert.Equal(t, "bytes", rl.Allow("big", 1))
+}
+
+func TestRateLimiter_SetConfig(t *testing.T) {
+	rl, advance := newTestRateLimiter(t, testRateLimitConfig)
+
+	assert.Equal(t, "", rl.Allow("test", 1))
+	assert.Equal(t, "", rl.Allow("test", 1))
+	assert.Equal(t, "requests", rl.Allow("test", 1))
+
+	// The empty bucket is not refilled by a reload.
+	cfg, err := ParseRateLimitConfig([]byte("default:\n  requests_per_second: 1\n  requests_burst: 5\n"))
+	assert.NoError(t, err)
+	rl.SetConfig(cfg)
+	assert.Equal(t, "requests", rl.Allow("test", 1))
+	advance(time.Second)
+	assert.Equal(t, "", rl.Allow("test", 1))
+
+	// A previously unlimited bucket starts full.
+	assert.Equal(t, "", rl.Allow("big", 1))
+	cfg, err = ParseRateLimitConfig([]byte("default:\n  bytes_per_second: 10\n"))
+	assert.NoError(t, err)
+	rl.SetConfig(cfg)
+	assert.Equal(t, "", rl.Allow("big", 10))
+	assert.Equal(t, "bytes", rl.Allow("big", 1))
+}
+
+func TestParseRateLimitConfig_Invalid(t *testing.T) {
+	_, err := ParseRateLimitConfig([]byte("default:\n  request_per_second: 1\n"))
+	assert.Error(t, err)
+	_, err = ParseRateLimitConfig([]byte("tenants:\n  foo:\n    bytes_per_second: -1\n"))
+	assert.Error(t, err)
+}
+
+func TestRateLimiter_ReloadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimits.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("default:\n  requests_per_second: 1\n"), 0600))
+
+	rl, err := NewRateLimiterFromFile(path, 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer rl.Close()
+	assert.Equal(t, "", rl.Allow("test", 1))
+	assert.Equal(t, "requests", rl.Allow("test", 1))
+
+	// Invalid config: keep the previous one.
+	assert.NoError(t, ioutil.WriteFile(path, []byte("default: [\n"), 0600))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "requests", rl.Allow("test", 1))
+
+	// Remove the limit.
+	assert.NoError(t, ioutil.WriteFile(path, []byte("default: {}\n"), 0600))
+	assert.Eventually(t, func() bool {
+		return rl.Allow("test", 1) == ""
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestReverseProxy_LimitRate(t *testing.T) {
+	upstreamURL, upstreamClose := createUpstreamTenantEcho(tenantName, t)
+	defer upstreamClose()
+
+	rl, _ := newTestRateLimiter(t, "default:\n  requests_per_second: 1\n")
+	disableAPIAuth := true
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, disableAPIAuth).LimitRate(rl, 503)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader("data"))
+	w := httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader("data"))
+	w = httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	resp := w.Result()
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "rate limit exceeded (requests) for tenant test", GetStrippedBody(resp))
+}
+
+func TestReverseProxy_LimitRateChunked(t *testing.T) {
+	upstreamURL, upstreamClose := createUpstreamTenantEcho(tenantName, t)
+	defer upstreamClose()
+
+	rl, _ := newTestRateLimiter(t, "default:\n  bytes_per_second: 10\n")
+	disableAPIAuth := true
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, disableAPIAuth).LimitRate(rl, 503)
+
+	// Without Content-Length, the request is admitted and its body is
+	// charged while it is forwarded.
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader(strings.Repeat("x", 100)))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader("data"))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	resp := w.Result()
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "rate limit exceeded (bytes) for tenant test", GetStrippedBody(resp))
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+)
+
+/*
+TenantAllowList is the set of tenants that a multi-tenant proxy serves (see
+`TenantReverseProxy.RestrictTenants()`).
+
+The list is read from a source (a file, or the Hasura tenant table) at
+construction time, and then re-read periodically, so that tenants can be
+added or removed without restarting the proxy. If re-reading fails, the
+previous list remains active.
+*/
+type TenantAllowList struct {
+	mu      sync.RWMutex
+	tenants map[string]struct{}
+	fetch   func() ([]string, error)
+	stop    chan struct{}
+}
+
+/*
+Create an allow-list, populated by calling `fetch`. If that fails, return the
+error. Otherwise call `fetch` again every `interval` (until `Close()` is
+called).
+*/
+func NewTenantAllowList(fetch func() ([]string, error), interval time.Duration) (*TenantAllowList, error) {
+	l := &TenantAllowList{
+		tenants: make(map[string]struct{}),
+		fetch:   fetch,
+		stop:    make(chan struct{}),
+	}
+
+	tenants, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	l.Replace(tenants)
+
+	go l.run(interval)
+	return l, nil
+}
+
+// Create an allow-list from the file at `path`, see ReadTenantsFromFile().
+func NewTenantAllowListFromFile(path string, interval time.Duration) (*TenantAllowList, error) {
+	return NewTenantAllowList(func() ([]string, error) {
+		return ReadTenantsFromFile(path)
+	}, interval)
+}
+
+// Create an allow-list from the Hasura tenant table.
+func NewTenantAllowListFromGraphQL(access *graphql.GraphqlAccess, interval time.Duration) (*TenantAllowList, error) {
+	return NewTenantAllowList(func() ([]string, error) {
+		return FetchTenantsFromGraphQL(access)
+	}, interval)
+}
+
+/*
+Create the allow-list from the file at `path` if set, or else from the Hasura
+GraphQL API at `graphqlEndpoint` (authenticating with `graphqlSecret`). Return
+an error if neither or both are set.
+*/
+func NewTenantAllowListFromSource(
+	path string,
+	graphqlEndpoint string,
+	graphqlSecret string,
+	interval time.Duration,
+) (*TenantAllowList, error) {
+	switch {
+	case path != "" && graphqlEndpoint != "":
+		return nil, fmt.Errorf("tenant allow-list: set either a file or a GraphQL endpoint, not both")
+	case path != "":
+		log.Infof("tenant allow-list: read from %s every %s", path, interval)
+		return NewTenantAllowListFromFile(path, interval)
+	case graphqlEndpoint != "":
+		gqlurl, err := url.Parse(graphqlEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("bad GraphQL endpoint URL: %w", err)
+		}
+		log.Infof("tenant allow-list: fetch from %s every %s", gqlurl, interval)
+		return NewTenantAllowListFromGraphQL(graphql.NewGraphqlAccess(gqlurl, graphqlSecret), interval)
+	default:
+		return nil, fmt.Errorf("tenant allow-list: neither a file nor a GraphQL endpoint set")
+	}
+}
+
+/*
+Multi-tenant mode: return a function creating proxies that serve any tenant on
+`allowedTenants`, for the backend at the given URL and with the tenant name in
+the given request header. The allow-list is shared by all proxies.
+*/
+func NewMultiTenantProxyFactory(
+	allowedTenants *TenantAllowList,
+	disableAPIAuthentication bool,
+) func(string, *url.URL) *TenantReverseProxy {
+	return func(headerName string, backendURL *url.URL) *TenantReverseProxy {
+		return NewReverseProxyDynamicTenant(
+			headerName,
+			backendURL,
+			disableAPIAuthentication,
+		).RestrictTenants(allowedTenants)
+	}
+}
+
+// Allowed returns whether `tenantName` is on the list.
+func (l *TenantAllowList) Allowed(tenantName string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.tenants[tenantName]
+	return ok
+}
+
+// Replace swaps the current set of tenants for `tenants`, and logs each
+// tenant that has been added or removed.
+func (l *TenantAllowList) Replace(tenants []string) {
+	next := make(map[string]struct{}, len(tenants))
+	for _, t := range tenants {
+		next[t] = struct{}{}
+	}
+
+	l.mu.Lock()
+	prev := l.tenants
+	l.tenants = next
+	l.mu.Unlock()
+
+	for _, t := range sortedTenants(next) {
+		if _, known := prev[t]; !known {
+			log.Infof("tenant allow-list: added tenant %s", t)
+		}
+	}
+	for _, t := range sortedTenants(prev) {
+		if _, kept := next[t]; !kept {
+			log.Infof("tenant allow-list: removed tenant %s", t)
+		}
+	}
+}
+
+// Close stops refreshing the list.
+func (l *TenantAllowList) Close() {
+	close(l.stop)
+}
+
+func (l *TenantAllowList) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		tenants, err := l.fetch()
+		if err != nil {
+			log.Warnf("error while refreshing tenant allow-list, keep previous list: %s", err)
+			continue
+		}
+		l.Replace(tenants)
+	}
+}
+
+func sortedTenants(tenants map[string]struct{}) []string {
+	names := make([]string, 0, len(tenants))
+	for t := range tenants {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Read tenant names from the file at `path`: one per line. Leading and trailing
+whitespace is ignored, as are empty lines and lines starting with `#`.
+*/
+func ReadTenantsFromFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tenants []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tenants = append(tenants, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return tenants, nil
+}
+
+// Fetch the names of all tenants from the `tenant` table via the Hasura
+// GraphQL API.
+func FetchTenantsFromGraphQL(access *graphql.GraphqlAccess) ([]string, error) {
+	req, err := graphql.NewGetTenantsRequest(access.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp graphql.GetTenantsResponse
+	if err := access.Execute(req.Request, &resp); err != nil {
+		return nil, err
+	}
+
+	tenants := make([]string, 0, len(resp.Tenant))
+	for _, t := range resp.Tenant {
+		tenants = append(tenants, t.Name)
+	}
+	return tenants, nil
+}
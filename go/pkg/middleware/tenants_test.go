@@ -0,0 +1,119 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+)
+
+func TestReadTenantsFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("# tenants\ndefault\n\n  test \n"), 0600))
+
+	tenants, err := ReadTenantsFromFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default", "test"}, tenants)
+
+	_, err = ReadTenantsFromFile(filepath.Join(t.TempDir(), "nope"))
+	assert.Error(t, err)
+}
+
+func TestTenantAllowList_Refresh(t *testing.T) {
+	var calls int32
+	l, err := NewTenantAllowList(func() ([]string, error) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			return []string{"default"}, nil
+		case 2:
+			return nil, fmt.Errorf("unavailable")
+		default:
+			return []string{"test"}, nil
+		}
+	}, 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer l.Close()
+
+	assert.True(t, l.Allowed("default"))
+	assert.False(t, l.Allowed("test"))
+
+	// The failed refresh keeps the previous list, the next one replaces it.
+	assert.Eventually(t, func() bool {
+		return l.Allowed("test")
+	}, time.Second, 5*time.Millisecond)
+	assert.False(t, l.Allowed("default"))
+
+	_, err = NewTenantAllowList(func() ([]string, error) {
+		return nil, fmt.Errorf("unavailable")
+	}, time.Hour)
+	assert.Error(t, err)
+}
+
+func TestFetchTenantsFromGraphQL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("x-hasura-admin-secret"))
+		fmt.Fprint(w, `{"data": {"tenant": [{"name": "default"}, {"name": "system"}]}}`)
+	}))
+	defer srv.Close()
+
+	srvURL, err := url.Parse(srv.URL)
+	assert.NoError(t, err)
+	tenants, err := FetchTenantsFromGraphQL(graphql.NewGraphqlAccess(srvURL, "secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default", "system"}, tenants)
+}
+
+func TestReverseProxy_RestrictTenants(t *testing.T) {
+	upstreamURL, upstreamClose := createUpstreamTenantEcho(tenantName, t)
+	defer upstreamClose()
+
+	l, err := NewTenantAllowList(func() ([]string, error) {
+		return []string{tenantName}, nil
+	}, time.Hour)
+	assert.NoError(t, err)
+	defer l.Close()
+
+	// Authentication disabled: tenant read from the X-Scope-OrgID header.
+	disableAPIAuth := true
+	rp := NewReverseProxyDynamicTenant(tenantHeaderName, upstreamURL, disableAPIAuth).RestrictTenants(l)
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set(authenticator.TestTenantHeader, tenantName)
+	w := httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	resp := w.Result()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/api/v1/query test", GetStrippedBody(resp))
+
+	req = httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set(authenticator.TestTenantHeader, "other")
+	w = httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	resp = w.Result()
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "unknown tenant: other", GetStrippedBody(resp))
+}
@@ -63,7 +63,8 @@ func (e *oidcExtension) Shutdown(context.Context) error {
 func (e *oidcExtension) Authenticate(ctx context.Context, headers map[string][]string) (context.Context, error) {
 	// In HTTP the header is capitalized "Authorization"
 	// Meanwhile for gRPC the header is (apparently) lowercase "authorization"
-	err := authenticator.AuthenticateSpecificTenantByHeaderMap(headers, "authorization", e.cfg.TenantName)
+	err := authenticator.AuthenticateSpecificTenantByHeaderMap(
+		headers, "authorization", e.cfg.TenantName, authenticator.ScopeTracesWrite)
 	if err != nil {
 		return ctx, err
 	}
@@ -0,0 +1,134 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "remote_write_requests_total",
+	Help: "Number of write requests sent to remote_write endpoints, by result (success or failure).",
+}, []string{"remote_name", "url", "result"})
+
+// Maximum number of bytes of an error response kept in HTTPError.
+const maxErrorBodySize = 1024
+
+/*
+Client writes to a Prometheus remote_write endpoint, such as the Cortex
+distributor. `name` identifies the endpoint in logs and metrics. `headers`
+are set on each request, such as X-Scope-OrgID for the tenant.
+*/
+type Client struct {
+	name       string
+	url        string
+	headers    map[string]string
+	httpClient *http.Client
+	// The URL without credentials, for logs and metrics.
+	publicURL string
+}
+
+func NewClient(name string, url string, headers map[string]string, httpClient *http.Client) *Client {
+	return &Client{name: name, url: url, headers: headers, httpClient: httpClient, publicURL: stripUserinfo(url)}
+}
+
+func (c *Client) Name() string {
+	return c.name
+}
+
+// URL returns the URL of the endpoint without the user name and password it
+// may include.
+func (c *Client) URL() string {
+	return c.publicURL
+}
+
+func stripUserinfo(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	u.User = nil
+	return u.String()
+}
+
+// HTTPError is returned by Client.Store() for non-2xx responses.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("non-2xx HTTP response received from remote_write endpoint: %d, HTTP response body: %s",
+		e.StatusCode, e.Body)
+}
+
+// IsRecoverable returns whether retrying a write that failed with `err` may
+// succeed: after transport errors, 5xx and 429 responses.
+func IsRecoverable(err error) bool {
+	var herr *HTTPError
+	if !errors.As(err, &herr) {
+		return true
+	}
+	return herr.StatusCode >= 500 || herr.StatusCode == http.StatusTooManyRequests
+}
+
+// Store sends `body`, a snappy-compressed protobuf `WriteRequest` message (see
+// EncodeWriteRequest).
+func (c *Client) Store(ctx context.Context, body []byte) error {
+	err := c.store(ctx, body)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	requestsTotal.WithLabelValues(c.name, c.publicURL, result).Inc()
+	return err
+}
+
+func (c *Client) store(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Add("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodybytes, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return &HTTPError{StatusCode: resp.StatusCode, Body: string(bodybytes)}
+	}
+	// Read the body, so that the connection can be reused.
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
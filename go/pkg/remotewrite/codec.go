@@ -0,0 +1,111 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// DefaultMaxMessageSize is the default maximum size of a remote_write request,
+// compressed and decompressed: the default of Cortex'
+// -distributor.max-recv-msg-size.
+const DefaultMaxMessageSize = 100 << 20
+
+var errMessageTooLarge = errors.New("message too large")
+
+/*
+Read the body `r` of a request, unless it has more than `maxSize` bytes (0
+means unlimited): then return an error wrapping errMessageTooLarge, without
+reading further.
+*/
+func readBody(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", errMessageTooLarge, maxSize)
+	}
+	return body, nil
+}
+
+// DecodeWriteRequest decodes the body of a Prometheus remote_write request: a
+// snappy-compressed protobuf `WriteRequest` message of at most
+// DefaultMaxMessageSize bytes.
+func DecodeWriteRequest(body []byte) (*prompb.WriteRequest, error) {
+	return decodeWriteRequest(body, DefaultMaxMessageSize)
+}
+
+func decodeWriteRequest(body []byte, maxSize int) (*prompb.WriteRequest, error) {
+	// snappy.Decode() allocates the decoded length announced by the header:
+	// check it first.
+	size, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("snappy decoding failed: %w", err)
+	}
+	if maxSize > 0 && size > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes after snappy decoding (limit: %d)", errMessageTooLarge, size, maxSize)
+	}
+
+	pbmsgbytes, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("snappy decoding failed: %w", err)
+	}
+
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(pbmsgbytes, &wr); err != nil {
+		return nil, fmt.Errorf("protobuf decoding failed: %w", err)
+	}
+	return &wr, nil
+}
+
+// EncodeWriteRequest is the inverse of DecodeWriteRequest.
+func EncodeWriteRequest(wr *prompb.WriteRequest) ([]byte, error) {
+	pbmsgbytes, err := proto.Marshal(wr)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, pbmsgbytes), nil
+}
+
+// LabelValue returns the value of the label `name`, or an empty string if the
+// label is not set.
+func LabelValue(labels []prompb.Label, name string) string {
+	for _, l := range labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// Describe a series in error messages by its position in the request and its
+// metric name. The full label set is not used: it can be arbitrarily large.
+func describeSeries(i int, ts *prompb.TimeSeries) string {
+	if name := LabelValue(ts.Labels, "__name__"); name != "" {
+		return fmt.Sprintf("series %d (%s)", i, name)
+	}
+	return fmt.Sprintf("series %d", i)
+}
@@ -0,0 +1,206 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+)
+
+var rejectedWriteRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "remote_write_rejected_requests_total",
+	Help: "Number of remote_write requests rejected because they exceed a limit of the tenant, or cannot be decoded.",
+}, []string{"tenant", "limit"})
+
+// Names of the limits, used in the `limit` label of the metric.
+const (
+	limitDecode          = "decode"
+	limitMessageSize     = "max_message_size"
+	limitSeries          = "max_series_per_request"
+	limitLabels          = "max_labels_per_series"
+	limitLabelNameLength = "max_label_name_length"
+	limitLabelValLength  = "max_label_value_length"
+	limitRequiredLabel   = "required_labels"
+	limitForbiddenLabel  = "forbidden_labels"
+)
+
+// Limits are the limits for the remote_write requests of a single tenant. A
+// maximum of zero means unlimited.
+type Limits struct {
+	MaxSeriesPerRequest int      `yaml:"max_series_per_request"`
+	MaxLabelsPerSeries  int      `yaml:"max_labels_per_series"`
+	MaxLabelNameLength  int      `yaml:"max_label_name_length"`
+	MaxLabelValueLength int      `yaml:"max_label_value_length"`
+	RequiredLabels      []string `yaml:"required_labels"`
+	ForbiddenLabels     []string `yaml:"forbidden_labels"`
+}
+
+/*
+LimitsConfig is the YAML remote_write limits configuration. `Default` applies
+to tenants not listed in `Tenants`. An entry in `Tenants` replaces the default
+as a whole. Example:
+
+	default:
+	  max_series_per_request: 5000
+	  max_labels_per_series: 30
+	  max_label_name_length: 1024
+	  max_label_value_length: 2048
+	tenants:
+	  prod:
+	    max_series_per_request: 20000
+	    required_labels: [job]
+	    forbidden_labels: [pod_uid]
+*/
+type LimitsConfig struct {
+	Default Limits            `yaml:"default"`
+	Tenants map[string]Limits `yaml:"tenants"`
+}
+
+func (c *LimitsConfig) limitsFor(tenantName string) Limits {
+	if l, ok := c.Tenants[tenantName]; ok {
+		return l
+	}
+	return c.Default
+}
+
+func ParseLimitsConfig(data []byte) (*LimitsConfig, error) {
+	var cfg LimitsConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("bad remote_write limits config: %w", err)
+	}
+	for tenant, l := range cfg.Tenants {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("bad remote_write limits config for tenant %s: %w", tenant, err)
+		}
+	}
+	if err := cfg.Default.validate(); err != nil {
+		return nil, fmt.Errorf("bad default remote_write limits config: %w", err)
+	}
+	return &cfg, nil
+}
+
+func (l Limits) validate() error {
+	if l.MaxSeriesPerRequest < 0 || l.MaxLabelsPerSeries < 0 ||
+		l.MaxLabelNameLength < 0 || l.MaxLabelValueLength < 0 {
+		return fmt.Errorf("maximums must not be negative")
+	}
+	for _, name := range l.RequiredLabels {
+		for _, forbidden := range l.ForbiddenLabels {
+			if name == forbidden {
+				return fmt.Errorf("label %s is both required and forbidden", name)
+			}
+		}
+	}
+	return nil
+}
+
+// A violated limit. The message is meant for the client.
+type limitError struct {
+	limit string
+	msg   string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+func newLimitError(limit string, format string, a ...interface{}) *limitError {
+	return &limitError{limit: limit, msg: fmt.Sprintf(format, a...)}
+}
+
+// Check `wr` against the limits. Return an error describing the first
+// violation.
+func (l Limits) check(wr *prompb.WriteRequest) *limitError {
+	if l.MaxSeriesPerRequest > 0 && len(wr.Timeseries) > l.MaxSeriesPerRequest {
+		return newLimitError(limitSeries, "too many series in request: %d (limit: %d)",
+			len(wr.Timeseries), l.MaxSeriesPerRequest)
+	}
+
+	for i := range wr.Timeseries {
+		ts := &wr.Timeseries[i]
+		if l.MaxLabelsPerSeries > 0 && len(ts.Labels) > l.MaxLabelsPerSeries {
+			return newLimitError(limitLabels, "%s: too many labels: %d (limit: %d)",
+				describeSeries(i, ts), len(ts.Labels), l.MaxLabelsPerSeries)
+		}
+
+		for _, label := range ts.Labels {
+			if l.MaxLabelNameLength > 0 && len(label.Name) > l.MaxLabelNameLength {
+				// Do not echo the name: it is too long.
+				return newLimitError(limitLabelNameLength, "%s: label name too long: %d bytes (limit: %d)",
+					describeSeries(i, ts), len(label.Name), l.MaxLabelNameLength)
+			}
+			if l.MaxLabelValueLength > 0 && len(label.Value) > l.MaxLabelValueLength {
+				return newLimitError(limitLabelValLength, "%s: value of label %s too long: %d bytes (limit: %d)",
+					describeSeries(i, ts), label.Name, len(label.Value), l.MaxLabelValueLength)
+			}
+		}
+
+		for _, name := range l.RequiredLabels {
+			if LabelValue(ts.Labels, name) == "" {
+				return newLimitError(limitRequiredLabel, "%s: required label %s missing",
+					describeSeries(i, ts), name)
+			}
+		}
+		for _, name := range l.ForbiddenLabels {
+			if LabelValue(ts.Labels, name) != "" {
+				return newLimitError(limitForbiddenLabel, "%s: forbidden label %s set",
+					describeSeries(i, ts), name)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Validator enforces per-tenant limits on the series in remote_write requests,
+to stop e.g. cardinality explosions before they reach Cortex. See
+LimitsConfig.
+*/
+type Validator struct {
+	cfg *LimitsConfig
+}
+
+func NewValidator(cfg *LimitsConfig) *Validator {
+	return &Validator{cfg: cfg}
+}
+
+// Create a validator configured from the YAML file at `path` (see
+// LimitsConfig).
+func NewValidatorFromFile(path string) (*Validator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseLimitsConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewValidator(cfg), nil
+}
+
+// Check the remote_write request `wr` of `tenantName` against the tenant's
+// limits. Return an error describing the first violation.
+func (v *Validator) Validate(tenantName string, wr *prompb.WriteRequest) error {
+	if lerr := v.cfg.limitsFor(tenantName).check(wr); lerr != nil {
+		rejectedWriteRequestsTotal.WithLabelValues(tenantName, lerr.limit).Inc()
+		return lerr
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLimitsConfig = `
+default:
+  max_series_per_request: 2
+  max_labels_per_series: 3
+  max_label_name_length: 10
+  max_label_value_length: 20
+tenants:
+  strict:
+    required_labels: [job]
+    forbidden_labels: [pod_uid]
+`
+
+// Create a series from label name/value pairs.
+func series(nameValues ...string) prompb.TimeSeries {
+	ts := prompb.TimeSeries{Samples: []prompb.Sample{{Value: 1, Timestamp: 1600000000000}}}
+	for i := 0; i < len(nameValues); i += 2 {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: nameValues[i], Value: nameValues[i+1]})
+	}
+	return ts
+}
+
+func newTestValidator(t *testing.T) *Validator {
+	cfg, err := ParseLimitsConfig([]byte(testLimitsConfig))
+	assert.NoError(t, err)
+	return NewValidator(cfg)
+}
+
+func TestValidator_Validate(t *testing.T) {
+	v := newTestValidator(t)
+	ok := series("__name__", "up", "job", "node")
+
+	for _, tc := range []struct {
+		tenant string
+		series []prompb.TimeSeries
+		err    string
+	}{
+		{"test", []prompb.TimeSeries{ok, ok}, ""},
+		{"test", []prompb.TimeSeries{ok, ok, ok}, "too many series in request: 3 (limit: 2)"},
+		{"test", []prompb.TimeSeries{ok, series("__name__", "up", "a", "1", "b", "2", "c", "3")},
+			"series 1 (up): too many labels: 4 (limit: 3)"},
+		{"test", []prompb.TimeSeries{series("averyverylongname", "1")},
+			"series 0: label name too long: 17 bytes (limit: 10)"},
+		{"test", []prompb.TimeSeries{series("__name__", "up", "path", strings.Repeat("x", 21))},
+			"series 0 (up): value of label path too long: 21 bytes (limit: 20)"},
+		// The tenant entry replaces the default: no series limit.
+		{"strict", []prompb.TimeSeries{ok, ok, ok}, ""},
+		{"strict", []prompb.TimeSeries{series("__name__", "up")}, "series 0 (up): required label job missing"},
+		{"strict", []prompb.TimeSeries{series("__name__", "up", "job", "node", "pod_uid", "123")},
+			"series 0 (up): forbidden label pod_uid set"},
+	} {
+		err := v.Validate(tc.tenant, &prompb.WriteRequest{Timeseries: tc.series})
+		if tc.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tc.err)
+		}
+	}
+}
+
+func TestParseLimitsConfig_Invalid(t *testing.T) {
+	_, err := ParseLimitsConfig([]byte("default:\n  max_series: 1\n"))
+	assert.Error(t, err)
+	_, err = ParseLimitsConfig([]byte("tenants:\n  foo:\n    max_labels_per_series: -1\n"))
+	assert.Error(t, err)
+	_, err = ParseLimitsConfig([]byte("default:\n  required_labels: [job]\n  forbidden_labels: [job]\n"))
+	assert.Error(t, err)
+}
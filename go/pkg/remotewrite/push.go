@@ -0,0 +1,112 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/opstrace/opstrace/go/pkg/middleware"
+)
+
+/*
+PushFilter processes the remote_write requests pushed through the Cortex API
+proxy: it decodes each request once, relabels its series, and then validates
+them, according to the configuration of the request's tenant. Relabeling
+happens first, so that e.g. injected labels count as required labels.
+
+Either step is optional. Requests larger than the maximum message size,
+compressed or decompressed, are rejected before they are decoded.
+*/
+type PushFilter struct {
+	relabeler      *Relabeler
+	validator      *Validator
+	maxMessageSize int
+}
+
+// Create a push filter. `relabeler` and `validator` may be nil.
+func NewPushFilter(relabeler *Relabeler, validator *Validator) *PushFilter {
+	return &PushFilter{relabeler: relabeler, validator: validator, maxMessageSize: DefaultMaxMessageSize}
+}
+
+// Reject requests larger than `maxSize` bytes, compressed or decompressed
+// (default: DefaultMaxMessageSize). Zero means unlimited.
+func (f *PushFilter) MaxMessageSize(maxSize int) *PushFilter {
+	f.maxMessageSize = maxSize
+	return f
+}
+
+/*
+Decode the body of the remote_write request `r` for `tenantName`, relabel and
+validate it. Return an error if decoding or validation fails. If relabeling
+rules apply, replace the request body with the relabeled request. Otherwise
+leave the body intact for forwarding the request.
+
+The signature matches middleware.RequestFilter.
+*/
+func (f *PushFilter) FilterRequest(tenantName string, r *http.Request) error {
+	body, err := readBody(r.Body, f.maxMessageSize)
+	if err != nil {
+		if errors.Is(err, errMessageTooLarge) {
+			return rejectDecode(tenantName, err)
+		}
+		return fmt.Errorf("reading request body failed: %w", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	wr, err := decodeWriteRequest(body, f.maxMessageSize)
+	if err != nil {
+		return rejectDecode(tenantName, err)
+	}
+
+	relabeled := false
+	if f.relabeler != nil && f.relabeler.HasRules(tenantName) {
+		wr.Timeseries = f.relabeler.Relabel(tenantName, wr.Timeseries)
+		relabeled = true
+	}
+
+	if f.validator != nil {
+		if err := f.validator.Validate(tenantName, wr); err != nil {
+			return err
+		}
+	}
+
+	if relabeled {
+		body, err = EncodeWriteRequest(wr)
+		if err != nil {
+			return fmt.Errorf("encoding relabeled remote_write request failed: %w", err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	return nil
+}
+
+// Return the error rejecting a request of `tenantName` that cannot be decoded,
+// or is too large to be.
+func rejectDecode(tenantName string, err error) error {
+	if errors.Is(err, errMessageTooLarge) {
+		rejectedWriteRequestsTotal.WithLabelValues(tenantName, limitMessageSize).Inc()
+		return &middleware.RequestError{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Message:    fmt.Sprintf("remote_write request too large: %s", err),
+		}
+	}
+	rejectedWriteRequestsTotal.WithLabelValues(tenantName, limitDecode).Inc()
+	return fmt.Errorf("bad remote_write request: %w", err)
+}
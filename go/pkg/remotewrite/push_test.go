@@ -0,0 +1,115 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/middleware"
+)
+
+func newPushRequest(t *testing.T, series ...prompb.TimeSeries) (*http.Request, []byte) {
+	body, err := EncodeWriteRequest(&prompb.WriteRequest{Timeseries: series})
+	assert.NoError(t, err)
+	return httptest.NewRequest("POST", "http://localhost/api/v1/push", bytes.NewReader(body)), body
+}
+
+func TestPushFilter_Validate(t *testing.T) {
+	f := NewPushFilter(nil, newTestValidator(t))
+	rejected := func(limit string) float64 {
+		return testutil.ToFloat64(rejectedWriteRequestsTotal.WithLabelValues("test", limit))
+	}
+	decodeFailures := rejected(limitDecode)
+	seriesFailures := rejected(limitSeries)
+
+	ok := series("__name__", "up")
+	req, body := newPushRequest(t, ok)
+	assert.NoError(t, f.FilterRequest("test", req))
+
+	// The body is left intact for forwarding.
+	forwarded, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, forwarded)
+
+	req, _ = newPushRequest(t, ok, ok, ok)
+	assert.EqualError(t, f.FilterRequest("test", req), "too many series in request: 3 (limit: 2)")
+	assert.Equal(t, seriesFailures+1, rejected(limitSeries))
+
+	req = httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader("not snappy"))
+	err = f.FilterRequest("test", req)
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "bad remote_write request: snappy decoding failed"))
+	}
+	assert.Equal(t, decodeFailures+1, rejected(limitDecode))
+}
+
+func TestPushFilter_MaxMessageSize(t *testing.T) {
+	f := NewPushFilter(nil, nil).MaxMessageSize(1000)
+	tooLarge := func() float64 {
+		return testutil.ToFloat64(rejectedWriteRequestsTotal.WithLabelValues("test", limitMessageSize))
+	}
+	rejected := tooLarge()
+
+	req, _ := newPushRequest(t, series("__name__", "up"))
+	assert.NoError(t, f.FilterRequest("test", req))
+
+	// Compressed: larger than the limit.
+	req = httptest.NewRequest("POST", "http://localhost/api/v1/push", bytes.NewReader(make([]byte, 1001)))
+	err := f.FilterRequest("test", req)
+	var rerr *middleware.RequestError
+	if assert.True(t, errors.As(err, &rerr)) {
+		assert.Equal(t, 413, rerr.StatusCode)
+	}
+
+	// Decompressed: a snappy header announcing 2 GiB is rejected without
+	// decoding.
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, 1<<31)
+	req = httptest.NewRequest("POST", "http://localhost/api/v1/push", bytes.NewReader(append(header[:n], 0, 0, 0)))
+	err = f.FilterRequest("test", req)
+	if assert.True(t, errors.As(err, &rerr)) {
+		assert.Equal(t, 413, rerr.StatusCode)
+		assert.Contains(t, rerr.Message, "2147483648 bytes after snappy decoding (limit: 1000)")
+	}
+	assert.Equal(t, rejected+2, tooLarge())
+}
+
+func TestPushFilter_RelabelThenValidate(t *testing.T) {
+	// The strict tenant requires a job label, which is injected.
+	relabelCfg, err := ParseRelabelConfig([]byte("default:\n  - target_label: job\n    replacement: injected\n"))
+	assert.NoError(t, err)
+	f := NewPushFilter(NewRelabeler(relabelCfg), newTestValidator(t))
+
+	req, _ := newPushRequest(t, series("__name__", "up"))
+	assert.NoError(t, f.FilterRequest("strict", req))
+
+	forwarded, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(forwarded)), req.ContentLength)
+	wr, err := DecodeWriteRequest(forwarded)
+	assert.NoError(t, err)
+	assert.Equal(t, []prompb.TimeSeries{series("__name__", "up", "job", "injected")}, wr.Timeseries)
+}
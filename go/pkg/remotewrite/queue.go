@@ -0,0 +1,399 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+// The metrics of Prometheus' own remote_write queues, so that the same
+// dashboards and alerts can be used. Labeled by the name and URL of the
+// remote_write endpoint.
+var (
+	queueLabels = []string{"remote_name", "url"}
+
+	succeededSamplesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_succeeded_samples_total",
+		Help: "Total number of samples successfully sent to remote storage.",
+	}, queueLabels)
+
+	failedSamplesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_failed_samples_total",
+		Help: "Total number of samples which failed on send to remote storage, non-recoverable errors.",
+	}, queueLabels)
+
+	retriedSamplesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_retried_samples_total",
+		Help: "Total number of samples which failed on send to remote storage but were retried because the send " +
+			"error was recoverable.",
+	}, queueLabels)
+
+	droppedSamplesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_dropped_samples_total",
+		Help: "Total number of samples which were dropped because the queue was full or stopped before they could be sent.",
+	}, queueLabels)
+
+	sentBatchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prometheus_remote_storage_sent_batch_duration_seconds",
+		Help:    "Duration of sample batch send calls to the remote storage.",
+		Buckets: append(prometheus.DefBuckets, 25, 60, 120, 300),
+	}, queueLabels)
+
+	sentBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_sent_bytes_total",
+		Help: "The total number of bytes sent by the queue after compression.",
+	}, queueLabels)
+
+	highestSentTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_remote_storage_queue_highest_sent_timestamp_seconds",
+		Help: "The highest sample timestamp successfully sent by this queue, in seconds since epoch.",
+	}, queueLabels)
+
+	pendingSamples = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_remote_storage_pending_samples",
+		Help: "The number of samples pending in the queues shards to be sent to the remote storage.",
+	}, queueLabels)
+
+	numShards = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_remote_storage_shards",
+		Help: "The number of shards used for parallel sending to the remote storage.",
+	}, queueLabels)
+
+	shardCapacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_remote_storage_shard_capacity",
+		Help: "The capacity of each shard of the queue used for parallel sending to the remote storage.",
+	}, queueLabels)
+
+	maxSamplesPerSend = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_remote_storage_max_samples_per_send",
+		Help: "The maximum number of samples to be sent, in a single request, to the remote storage.",
+	}, queueLabels)
+)
+
+// QueueConfig configures a QueueManager, like the `queue_config` of a
+// Prometheus remote_write config.
+type QueueConfig struct {
+	// Number of shards: of concurrent requests.
+	Shards int
+	// Number of samples buffered per shard.
+	Capacity int
+	// Maximum number of samples per request.
+	MaxSamplesPerSend int
+	// Maximum time a sample waits in the buffer.
+	BatchSendDeadline time.Duration
+	// Backoff between retries, doubled upon each retry.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultQueueConfig has the defaults of Prometheus, with a fixed number of
+// shards.
+var DefaultQueueConfig = QueueConfig{
+	Shards:            4,
+	Capacity:          2500,
+	MaxSamplesPerSend: 500,
+	BatchSendDeadline: 5 * time.Second,
+	MinBackoff:        30 * time.Millisecond,
+	MaxBackoff:        5 * time.Second,
+}
+
+// A sample with the labels of its series.
+type queuedSample struct {
+	labels []prompb.Label
+	sample prompb.Sample
+}
+
+/*
+QueueManager writes series to a remote_write endpoint asynchronously, the
+way Prometheus does: samples are distributed to shards by series (keeping
+the samples of a series in order), and each shard sends batches of up to
+MaxSamplesPerSend samples, or of the samples that waited BatchSendDeadline.
+The shards send concurrently. Failed requests are retried with backoff if
+the error is recoverable (see IsRecoverable()), and dropped otherwise.
+
+Unlike Prometheus, the number of shards is fixed.
+*/
+type QueueManager struct {
+	cfg    QueueConfig
+	client *Client
+	shards []chan queuedSample
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	succeeded, failed, retried, dropped, sentBytes prometheus.Counter
+	pending                                        prometheus.Gauge
+	highestSent                                    *maxGauge
+	sentDuration                                   prometheus.Observer
+}
+
+/*
+A gauge that only ever grows, as Prometheus' `maxGauge`: the shards send
+concurrently, and a batch sent after another one may hold older samples.
+*/
+type maxGauge struct {
+	prometheus.Gauge
+	mu    sync.Mutex
+	value float64
+}
+
+func (g *maxGauge) Set(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if value > g.value {
+		g.value = value
+		g.Gauge.Set(value)
+	}
+}
+
+func NewQueueManager(cfg QueueConfig, client *Client) *QueueManager {
+	lvs := []string{client.Name(), client.URL()}
+	q := &QueueManager{
+		cfg:          cfg,
+		client:       client,
+		shards:       make([]chan queuedSample, cfg.Shards),
+		quit:         make(chan struct{}),
+		succeeded:    succeededSamplesTotal.WithLabelValues(lvs...),
+		failed:       failedSamplesTotal.WithLabelValues(lvs...),
+		retried:      retriedSamplesTotal.WithLabelValues(lvs...),
+		dropped:      droppedSamplesTotal.WithLabelValues(lvs...),
+		sentBytes:    sentBytesTotal.WithLabelValues(lvs...),
+		pending:      pendingSamples.WithLabelValues(lvs...),
+		highestSent:  &maxGauge{Gauge: highestSentTimestamp.WithLabelValues(lvs...)},
+		sentDuration: sentBatchDuration.WithLabelValues(lvs...),
+	}
+	for i := range q.shards {
+		q.shards[i] = make(chan queuedSample, cfg.Capacity)
+	}
+	numShards.WithLabelValues(lvs...).Set(float64(cfg.Shards))
+	shardCapacity.WithLabelValues(lvs...).Set(float64(cfg.Capacity))
+	maxSamplesPerSend.WithLabelValues(lvs...).Set(float64(cfg.MaxSamplesPerSend))
+	return q
+}
+
+// Start the shards.
+func (q *QueueManager) Start() {
+	for _, shard := range q.shards {
+		q.wg.Add(1)
+		go q.runShard(shard)
+	}
+}
+
+/*
+Stop the shards, after a last attempt to send the samples they buffered.
+Samples that cannot be sent are dropped, as may be samples appended
+meanwhile.
+*/
+func (q *QueueManager) Stop() {
+	close(q.quit)
+	q.wg.Wait()
+}
+
+// ErrQueueStopped is returned by QueueManager.Append() once the queue is
+// stopped.
+var ErrQueueStopped = errors.New("remote_write queue stopped")
+
+/*
+Append the samples of `series` to the queue. Block while the shard of a
+series is full (backpressure), until `ctx` is done. Return ErrQueueStopped if
+the queue was stopped meanwhile, or the error of `ctx`: the remaining samples
+are dropped, while those appended before are sent.
+*/
+func (q *QueueManager) Append(ctx context.Context, series []prompb.TimeSeries) error {
+	for _, ts := range series {
+		shard := q.shards[shardIndex(ts.Labels, len(q.shards))]
+		for _, s := range ts.Samples {
+			q.pending.Inc()
+			select {
+			case shard <- queuedSample{labels: ts.Labels, sample: s}:
+			case <-q.quit:
+				q.pending.Dec()
+				return ErrQueueStopped
+			case <-ctx.Done():
+				q.pending.Dec()
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+/*
+TryAppend is like Append(), but does not block: the samples of series whose
+shard is full are dropped. Return the number of dropped samples.
+*/
+func (q *QueueManager) TryAppend(series []prompb.TimeSeries) int {
+	dropped := 0
+	for _, ts := range series {
+		shard := q.shards[shardIndex(ts.Labels, len(q.shards))]
+		for _, s := range ts.Samples {
+			q.pending.Inc()
+			select {
+			case shard <- queuedSample{labels: ts.Labels, sample: s}:
+			default:
+				q.pending.Dec()
+				dropped++
+			}
+		}
+	}
+	q.dropped.Add(float64(dropped))
+	return dropped
+}
+
+// Return the shard of the series with the labels `labels`, independent of
+// their order.
+func shardIndex(labels []prompb.Label, shards int) int {
+	var h uint64
+	for _, l := range labels {
+		lh := fnv.New64a()
+		lh.Write([]byte(l.Name))
+		lh.Write([]byte{0xff})
+		lh.Write([]byte(l.Value))
+		h ^= lh.Sum64()
+	}
+	return int(h % uint64(shards))
+}
+
+func (q *QueueManager) runShard(shard chan queuedSample) {
+	defer q.wg.Done()
+
+	batch := make([]prompb.TimeSeries, 0, q.cfg.MaxSamplesPerSend)
+	timer := time.NewTimer(q.cfg.BatchSendDeadline)
+	defer timer.Stop()
+
+	for {
+		select {
+		case s := <-shard:
+			batch = append(batch, prompb.TimeSeries{Labels: s.labels, Samples: []prompb.Sample{s.sample}})
+			if len(batch) >= q.cfg.MaxSamplesPerSend {
+				q.sendBatch(batch)
+				batch = batch[:0]
+				resetTimer(timer, q.cfg.BatchSendDeadline)
+			}
+
+		case <-timer.C:
+			if len(batch) > 0 {
+				q.sendBatch(batch)
+				batch = batch[:0]
+			}
+			timer.Reset(q.cfg.BatchSendDeadline)
+
+		case <-q.quit:
+			q.flush(shard, batch)
+			return
+		}
+	}
+}
+
+// Send the samples in `batch`, and those buffered in `shard`.
+func (q *QueueManager) flush(shard chan queuedSample, batch []prompb.TimeSeries) {
+	for {
+		select {
+		case s := <-shard:
+			batch = append(batch, prompb.TimeSeries{Labels: s.labels, Samples: []prompb.Sample{s.sample}})
+			if len(batch) >= q.cfg.MaxSamplesPerSend {
+				q.sendBatch(batch)
+				batch = batch[:0]
+			}
+		default:
+			if len(batch) > 0 {
+				q.sendBatch(batch)
+			}
+			return
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// Send `batch` (of series with a sample each), retrying with backoff upon
+// recoverable errors. Once the queue is stopped, the batch is sent once.
+func (q *QueueManager) sendBatch(batch []prompb.TimeSeries) {
+	n := float64(len(batch))
+	defer q.pending.Sub(n)
+
+	body, err := EncodeWriteRequest(&prompb.WriteRequest{Timeseries: batch})
+	if err != nil {
+		log.Errorf("error while encoding write request for %s: %s", q.client.Name(), err)
+		q.failed.Add(n)
+		return
+	}
+
+	backoff := q.cfg.MinBackoff
+	for {
+		start := time.Now()
+		err := q.client.Store(context.Background(), body)
+		q.sentDuration.Observe(time.Since(start).Seconds())
+		if err == nil {
+			q.succeeded.Add(n)
+			q.sentBytes.Add(float64(len(body)))
+			q.highestSent.Set(float64(highestTimestamp(batch)) / 1000)
+			return
+		}
+		if !IsRecoverable(err) {
+			log.Errorf("non-recoverable error while sending %d samples to %s: %s", len(batch), q.client.Name(), err)
+			q.failed.Add(n)
+			return
+		}
+
+		select {
+		case <-q.quit:
+			log.Errorf("dropping %d samples for %s, queue stopped: %s", len(batch), q.client.Name(), err)
+			q.dropped.Add(n)
+			return
+		default:
+		}
+		log.Warnf("error while sending %d samples to %s, retrying in %s: %s", len(batch), q.client.Name(), backoff, err)
+		q.retried.Add(n)
+		select {
+		case <-time.After(backoff):
+		case <-q.quit:
+		}
+		backoff *= 2
+		if backoff > q.cfg.MaxBackoff {
+			backoff = q.cfg.MaxBackoff
+		}
+	}
+}
+
+// Return the highest sample timestamp in `series`, in milliseconds.
+func highestTimestamp(series []prompb.TimeSeries) int64 {
+	var highest int64
+	for _, ts := range series {
+		for _, s := range ts.Samples {
+			if s.Timestamp > highest {
+				highest = s.Timestamp
+			}
+		}
+	}
+	return highest
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+// A remote_write endpoint recording the write requests it accepts, and
+// responding with `statusCodes` first.
+type testEndpoint struct {
+	*httptest.Server
+	mu          sync.Mutex
+	requests    []*prompb.WriteRequest
+	attempts    int
+	statusCodes []int
+	tenants     []string
+}
+
+func newTestEndpoint(t *testing.T, statusCodes ...int) *testEndpoint {
+	e := &testEndpoint{statusCodes: statusCodes}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.attempts++
+		if len(e.statusCodes) > 0 {
+			w.WriteHeader(e.statusCodes[0])
+			e.statusCodes = e.statusCodes[1:]
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		wr, err := DecodeWriteRequest(body)
+		assert.NoError(t, err)
+		e.requests = append(e.requests, wr)
+		e.tenants = append(e.tenants, r.Header.Get("X-Scope-OrgID"))
+	}))
+	return e
+}
+
+// Return the number of samples of each accepted request.
+func (e *testEndpoint) batchSizes() []int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sizes := []int{}
+	for _, wr := range e.requests {
+		n := 0
+		for _, ts := range wr.Timeseries {
+			n += len(ts.Samples)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes
+}
+
+func newTestQueue(e *testEndpoint, shards int, maxSamplesPerSend int, deadline time.Duration) *QueueManager {
+	client := NewClient("test", e.URL, map[string]string{"X-Scope-OrgID": "tenant"}, http.DefaultClient)
+	return NewQueueManager(QueueConfig{
+		Shards:            shards,
+		Capacity:          10,
+		MaxSamplesPerSend: maxSamplesPerSend,
+		BatchSendDeadline: deadline,
+		MinBackoff:        time.Millisecond,
+		MaxBackoff:        10 * time.Millisecond,
+	}, client)
+}
+
+func testSeries(name string, timestamps ...int64) prompb.TimeSeries {
+	ts := prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: name}}}
+	for _, t := range timestamps {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: 1, Timestamp: t})
+	}
+	return ts
+}
+
+func TestQueueManager_MaxSamplesPerSend(t *testing.T) {
+	e := newTestEndpoint(t)
+	defer e.Close()
+	q := newTestQueue(e, 1, 2, time.Hour)
+	q.Start()
+
+	assert.NoError(t, q.Append(context.Background(), []prompb.TimeSeries{testSeries("a", 1, 2, 3), testSeries("b", 1, 2)}))
+	assert.Eventually(t, func() bool { return len(e.batchSizes()) == 2 }, time.Second, time.Millisecond)
+	// The last sample is sent when stopping.
+	q.Stop()
+	assert.Equal(t, []int{2, 2, 1}, e.batchSizes())
+	assert.Equal(t, []string{"tenant", "tenant", "tenant"}, e.tenants)
+
+	// The samples of a series are sent in order.
+	var timestamps []int64
+	for _, wr := range e.requests {
+		for _, ts := range wr.Timeseries {
+			if ts.Labels[0].Value == "a" {
+				timestamps = append(timestamps, ts.Samples[0].Timestamp)
+			}
+		}
+	}
+	assert.Equal(t, []int64{1, 2, 3}, timestamps)
+}
+
+func TestQueueManager_BatchSendDeadline(t *testing.T) {
+	e := newTestEndpoint(t)
+	defer e.Close()
+	q := newTestQueue(e, 2, 100, 10*time.Millisecond)
+	q.Start()
+	defer q.Stop()
+
+	assert.NoError(t, q.Append(context.Background(), []prompb.TimeSeries{testSeries("a", 1)}))
+	assert.Eventually(t, func() bool { return len(e.batchSizes()) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestQueueManager_Retry(t *testing.T) {
+	// Retried after 5xx and 429 responses.
+	e := newTestEndpoint(t, 500, 429)
+	defer e.Close()
+	q := newTestQueue(e, 1, 1, time.Hour)
+	q.Start()
+	assert.NoError(t, q.Append(context.Background(), []prompb.TimeSeries{testSeries("a", 1)}))
+	assert.Eventually(t, func() bool { return len(e.batchSizes()) == 1 }, time.Second, time.Millisecond)
+	q.Stop()
+	assert.Equal(t, 3, e.attempts)
+	assert.Equal(t, 2.0, testutil.ToFloat64(retriedSamplesTotal.WithLabelValues("test", e.URL)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(succeededSamplesTotal.WithLabelValues("test", e.URL)))
+
+	// Dropped after other 4xx responses.
+	e = newTestEndpoint(t, 400)
+	defer e.Close()
+	q = newTestQueue(e, 1, 1, time.Hour)
+	q.Start()
+	assert.NoError(t, q.Append(context.Background(), []prompb.TimeSeries{testSeries("a", 1), testSeries("a", 2)}))
+	assert.Eventually(t, func() bool { return len(e.batchSizes()) == 1 }, time.Second, time.Millisecond)
+	q.Stop()
+	assert.Equal(t, 2, e.attempts)
+	assert.Equal(t, 1.0, testutil.ToFloat64(failedSamplesTotal.WithLabelValues("test", e.URL)))
+	assert.Equal(t, int64(2), e.requests[0].Timeseries[0].Samples[0].Timestamp)
+}
+
+func TestQueueManager_AppendBlocked(t *testing.T) {
+	e := newTestEndpoint(t)
+	defer e.Close()
+	// Not started: the shard holds 10 samples.
+	q := newTestQueue(e, 1, 100, time.Hour)
+	series := []prompb.TimeSeries{testSeries("a", 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, q.Append(ctx, series))
+
+	q.Start()
+	q.Stop()
+	assert.Equal(t, ErrQueueStopped, q.Append(context.Background(), series))
+}
+
+func TestMaxGauge(t *testing.T) {
+	g := &maxGauge{Gauge: highestSentTimestamp.WithLabelValues("maxgauge", "http://localhost")}
+	g.Set(20)
+	g.Set(10)
+	assert.Equal(t, 20.0, testutil.ToFloat64(g))
+	g.Set(30)
+	assert.Equal(t, 30.0, testutil.ToFloat64(g))
+}
+
+func TestShardIndex(t *testing.T) {
+	// Independent of the order of labels.
+	a := []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "ddagent"}}
+	b := []prompb.Label{{Name: "job", Value: "ddagent"}, {Name: "__name__", Value: "up"}}
+	assert.Equal(t, shardIndex(a, 16), shardIndex(b, 16))
+
+	// Series are spread over the shards.
+	used := make(map[int]bool)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		used[shardIndex([]prompb.Label{{Name: "__name__", Value: name}}, 4)] = true
+	}
+	assert.Greater(t, len(used), 1)
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+)
+
+var relabelDroppedSeriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "remote_write_relabel_dropped_series_total",
+	Help: "Number of series dropped by relabeling rules.",
+}, []string{"tenant"})
+
+/*
+RelabelConfig is the YAML relabeling configuration: lists of rules with the
+semantics of Prometheus' `relabel_config`. `Default` applies to tenants not
+listed in `Tenants`. An entry in `Tenants` replaces the default as a whole.
+Example:
+
+	default:
+	  # Inject a label: a replace rule without source labels.
+	  - target_label: source
+	    replacement: opstrace-proxy
+	tenants:
+	  prod:
+	    - target_label: cluster
+	      replacement: eu-west-1
+	    - action: labeldrop
+	      regex: pod_uid|container_id
+	    - source_labels: [__name__]
+	      regex: go_.*
+	      action: drop
+*/
+type RelabelConfig struct {
+	Default []*relabel.Config            `yaml:"default"`
+	Tenants map[string][]*relabel.Config `yaml:"tenants"`
+}
+
+func (c *RelabelConfig) rulesFor(tenantName string) []*relabel.Config {
+	if rules, ok := c.Tenants[tenantName]; ok {
+		return rules
+	}
+	return c.Default
+}
+
+func ParseRelabelConfig(data []byte) (*RelabelConfig, error) {
+	var cfg RelabelConfig
+	// The rules are validated by relabel.Config.UnmarshalYAML().
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("bad relabel config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Relabeler applies per-tenant relabeling rules to series, see RelabelConfig.
+type Relabeler struct {
+	cfg *RelabelConfig
+}
+
+func NewRelabeler(cfg *RelabelConfig) *Relabeler {
+	return &Relabeler{cfg: cfg}
+}
+
+// Create a relabeler configured from the YAML file at `path` (see
+// RelabelConfig).
+func NewRelabelerFromFile(path string) (*Relabeler, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseRelabelConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewRelabeler(cfg), nil
+}
+
+// HasRules returns whether any relabeling rules apply to `tenantName`.
+func (rl *Relabeler) HasRules(tenantName string) bool {
+	return len(rl.cfg.rulesFor(tenantName)) > 0
+}
+
+/*
+Apply the relabeling rules of `tenantName` to each of `series`, in place.
+Return the series that have not been dropped (a prefix of `series`, reusing
+its backing array). The labels of a relabeled series are sorted by name, as
+expected by Cortex.
+*/
+func (rl *Relabeler) Relabel(tenantName string, series []prompb.TimeSeries) []prompb.TimeSeries {
+	rules := rl.cfg.rulesFor(tenantName)
+	if len(rules) == 0 {
+		return series
+	}
+
+	kept := series[:0]
+	for _, ts := range series {
+		lset := relabel.Process(toLabels(ts.Labels), rules...)
+		if lset == nil {
+			continue
+		}
+		ts.Labels = fromLabels(lset)
+		kept = append(kept, ts)
+	}
+
+	if dropped := len(series) - len(kept); dropped > 0 {
+		relabelDroppedSeriesTotal.WithLabelValues(tenantName).Add(float64(dropped))
+	}
+	return kept
+}
+
+func toLabels(pls []prompb.Label) labels.Labels {
+	ls := make(labels.Labels, 0, len(pls))
+	for _, l := range pls {
+		ls = append(ls, labels.Label{Name: l.Name, Value: l.Value})
+	}
+	return labels.New(ls...)
+}
+
+func fromLabels(ls labels.Labels) []prompb.Label {
+	pls := make([]prompb.Label, 0, len(ls))
+	for _, l := range ls {
+		pls = append(pls, prompb.Label{Name: l.Name, Value: l.Value})
+	}
+	return pls
+}
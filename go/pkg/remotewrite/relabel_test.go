@@ -0,0 +1,103 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRelabelConfig = `
+default:
+  - target_label: source
+    replacement: opstrace-proxy
+tenants:
+  prod:
+    - target_label: cluster
+      replacement: eu-west-1
+    - action: labeldrop
+      regex: pod_uid
+    - action: labelmap
+      regex: __meta_(.+)
+    - source_labels: [__name__]
+      regex: go_.*
+      action: drop
+    - source_labels: [job]
+      regex: (.*)-canary
+      target_label: job
+      replacement: $1
+  keeponly:
+    - source_labels: [__name__]
+      regex: up
+      action: keep
+`
+
+func newTestRelabeler(t *testing.T) *Relabeler {
+	cfg, err := ParseRelabelConfig([]byte(testRelabelConfig))
+	assert.NoError(t, err)
+	return NewRelabeler(cfg)
+}
+
+func TestRelabeler_Relabel(t *testing.T) {
+	rl := newTestRelabeler(t)
+
+	// Default rules: inject a label. Labels end up sorted by name.
+	relabeled := rl.Relabel("test", []prompb.TimeSeries{series("__name__", "up", "job", "node")})
+	assert.Equal(t, []prompb.TimeSeries{series("__name__", "up", "job", "node", "source", "opstrace-proxy")}, relabeled)
+
+	dropped := testutil.ToFloat64(relabelDroppedSeriesTotal.WithLabelValues("prod"))
+	relabeled = rl.Relabel("prod", []prompb.TimeSeries{
+		series("__name__", "up", "job", "api-canary", "pod_uid", "123", "__meta_zone", "a"),
+		series("__name__", "go_goroutines", "job", "api"),
+	})
+	// The tenant rules replace the default: no source label.
+	assert.Equal(t, []prompb.TimeSeries{
+		series("__meta_zone", "a", "__name__", "up", "cluster", "eu-west-1", "job", "api", "zone", "a"),
+	}, relabeled)
+	assert.Equal(t, dropped+1, testutil.ToFloat64(relabelDroppedSeriesTotal.WithLabelValues("prod")))
+
+	relabeled = rl.Relabel("keeponly", []prompb.TimeSeries{
+		series("__name__", "down"),
+		series("__name__", "up"),
+	})
+	assert.Equal(t, []prompb.TimeSeries{series("__name__", "up")}, relabeled)
+}
+
+func TestRelabeler_HasRules(t *testing.T) {
+	cfg, err := ParseRelabelConfig([]byte("tenants:\n  prod:\n    - action: labeldrop\n      regex: pod_uid\n"))
+	assert.NoError(t, err)
+	rl := NewRelabeler(cfg)
+	assert.True(t, rl.HasRules("prod"))
+	assert.False(t, rl.HasRules("test"))
+
+	// Without rules, series are returned as they are.
+	in := []prompb.TimeSeries{series("job", "node", "__name__", "up")}
+	assert.Equal(t, in, rl.Relabel("test", in))
+}
+
+func TestParseRelabelConfig_Invalid(t *testing.T) {
+	// Unknown action.
+	_, err := ParseRelabelConfig([]byte("default:\n  - action: nope\n"))
+	assert.Error(t, err)
+	// Replace without target label.
+	_, err = ParseRelabelConfig([]byte("default:\n  - replacement: foo\n"))
+	assert.Error(t, err)
+	// Unknown field.
+	_, err = ParseRelabelConfig([]byte("default:\n  - target: foo\n"))
+	assert.Error(t, err)
+}
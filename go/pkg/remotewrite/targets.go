@@ -0,0 +1,197 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Failure policies of a target.
+const (
+	PolicyRequired   = "required"
+	PolicyBestEffort = "best_effort"
+)
+
+// Default timeout of the requests to a target.
+const defaultTargetTimeout = 120 * time.Second
+
+/*
+TargetsConfig is the YAML configuration of the remote_write endpoints to
+write to. Each target has its own tenant (X-Scope-OrgID header, defaults to
+the tenant of the proxy), headers, request timeout (default: 2m) and failure
+policy: writes fail if a `required` target (the default) fails, while
+failures of `best_effort` targets are only logged and counted. Example:
+
+	targets:
+	  - name: cortex
+	    url: http://cortex-distributor.cortex.svc.cluster.local/api/v1/push
+	  - name: migration
+	    url: https://prometheus.example.com/api/v1/write
+	    tenant: ddapi
+	    headers:
+	      Authorization: Bearer s3cr3t
+	    timeout: 10s
+	    policy: best_effort
+*/
+type TargetsConfig struct {
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+type TargetConfig struct {
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Tenant  string            `yaml:"tenant"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Policy  string            `yaml:"policy"`
+}
+
+func ParseTargetsConfig(data []byte) (*TargetsConfig, error) {
+	var cfg TargetsConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("bad remote_write targets config: %w", err)
+	}
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("bad remote_write targets config: no targets")
+	}
+	names := make(map[string]bool)
+	for i, t := range cfg.Targets {
+		if t.Name == "" {
+			return nil, fmt.Errorf("bad remote_write target %d: name missing", i)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("bad remote_write target %s: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+		if _, err := url.ParseRequestURI(t.URL); err != nil {
+			return nil, fmt.Errorf("bad remote_write target %s: bad URL: %w", t.Name, err)
+		}
+		if t.Timeout < 0 {
+			return nil, fmt.Errorf("bad remote_write target %s: negative timeout", t.Name)
+		}
+		switch t.Policy {
+		case "":
+			cfg.Targets[i].Policy = PolicyRequired
+		case PolicyRequired, PolicyBestEffort:
+		default:
+			return nil, fmt.Errorf("bad remote_write target %s: unknown policy %s (expecting: %s or %s)",
+				t.Name, t.Policy, PolicyRequired, PolicyBestEffort)
+		}
+	}
+	return &cfg, nil
+}
+
+// Read the targets configuration at `path`, see TargetsConfig.
+func ReadTargetsConfigFile(path string) (*TargetsConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTargetsConfig(data)
+}
+
+/*
+Create the targets, writing for `defaultTenant` unless configured otherwise.
+Their HTTP clients share `transport` (nil means http.DefaultTransport).
+*/
+func (c *TargetsConfig) NewTargets(defaultTenant string, transport http.RoundTripper) []*Target {
+	targets := make([]*Target, 0, len(c.Targets))
+	for _, t := range c.Targets {
+		headers := map[string]string{"X-Scope-OrgID": defaultTenant}
+		if t.Tenant != "" {
+			headers["X-Scope-OrgID"] = t.Tenant
+		}
+		for k, v := range t.Headers {
+			headers[k] = v
+		}
+		timeout := t.Timeout
+		if timeout == 0 {
+			timeout = defaultTargetTimeout
+		}
+		httpClient := &http.Client{Transport: transport, Timeout: timeout}
+		targets = append(targets, NewTarget(NewClient(t.Name, t.URL, headers, httpClient), t.Policy == PolicyRequired))
+	}
+	return targets
+}
+
+// Target is a remote_write endpoint to write to, see TargetsConfig.
+type Target struct {
+	client   *Client
+	required bool
+}
+
+func NewTarget(client *Client, required bool) *Target {
+	return &Target{client: client, required: required}
+}
+
+func (t *Target) Client() *Client {
+	return t.client
+}
+
+// Required returns whether writes fail if writing to the target fails.
+func (t *Target) Required() bool {
+	return t.required
+}
+
+/*
+WriteToTargets writes `body` (see Client.Store()) to `targets` concurrently.
+Return the error of the first required target that failed, in the order of
+`targets`. Failures of best-effort targets are logged.
+*/
+func WriteToTargets(ctx context.Context, targets []*Target, body []byte) error {
+	if len(targets) == 1 {
+		return targets[0].write(ctx, body)
+	}
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *Target) {
+			defer wg.Done()
+			errs[i] = t.write(ctx, body)
+		}(i, t)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write to the target. Return an error only if the target is required.
+func (t *Target) write(ctx context.Context, body []byte) error {
+	err := t.client.Store(ctx, body)
+	if err == nil {
+		return nil
+	}
+	if t.required {
+		return fmt.Errorf("remote_write target %s: %w", t.client.Name(), err)
+	}
+	log.Warnf("error while writing to best-effort remote_write target %s: %s", t.client.Name(), err)
+	return nil
+}
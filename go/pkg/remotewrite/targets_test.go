@@ -0,0 +1,131 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTargetsConfig(t *testing.T) {
+	cfg, err := ParseTargetsConfig([]byte(`
+targets:
+  - name: cortex
+    url: http://cortex/api/v1/push
+  - name: migration
+    url: https://prometheus.example.com/api/v1/write
+    tenant: ddapi
+    headers:
+      Authorization: Bearer s3cr3t
+    timeout: 10s
+    policy: best_effort
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []TargetConfig{
+		{Name: "cortex", URL: "http://cortex/api/v1/push", Policy: PolicyRequired},
+		{
+			Name:    "migration",
+			URL:     "https://prometheus.example.com/api/v1/write",
+			Tenant:  "ddapi",
+			Headers: map[string]string{"Authorization": "Bearer s3cr3t"},
+			Timeout: 10 * time.Second,
+			Policy:  PolicyBestEffort,
+		},
+	}, cfg.Targets)
+
+	targets := cfg.NewTargets("default", nil)
+	assert.True(t, targets[0].Required())
+	assert.Equal(t, map[string]string{"X-Scope-OrgID": "default"}, targets[0].Client().headers)
+	assert.Equal(t, defaultTargetTimeout, targets[0].Client().httpClient.Timeout)
+	assert.False(t, targets[1].Required())
+	assert.Equal(t, map[string]string{"X-Scope-OrgID": "ddapi", "Authorization": "Bearer s3cr3t"},
+		targets[1].Client().headers)
+	assert.Equal(t, 10*time.Second, targets[1].Client().httpClient.Timeout)
+
+	// The transport is shared.
+	transport := &http.Transport{}
+	targets = cfg.NewTargets("default", transport)
+	assert.Equal(t, transport, targets[0].Client().httpClient.Transport)
+	assert.Equal(t, transport, targets[1].Client().httpClient.Transport)
+
+	for _, bad := range []string{
+		`targets: []`,
+		`targets: [{url: "http://cortex/api/v1/push"}]`,
+		`targets: [{name: a, url: "http://a/push"}, {name: a, url: "http://b/push"}]`,
+		`targets: [{name: a, url: "cortex"}]`,
+		`targets: [{name: a, url: "http://a/push", policy: sometimes}]`,
+		`targets: [{name: a, url: "http://a/push", retries: 3}]`,
+	} {
+		_, err := ParseTargetsConfig([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestWriteToTargets(t *testing.T) {
+	ok := newTestEndpoint(t)
+	defer ok.Close()
+	failing := newTestEndpoint(t, 500, 500)
+	defer failing.Close()
+
+	newTarget := func(name string, e *testEndpoint, required bool) *Target {
+		return NewTarget(NewClient(name, e.URL, map[string]string{"X-Scope-OrgID": name}, http.DefaultClient), required)
+	}
+	body, err := EncodeWriteRequest(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{testSeries("a", 1)}})
+	assert.NoError(t, err)
+
+	// Failures of best-effort targets are ignored.
+	err = WriteToTargets(context.Background(), []*Target{
+		newTarget("ok", ok, true),
+		newTarget("failing", failing, false),
+	}, body)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ok"}, ok.tenants)
+	assert.Equal(t, 1, failing.attempts)
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestsTotal.WithLabelValues("ok", ok.URL, "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestsTotal.WithLabelValues("failing", failing.URL, "failure")))
+
+	// Failures of required targets are not.
+	err = WriteToTargets(context.Background(), []*Target{
+		newTarget("ok", ok, true),
+		newTarget("failing", failing, true),
+	}, body)
+	var herr *HTTPError
+	if assert.ErrorAs(t, err, &herr) {
+		assert.Equal(t, 500, herr.StatusCode)
+	}
+	assert.Equal(t, []string{"ok", "ok"}, ok.tenants)
+	assert.False(t, IsRecoverable(&HTTPError{StatusCode: 400}))
+	assert.True(t, IsRecoverable(err))
+}
+
+func TestClient_URL(t *testing.T) {
+	e := newTestEndpoint(t)
+	defer e.Close()
+	u := strings.Replace(e.URL, "http://", "http://user:s3cr3t@", 1)
+
+	c := NewClient("secret", u, nil, http.DefaultClient)
+	assert.Equal(t, e.URL, c.URL())
+	body, err := EncodeWriteRequest(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{testSeries("a", 1)}})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Store(context.Background(), body))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestsTotal.WithLabelValues("secret", e.URL, "success")))
+}
@@ -0,0 +1,239 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+	"github.com/opstrace/opstrace/go/pkg/middleware"
+)
+
+/*
+Enforcer restricts the queries of a request to the selector of its
+authentication token (the `selector` claim, see authenticator.Tenant) and to
+the selector of its tenant in the (optional) policy. If both are set, a
+series must match both.
+
+Its Filter* methods are middleware.RequestFilter functions, expecting the
+authenticated tenant in the request context.
+*/
+type Enforcer struct {
+	policy *Policy
+}
+
+// Create an enforcer. `policy` may be nil: then only the selectors of tokens
+// are enforced.
+func NewEnforcer(policy *Policy) *Enforcer {
+	return &Enforcer{policy: policy}
+}
+
+/*
+Return the label matchers to enforce for the request `r` of `tenantName`, none
+if the request is not restricted. A bad selector claim in the token yields a
+*middleware.RequestError.
+*/
+func (e *Enforcer) Matchers(tenantName string, r *http.Request) ([]*labels.Matcher, error) {
+	var matchers []*labels.Matcher
+	if e.policy != nil {
+		matchers = append(matchers, e.policy.matchersFor(tenantName)...)
+	}
+
+	tenant, _ := authenticator.TenantFromContext(r.Context())
+	claimed, err := Parse(tenant.Selector)
+	if err != nil {
+		// The token has been signed with a bad claim.
+		log.Warnf("tenant %s: %s", tenantName, err)
+		return nil, &middleware.RequestError{
+			StatusCode: http.StatusForbidden,
+			Message:    "bad authentication token: invalid selector claim",
+		}
+	}
+	return append(matchers, claimed...), nil
+}
+
+/*
+Restrict the Prometheus HTTP API request `r` (as served by the Cortex
+querier): inject the matchers into the PromQL expression of the `query`
+parameter of /query, /query_range and /query_exemplars, and into each
+`match[]` parameter of /series, /labels and /label/<name>/values. If there is
+no `match[]` parameter, add one.
+
+When there are matchers to enforce, reject requests to other endpoints with a
+403 response: their responses cannot be restricted.
+*/
+func (e *Enforcer) FilterPromQLRequest(tenantName string, r *http.Request) error {
+	matchers, err := e.Matchers(tenantName, r)
+	if err != nil || len(matchers) == 0 {
+		return err
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case strings.HasSuffix(path, "/query") ||
+		strings.HasSuffix(path, "/query_range") ||
+		strings.HasSuffix(path, "/query_exemplars"):
+		return rewriteParams(r, func(params url.Values) error {
+			return injectParam(params, "query", matchers, InjectPromQL)
+		})
+	case strings.HasSuffix(path, "/series") ||
+		strings.HasSuffix(path, "/labels") ||
+		(strings.Contains(path, "/label/") && strings.HasSuffix(path, "/values")):
+		return injectMatchParams(r, matchers, InjectPromQL)
+	default:
+		return notAvailable(r, matchers)
+	}
+}
+
+/*
+Restrict the Loki HTTP API request `r`: inject the matchers into the LogQL
+query of the `query` parameter of /query, /query_range and /tail, and into
+each `match[]` parameter of /series. If there is no `match[]` parameter, add
+one.
+
+When there are matchers to enforce, reject requests to other endpoints with a
+403 response. This includes /labels and /label/<name>/values, which do not
+take a selector in the Loki versions we run.
+*/
+func (e *Enforcer) FilterLogQLRequest(tenantName string, r *http.Request) error {
+	matchers, err := e.Matchers(tenantName, r)
+	if err != nil || len(matchers) == 0 {
+		return err
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case strings.HasSuffix(path, "/query") ||
+		strings.HasSuffix(path, "/query_range") ||
+		strings.HasSuffix(path, "/tail"):
+		return rewriteParams(r, func(params url.Values) error {
+			return injectParam(params, "query", matchers, InjectLogQL)
+		})
+	case strings.HasSuffix(path, "/series"):
+		return injectMatchParams(r, matchers, InjectLogQL)
+	default:
+		return notAvailable(r, matchers)
+	}
+}
+
+func notAvailable(r *http.Request, matchers []*labels.Matcher) error {
+	return &middleware.RequestError{
+		StatusCode: http.StatusForbidden,
+		Message:    fmt.Sprintf("%s is not available to requests restricted to %s", r.URL.Path, Format(matchers)),
+	}
+}
+
+// Inject `matchers` into each `match[]` parameter of `r`, adding the parameter
+// if there is none.
+func injectMatchParams(
+	r *http.Request,
+	matchers []*labels.Matcher,
+	inject func(string, []*labels.Matcher) (string, error),
+) error {
+	matchSet := false
+	err := rewriteParams(r, func(params url.Values) error {
+		matchSet = matchSet || len(params["match[]"]) > 0
+		return injectParam(params, "match[]", matchers, inject)
+	})
+	if err == nil && !matchSet {
+		// Do not let the request escape the restriction by omitting the
+		// parameter.
+		query := r.URL.Query()
+		query.Set("match[]", Format(matchers))
+		r.URL.RawQuery = query.Encode()
+	}
+	return err
+}
+
+// Inject `matchers` into each value of the parameter `name`.
+func injectParam(
+	params url.Values,
+	name string,
+	matchers []*labels.Matcher,
+	inject func(string, []*labels.Matcher) (string, error),
+) error {
+	values := params[name]
+	for i, v := range values {
+		injected, err := inject(v, matchers)
+		if err != nil {
+			return fmt.Errorf("bad %s parameter: %w", name, err)
+		}
+		values[i] = injected
+	}
+	return nil
+}
+
+// Maximum size of a form-encoded request body, as in http.Request.ParseForm().
+const maxFormBodySize = 10 << 20
+
+/*
+Apply `rewrite` to the parameters in the URL query of `r` and, for a request
+with a form-encoded body, to the parameters in the body. Reject multipart
+bodies, which the backend would also read parameters from, and bodies larger
+than maxFormBodySize.
+*/
+func rewriteParams(r *http.Request, rewrite func(url.Values) error) error {
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return fmt.Errorf("bad URL query: %w", err)
+	}
+	if err := rewrite(query); err != nil {
+		return err
+	}
+	r.URL.RawQuery = query.Encode()
+
+	if r.Body == nil || (r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch) {
+		return nil
+	}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(ct, "multipart/") {
+		return fmt.Errorf("multipart request bodies are not supported")
+	}
+	if ct != "application/x-www-form-urlencoded" {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFormBodySize+1))
+	if err != nil {
+		return fmt.Errorf("reading request body failed: %w", err)
+	}
+	if len(body) > maxFormBodySize {
+		return &middleware.RequestError{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Message:    fmt.Sprintf("form-encoded request body too large: more than %d bytes", maxFormBodySize),
+		}
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return fmt.Errorf("bad form-encoded body: %w", err)
+	}
+	if err := rewrite(form); err != nil {
+		return err
+	}
+	body = []byte(form.Encode())
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return nil
+}
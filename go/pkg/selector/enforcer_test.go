@@ -0,0 +1,191 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+	"github.com/opstrace/opstrace/go/pkg/middleware"
+)
+
+// Create a request authenticated for tenant `test`, with a token carrying the
+// selector claim `claim`.
+func newTestRequest(method string, target string, body string, claim string) *http.Request {
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, target, nil)
+	} else {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req.WithContext(authenticator.WithTenant(req.Context(), authenticator.Tenant{Name: "test", Selector: claim}))
+}
+
+func TestEnforcer_FilterPromQLRequest(t *testing.T) {
+	e := NewEnforcer(nil)
+
+	// Query parameter.
+	req := newTestRequest("GET", "http://localhost/api/v1/query?query=up&time=1", "", `{team="payments"}`)
+	assert.NoError(t, e.FilterPromQLRequest("test", req))
+	assert.Equal(t, `up{team="payments"}`, req.URL.Query().Get("query"))
+	assert.Equal(t, "1", req.URL.Query().Get("time"))
+
+	// Form-encoded body.
+	req = newTestRequest("POST", "http://localhost/api/v1/query_range",
+		url.Values{"query": {"rate(x[5m])"}}.Encode(), `{team="payments"}`)
+	assert.NoError(t, e.FilterPromQLRequest("test", req))
+	body, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(body)), req.ContentLength)
+	form, err := url.ParseQuery(string(body))
+	assert.NoError(t, err)
+	assert.Equal(t, `rate(x{team="payments"}[5m])`, form.Get("query"))
+
+	// Each match[] parameter.
+	req = newTestRequest("GET", "http://localhost/api/v1/series?match[]=up&match[]={job=\"node\"}", "",
+		`{team="payments"}`)
+	assert.NoError(t, e.FilterPromQLRequest("test", req))
+	assert.Equal(t, []string{`up{team="payments"}`, `{job="node", team="payments"}`}, req.URL.Query()["match[]"])
+
+	// A missing match[] parameter is added.
+	req = newTestRequest("GET", "http://localhost/api/v1/label/job/values", "", `{team="payments"}`)
+	assert.NoError(t, e.FilterPromQLRequest("test", req))
+	assert.Equal(t, []string{`{team="payments"}`}, req.URL.Query()["match[]"])
+
+	// Other endpoints cannot be restricted.
+	req = newTestRequest("GET", "http://localhost/api/v1/rules", "", `{team="payments"}`)
+	err = e.FilterPromQLRequest("test", req)
+	var rerr *middleware.RequestError
+	if assert.True(t, errors.As(err, &rerr)) {
+		assert.Equal(t, 403, rerr.StatusCode)
+		assert.Equal(t, `/api/v1/rules is not available to requests restricted to {team="payments"}`, rerr.Message)
+	}
+
+	// Unrestricted token: the request is left as it is.
+	req = newTestRequest("GET", "http://localhost/api/v1/rules?query=up", "", "")
+	assert.NoError(t, e.FilterPromQLRequest("test", req))
+	assert.Equal(t, "query=up", req.URL.RawQuery)
+
+	// Bad claim.
+	req = newTestRequest("GET", "http://localhost/api/v1/query?query=up", "", `team="payments"`)
+	err = e.FilterPromQLRequest("test", req)
+	if assert.True(t, errors.As(err, &rerr)) {
+		assert.Equal(t, 403, rerr.StatusCode)
+	}
+
+	// Bad query.
+	req = newTestRequest("GET", "http://localhost/api/v1/query?query="+url.QueryEscape("up{"), "", `{team="payments"}`)
+	assert.EqualError(t, e.FilterPromQLRequest("test", req), `bad query parameter: unclosed "{" at position 2`)
+
+	// Multipart body.
+	req = newTestRequest("POST", "http://localhost/api/v1/query", "", `{team="payments"}`)
+	req.Body = ioutil.NopCloser(strings.NewReader("--x--"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	assert.Error(t, e.FilterPromQLRequest("test", req))
+
+	// Body too large.
+	req = newTestRequest("POST", "http://localhost/api/v1/query",
+		"query=up&x="+strings.Repeat("x", maxFormBodySize), `{team="payments"}`)
+	if assert.True(t, errors.As(e.FilterPromQLRequest("test", req), &rerr)) {
+		assert.Equal(t, 413, rerr.StatusCode)
+	}
+}
+
+func TestEnforcer_FilterLogQLRequest(t *testing.T) {
+	e := NewEnforcer(nil)
+
+	for _, path := range []string{"/loki/api/v1/query", "/loki/api/v1/query_range", "/loki/api/v1/tail"} {
+		req := newTestRequest("GET", "http://localhost"+path+"?query="+url.QueryEscape(`{app="api"} |= "x"`), "",
+			`{team="payments"}`)
+		assert.NoError(t, e.FilterLogQLRequest("test", req))
+		assert.Equal(t, `{app="api", team="payments"} |= "x"`, req.URL.Query().Get("query"), path)
+	}
+
+	// A missing match[] parameter is added.
+	req := newTestRequest("GET", "http://localhost/loki/api/v1/series", "", `{team="payments"}`)
+	assert.NoError(t, e.FilterLogQLRequest("test", req))
+	assert.Equal(t, []string{`{team="payments"}`}, req.URL.Query()["match[]"])
+
+	// Label names and values cannot be restricted.
+	req = newTestRequest("GET", "http://localhost/loki/api/v1/label/app/values", "", `{team="payments"}`)
+	err := e.FilterLogQLRequest("test", req)
+	var rerr *middleware.RequestError
+	if assert.True(t, errors.As(err, &rerr)) {
+		assert.Equal(t, 403, rerr.StatusCode)
+	}
+
+	// Unrestricted token.
+	req = newTestRequest("GET", "http://localhost/loki/api/v1/labels", "", "")
+	assert.NoError(t, e.FilterLogQLRequest("test", req))
+
+	// Not a LogQL selector (Loki rejects the query): nothing to inject into.
+	req = newTestRequest("GET", "http://localhost/loki/api/v1/query?query=up", "", `{team="payments"}`)
+	assert.NoError(t, e.FilterLogQLRequest("test", req))
+	assert.Equal(t, "up", req.URL.Query().Get("query"))
+}
+
+func TestEnforcer_Policy(t *testing.T) {
+	policy, err := ParsePolicy([]byte("tenants:\n  test: '{env=\"prod\"}'\n"))
+	assert.NoError(t, err)
+	e := NewEnforcer(policy)
+
+	// Policy and claim combined.
+	req := newTestRequest("GET", "http://localhost/api/v1/query?query=up", "", `{team="payments"}`)
+	assert.NoError(t, e.FilterPromQLRequest("test", req))
+	assert.Equal(t, `up{env="prod", team="payments"}`, req.URL.Query().Get("query"))
+
+	// Other tenants are not restricted.
+	req = newTestRequest("GET", "http://localhost/api/v1/query?query=up", "", "")
+	assert.NoError(t, e.FilterPromQLRequest("other", req))
+	assert.Equal(t, "up", req.URL.Query().Get("query"))
+
+	_, err = ParsePolicy([]byte("tenants:\n  test: 'env=\"prod\"'\n"))
+	assert.Error(t, err)
+}
+
+func TestReverseProxy_FilterPromQLRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Query().Get("query"))
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	assert.NoError(t, err)
+
+	policy, err := ParsePolicy([]byte("default: '{team=\"payments\"}'\n"))
+	assert.NoError(t, err)
+	disableAPIAuth := true
+	rp := middleware.NewReverseProxyFixedTenant("test", "X-Scope-OrgID", backendURL, disableAPIAuth).
+		FilterRequests(NewEnforcer(policy).FilterPromQLRequest)
+
+	w := httptest.NewRecorder()
+	rp.HandleWithProxy(w, httptest.NewRequest("GET", "http://localhost/api/v1/query?query=up", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `up{team="payments"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	rp.HandleWithProxy(w, httptest.NewRequest("GET", "http://localhost/api/v1/metadata", nil))
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, `/api/v1/metadata is not available to requests restricted to {team="payments"}`, w.Body.String())
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+A minimal lexer for PromQL and LogQL queries. It does not understand the
+grammar, only enough to find the selectors in a query: it splits the query
+into identifiers, strings, numbers, brackets and operators, skipping
+whitespace and comments.
+
+The lexer is strict: input it does not understand is an error, so that
+selectors cannot be hidden from it.
+*/
+
+type tokenKind int
+
+const (
+	tokIdentifier tokenKind = iota
+	tokString
+	tokNumber
+	tokLeftBrace
+	tokRightBrace
+	tokLeftParen
+	tokRightParen
+	tokLeftBracket
+	tokRightBracket
+	tokComma
+	tokOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// Byte offsets of the token in the query.
+	start int
+	end   int
+}
+
+const operatorChars = "+-*/%^=!<>~@|:"
+
+var punctuation = map[byte]tokenKind{
+	'{': tokLeftBrace,
+	'}': tokRightBrace,
+	'(': tokLeftParen,
+	')': tokRightParen,
+	'[': tokLeftBracket,
+	']': tokRightBracket,
+	',': tokComma,
+}
+
+var closingKind = map[tokenKind]tokenKind{
+	tokLeftBrace:   tokRightBrace,
+	tokLeftParen:   tokRightParen,
+	tokLeftBracket: tokRightBracket,
+}
+
+func isAlpha(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func lex(query string) ([]token, error) {
+	var tokens []token
+	// Within brackets (ranges, subqueries), a colon separates durations.
+	bracketDepth := 0
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		start := i
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			end, err := scanString(query, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{tokString, query[start:i], start, i})
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			// Numbers and durations, such as 1.5e3, 0x1f or 1h30m.
+			for i < len(query) && (isAlpha(query[i]) || isDigit(query[i]) || query[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, query[start:i], start, i})
+		case isAlpha(c) || (c == ':' && bracketDepth == 0):
+			for i < len(query) && (isAlpha(query[i]) || isDigit(query[i]) || query[i] == ':') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdentifier, query[start:i], start, i})
+		case strings.IndexByte(operatorChars, c) >= 0:
+			for i < len(query) && strings.IndexByte(operatorChars, query[i]) >= 0 &&
+				!(query[i] == ':' && bracketDepth == 0) {
+				i++
+			}
+			tokens = append(tokens, token{tokOperator, query[start:i], start, i})
+		default:
+			kind, ok := punctuation[c]
+			if !ok {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			switch kind {
+			case tokLeftBracket:
+				bracketDepth++
+			case tokRightBracket:
+				bracketDepth--
+			}
+			i++
+			tokens = append(tokens, token{kind, query[start:i], start, i})
+		}
+	}
+	return tokens, nil
+}
+
+// Return the offset after the string starting at `start`. Double- and
+// single-quoted strings support backslash escapes, backtick strings do not.
+func scanString(query string, start int) (int, error) {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at position %d", start)
+}
+
+// Return the index of the token closing the brace, parenthesis or bracket
+// opened by tokens[open].
+func matching(tokens []token, open int) (int, error) {
+	closing := closingKind[tokens[open].kind]
+
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch tokens[i].kind {
+		case tokens[open].kind:
+			depth++
+		case closing:
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unclosed %q at position %d", tokens[open].text, tokens[open].start)
+}
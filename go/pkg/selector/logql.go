@@ -0,0 +1,54 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+/*
+Restrict the LogQL query `query` to the log streams matching `matchers`, by
+adding them to each stream selector: `{app="api"} |= "error"` becomes
+`{app="api", team="payments"} |= "error"`.
+
+Unlike in PromQL, every LogQL selector is a `{...}` block, and braces do not
+appear elsewhere outside of strings (such as the templates of line_format).
+Return an error if the query cannot be tokenized.
+*/
+func InjectLogQL(query string, matchers []*labels.Matcher) (string, error) {
+	if len(matchers) == 0 {
+		return query, nil
+	}
+
+	tokens, err := lex(query)
+	if err != nil {
+		return "", err
+	}
+
+	var edits []edit
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].kind != tokLeftBrace {
+			continue
+		}
+		closing, err := matching(tokens, i)
+		if err != nil {
+			return "", err
+		}
+		injectIntoBraces(tokens, i, closing, matchers, &edits)
+		i = closing
+	}
+
+	return applyEdits(query, edits), nil
+}
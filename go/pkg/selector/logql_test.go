@@ -0,0 +1,55 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInjectLogQL(t *testing.T) {
+	matchers := mustParse(t, `{team="payments"}`)
+
+	for _, tc := range []struct{ query, expected string }{
+		{`{app="api"}`, `{app="api", team="payments"}`},
+		{`{app="api"} |= "error" != "timeout"`, `{app="api", team="payments"} |= "error" != "timeout"`},
+		{`{app=~"api|web"} |~ "{.*}"`, `{app=~"api|web", team="payments"} |~ "{.*}"`},
+		{
+			`{app="api"} | json | line_format "{{.msg}}" | label_format level="{{.lvl}}"`,
+			`{app="api", team="payments"} | json | line_format "{{.msg}}" | label_format level="{{.lvl}}"`,
+		},
+		{
+			"sum by (level) (count_over_time({app=\"api\"} | logfmt | duration > 10s [5m]))",
+			"sum by (level) (count_over_time({app=\"api\", team=\"payments\"} | logfmt | duration > 10s [5m]))",
+		},
+		{
+			`rate({app="api"}[1m]) / rate({app="web"} | unwrap bytes(size) [1m])`,
+			`rate({app="api", team="payments"}[1m]) / rate({app="web", team="payments"} | unwrap bytes(size) [1m])`,
+		},
+		{"{app=\"api\"} |= `{raw}`", "{app=\"api\", team=\"payments\"} |= `{raw}`"},
+		{`vector(1)`, `vector(1)`},
+	} {
+		injected, err := InjectLogQL(tc.query, matchers)
+		if assert.NoError(t, err, tc.query) {
+			assert.Equal(t, tc.expected, injected, tc.query)
+		}
+	}
+
+	for _, bad := range []string{`{app="api"`, `{app="api} |= "x"`, `{app="api"} |= "x" ; {}`} {
+		_, err := InjectLogQL(bad, matchers)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Policy is the YAML selector policy: a selector restricting all requests of a
+tenant, regardless of the token used. `Default` applies to tenants not listed
+in `Tenants`. Example:
+
+	tenants:
+	  shared: '{team="payments"}'
+*/
+type Policy struct {
+	Default string            `yaml:"default"`
+	Tenants map[string]string `yaml:"tenants"`
+
+	defaultMatchers []*labels.Matcher
+	tenantMatchers  map[string][]*labels.Matcher
+}
+
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("bad selector policy: %w", err)
+	}
+
+	var err error
+	p.defaultMatchers, err = Parse(p.Default)
+	if err != nil {
+		return nil, fmt.Errorf("bad default selector policy: %w", err)
+	}
+	p.tenantMatchers = make(map[string][]*labels.Matcher, len(p.Tenants))
+	for tenant, sel := range p.Tenants {
+		p.tenantMatchers[tenant], err = Parse(sel)
+		if err != nil {
+			return nil, fmt.Errorf("bad selector policy for tenant %s: %w", tenant, err)
+		}
+	}
+	return &p, nil
+}
+
+// Read the policy from the YAML file at `path`.
+func NewPolicyFromFile(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+func (p *Policy) matchersFor(tenantName string) []*labels.Matcher {
+	if m, ok := p.tenantMatchers[tenantName]; ok {
+		return m
+	}
+	return p.defaultMatchers
+}
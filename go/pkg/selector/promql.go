@@ -0,0 +1,176 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// PromQL aggregation operators (case-insensitive), as in `sum by (job) (x)`.
+var promqlAggregations = map[string]bool{
+	"sum":          true,
+	"avg":          true,
+	"count":        true,
+	"min":          true,
+	"max":          true,
+	"group":        true,
+	"stddev":       true,
+	"stdvar":       true,
+	"topk":         true,
+	"bottomk":      true,
+	"count_values": true,
+	"quantile":     true,
+}
+
+// PromQL binary operators that are keywords.
+var promqlBinaryKeywords = map[string]bool{
+	"and":    true,
+	"or":     true,
+	"unless": true,
+	"atan2":  true,
+}
+
+var promqlComparisonOperators = map[string]bool{
+	"==": true,
+	"!=": true,
+	">":  true,
+	"<":  true,
+	">=": true,
+	"<=": true,
+}
+
+/*
+Restrict the PromQL expression `query` to the series matching `matchers`, by
+adding them to each vector selector: `up` becomes `up{team="payments"}`,
+`{job="node"}` becomes `{job="node", team="payments"}`. Existing matchers are
+kept: for a label matched both by the query and by `matchers`, only series
+matching both are selected.
+
+Keywords are only recognized where the grammar expects them: where an
+expression is expected, an identifier is a metric name (such as `count` in
+`rate(count[5m])`) unless it is followed by a parenthesis (a function call or
+an aggregation) or is a modifier of the preceding operator (`bool`, `on`,
+`ignoring`, `group_left`, `group_right`, `by`, `without`). After an
+expression, an identifier must be a binary operator or a modifier (`offset`,
+`by`, `without`).
+
+Return an error if the query cannot be tokenized, or has identifiers this
+does not understand: such queries are rejected rather than passed on without
+matchers.
+*/
+func InjectPromQL(query string, matchers []*labels.Matcher) (string, error) {
+	if len(matchers) == 0 {
+		return query, nil
+	}
+
+	tokens, err := lex(query)
+	if err != nil {
+		return "", err
+	}
+
+	var edits []edit
+	// Whether an expression is expected at the current token, rather than
+	// an operator.
+	expectExpr := true
+	// Modifiers allowed at the current token.
+	var afterAggregation, afterComparison, afterBinaryOp, afterMatching bool
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		next := tokenKind(-1)
+		nextKeyword := ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1].kind
+			if next == tokIdentifier {
+				nextKeyword = strings.ToLower(tokens[i+1].text)
+			}
+		}
+		aggregation, comparison, binaryOp, vectorMatching := false, false, false, false
+
+		switch t.kind {
+		case tokLeftBrace:
+			closing, err := matching(tokens, i)
+			if err != nil {
+				return "", err
+			}
+			injectIntoBraces(tokens, i, closing, matchers, &edits)
+			// The label matchers are not expressions: skip them.
+			i = closing
+			expectExpr = false
+		case tokLeftParen, tokLeftBracket, tokComma:
+			expectExpr = true
+		case tokRightParen, tokRightBracket, tokString, tokNumber:
+			expectExpr = false
+		case tokOperator:
+			expectExpr = true
+			comparison = promqlComparisonOperators[t.text]
+			binaryOp = true
+		case tokIdentifier:
+			keyword := strings.ToLower(t.text)
+			var skip bool
+			switch {
+			case !expectExpr:
+				switch {
+				case promqlBinaryKeywords[keyword]:
+					expectExpr = true
+					binaryOp = true
+				case keyword == "offset":
+				case (keyword == "by" || keyword == "without") && next == tokLeftParen:
+					skip = true
+				default:
+					return "", fmt.Errorf("unexpected identifier %q at position %d", t.text, t.start)
+				}
+			case keyword == "bool" && afterComparison:
+				binaryOp = true
+			case (keyword == "on" || keyword == "ignoring") && afterBinaryOp && next == tokLeftParen:
+				skip = true
+				vectorMatching = true
+			case (keyword == "group_left" || keyword == "group_right") && afterMatching:
+				skip = next == tokLeftParen
+			case (keyword == "by" || keyword == "without") && afterAggregation && next == tokLeftParen:
+				skip = true
+			case promqlAggregations[keyword] && (nextKeyword == "by" || nextKeyword == "without"):
+				aggregation = true
+			case next == tokLeftParen:
+				// A function call or an aggregation.
+			case next == tokLeftBrace:
+				// A metric name followed by label matchers, see above.
+			case keyword == "inf" || keyword == "nan":
+				expectExpr = false
+			default:
+				// A metric name without label matchers.
+				edits = append(edits, edit{pos: t.end, text: Format(matchers)})
+				expectExpr = false
+			}
+			if skip {
+				// A list of label names: skip it.
+				closing, err := matching(tokens, i+1)
+				if err != nil {
+					return "", err
+				}
+				i = closing
+			}
+		}
+		afterAggregation, afterComparison, afterBinaryOp, afterMatching = aggregation, comparison, binaryOp, vectorMatching
+	}
+	if expectExpr && len(tokens) > 0 {
+		return "", fmt.Errorf("unexpected end of query")
+	}
+
+	return applyEdits(query, edits), nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParse(t *testing.T, selector string) []*labels.Matcher {
+	matchers, err := Parse(selector)
+	assert.NoError(t, err)
+	return matchers
+}
+
+func TestParse(t *testing.T) {
+	matchers := mustParse(t, `{team="payments", env=~'prod|staging', region!=`+"`eu`"+`,}`)
+	assert.Equal(t, `{team="payments", env=~"prod|staging", region!="eu"}`, Format(matchers))
+
+	assert.Empty(t, mustParse(t, " "))
+	assert.Empty(t, mustParse(t, "{}"))
+
+	for _, bad := range []string{
+		`team="payments"`,
+		`{team}`,
+		`{team=payments}`,
+		`{team=="payments"}`,
+		`{team="a" env="b"}`,
+		`{team=~"("}`,
+		`{team="payments"`,
+	} {
+		_, err := Parse(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestInjectPromQL(t *testing.T) {
+	matchers := mustParse(t, `{team="payments"}`)
+
+	for _, tc := range []struct{ query, expected string }{
+		{`up`, `up{team="payments"}`},
+		{`up{job="node"}`, `up{job="node", team="payments"}`},
+		{`up{job="node",}`, `up{job="node",team="payments"}`},
+		{`{__name__=~"http_.*"}`, `{__name__=~"http_.*", team="payments"}`},
+		{`up {}`, `up {team="payments"}`},
+		{`rate(http_requests[5m])`, `rate(http_requests{team="payments"}[5m])`},
+		{
+			`sum by (job) (rate(http_requests{code=~"5.."}[5m])) / ignoring(code) group_left sum(rate(http_requests[5m]))`,
+			`sum by (job) (rate(http_requests{code=~"5..", team="payments"}[5m])) / ` +
+				`ignoring(code) group_left sum(rate(http_requests{team="payments"}[5m]))`,
+		},
+		{`SUM(up) WITHOUT (instance)`, `SUM(up{team="payments"}) WITHOUT (instance)`},
+		{
+			`a and on(job) b or c unless d`,
+			`a{team="payments"} and on(job) b{team="payments"} or c{team="payments"} unless d{team="payments"}`,
+		},
+		{`max_over_time(deriv(up[1h:5m])[1d:]) offset 5m`, `max_over_time(deriv(up{team="payments"}[1h:5m])[1d:]) offset 5m`},
+		{`count_values("version", build_info)`, `count_values("version", build_info{team="payments"})`},
+		{
+			`label_replace(up, "dst", "{$1}", "src", "(.*)")`,
+			`label_replace(up{team="payments"}, "dst", "{$1}", "src", "(.*)")`,
+		},
+		{`node:cpu:rate5m > bool 0.5`, `node:cpu:rate5m{team="payments"} > bool 0.5`},
+		{"up # comment with {braces}\n", `up{team="payments"} # comment with {braces}` + "\n"},
+		{`1 + 2 * time()`, `1 + 2 * time()`},
+		{`vector(1) > Inf`, `vector(1) > Inf`},
+		// Keywords are metric names where an expression is expected.
+		{`rate(count[5m])`, `rate(count{team="payments"}[5m])`},
+		{`1 + count`, `1 + count{team="payments"}`},
+		{`sum offset 5m`, `sum{team="payments"} offset 5m`},
+		{`group`, `group{team="payments"}`},
+		{`topk(3, max)`, `topk(3, max{team="payments"})`},
+		{`and or on`, `and{team="payments"} or on{team="payments"}`},
+		{`bool > bool bool`, `bool{team="payments"} > bool bool{team="payments"}`},
+		{`sum(by) by (job)`, `sum(by{team="payments"}) by (job)`},
+		{`rate(offset[5m] offset 1m)`, `rate(offset{team="payments"}[5m] offset 1m)`},
+		{`a / on(job) group_left(env) b`, `a{team="payments"} / on(job) group_left(env) b{team="payments"}`},
+	} {
+		injected, err := InjectPromQL(tc.query, matchers)
+		if assert.NoError(t, err, tc.query) {
+			assert.Equal(t, tc.expected, injected, tc.query)
+		}
+	}
+
+	for _, bad := range []string{
+		`up{job="node"`, `up{job="node}`, `sum by (job`, `up; drop`, "up{job=\"é\"} é",
+		`up count`, `sum(up) count`, `group_left / ignoring (x) group_right`, `up +`,
+	} {
+		_, err := InjectPromQL(bad, matchers)
+		assert.Error(t, err, bad)
+	}
+
+	// Nothing to enforce.
+	injected, err := InjectPromQL(`up{`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `up{`, injected)
+}
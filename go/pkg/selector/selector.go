@@ -0,0 +1,137 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selector restricts PromQL and LogQL queries to the series (or log
+// streams) matching a label selector, by injecting its label matchers into
+// every selector of a query, similar to prom-label-proxy.
+package selector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+var matchTypes = map[string]labels.MatchType{
+	"=":  labels.MatchEqual,
+	"!=": labels.MatchNotEqual,
+	"=~": labels.MatchRegexp,
+	"!~": labels.MatchNotRegexp,
+}
+
+/*
+Parse a label selector without metric name, such as
+`{team="payments", env=~"prod|staging"}`, into its label matchers. An empty
+string yields no matchers.
+*/
+func Parse(selector string) ([]*labels.Matcher, error) {
+	if strings.TrimSpace(selector) == "" {
+		return nil, nil
+	}
+
+	tokens, err := lex(selector)
+	if err != nil {
+		return nil, fmt.Errorf("bad selector %s: %w", selector, err)
+	}
+	if len(tokens) < 2 || tokens[0].kind != tokLeftBrace || tokens[len(tokens)-1].kind != tokRightBrace {
+		return nil, fmt.Errorf("bad selector %s: expected {...}", selector)
+	}
+
+	var matchers []*labels.Matcher
+	inner := tokens[1 : len(tokens)-1]
+	for len(inner) > 0 {
+		if len(inner) < 3 || inner[0].kind != tokIdentifier || inner[1].kind != tokOperator ||
+			inner[2].kind != tokString {
+			return nil, fmt.Errorf("bad selector %s: expected label matcher at position %d", selector, inner[0].start)
+		}
+		mtype, ok := matchTypes[inner[1].text]
+		if !ok {
+			return nil, fmt.Errorf("bad selector %s: unknown match operator %s", selector, inner[1].text)
+		}
+		value, err := unquote(inner[2].text)
+		if err != nil {
+			return nil, fmt.Errorf("bad selector %s: %w", selector, err)
+		}
+		m, err := labels.NewMatcher(mtype, inner[0].text, value)
+		if err != nil {
+			return nil, fmt.Errorf("bad selector %s: %w", selector, err)
+		}
+		matchers = append(matchers, m)
+
+		inner = inner[3:]
+		if len(inner) > 0 {
+			if inner[0].kind != tokComma {
+				return nil, fmt.Errorf("bad selector %s: expected comma at position %d", selector, inner[0].start)
+			}
+			inner = inner[1:]
+		}
+	}
+	return matchers, nil
+}
+
+// Format `matchers` as a selector, such as `{team="payments"}`.
+func Format(matchers []*labels.Matcher) string {
+	return "{" + formatMatchers(matchers) + "}"
+}
+
+func formatMatchers(matchers []*labels.Matcher) string {
+	s := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		s = append(s, m.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// Unquote a PromQL/LogQL string literal.
+func unquote(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		// Go only has single-quoted rune literals: use double quotes.
+		inner := strings.ReplaceAll(s[1:len(s)-1], `\'`, `'`)
+		s = `"` + strings.ReplaceAll(inner, `"`, `\"`) + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+/*
+Inject `matchers` into the selector formed by tokens[open:closing+1] (a `{...}`
+block), by recording an edit that inserts them before the closing brace.
+*/
+func injectIntoBraces(tokens []token, open int, closing int, matchers []*labels.Matcher, edits *[]edit) {
+	text := formatMatchers(matchers)
+	if closing > open+1 && tokens[closing-1].kind != tokComma {
+		text = ", " + text
+	}
+	*edits = append(*edits, edit{pos: tokens[closing].start, text: text})
+}
+
+// An insertion of `text` at byte offset `pos` of a query.
+type edit struct {
+	pos  int
+	text string
+}
+
+// Apply `edits` (ordered by position) to `query`.
+func applyEdits(query string, edits []edit) string {
+	var b strings.Builder
+	last := 0
+	for _, e := range edits {
+		b.WriteString(query[last:e.pos])
+		b.WriteString(e.text)
+		last = e.pos
+	}
+	b.WriteString(query[last:])
+	return b.String()
+}
@@ -0,0 +1,2 @@
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+CREATE TABLE "public"."token_revocation"("id" uuid NOT NULL DEFAULT gen_random_uuid(), "tenant" text NOT NULL, "jti" text, "not_before" timestamptz, "created_at" timestamptz NOT NULL DEFAULT now(), PRIMARY KEY ("id") , FOREIGN KEY ("tenant") REFERENCES "public"."tenant"("name") ON UPDATE cascade ON DELETE cascade, CONSTRAINT "token_revocation_jti_or_not_before" CHECK ("jti" IS NOT NULL OR "not_before" IS NOT NULL));